@@ -5,7 +5,6 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
@@ -13,17 +12,11 @@ import (
 	"time"
 
 	"github.com/goccy/go-json"
-
-	"github.com/joho/godotenv"
 )
 
-// Get admin password from env, default to "admin"
+// Get admin password from config/env, default to "admin"
 func getAdminPassword() string {
-	pw := os.Getenv("ADMIN_PASSWORD")
-	if pw == "" {
-		pw = "admin"
-	}
-	return pw
+	return currentSettings().AdminPassword
 }
 
 // checkAuth verifies basic authentication
@@ -78,7 +71,7 @@ func configWebHandler(w http.ResponseWriter, r *http.Request) {
 	defer f.Close()
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if _, err := io.Copy(w, f); err != nil {
-		log.Printf("Error serving web UI: %v", err)
+		httpLogger.Warn("serving web UI failed", "error", err)
 	}
 }
 
@@ -93,15 +86,16 @@ func healthHandler() http.HandlerFunc {
 			"service":   "ant2oa",
 			"timestamp": time.Now().Format(time.RFC3339),
 		}); err != nil {
-			log.Printf("Error encoding health response: %v", err)
+			httpLogger.Warn("encoding health response failed", "error", err)
 		}
 	}
 }
 
 // enhancedHealthHandler checks both service and upstream health
-func enhancedHealthHandler(upstreamBase string) http.HandlerFunc {
+func enhancedHealthHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		upstreamBase := currentSettings().BaseURL
 
 		// Check upstream connectivity
 		upstreamStatus := "ok"
@@ -154,15 +148,18 @@ func enhancedHealthHandler(upstreamBase string) http.HandlerFunc {
 			"timestamp":           time.Now().Format(time.RFC3339),
 			"upstream_status":     upstreamStatus,
 			"upstream_latency_ms": upstreamLatency,
-			"rate_limit_enabled":  rateLimitEnabled,
+			"rate_limit_enabled":  rateLimitEnabled(),
+			"last_reload":         lastReload.Load(),
 		}); err != nil {
-			log.Printf("Error encoding health response: %v", err)
+			httpLogger.Warn("encoding health response failed", "error", err)
 		}
 	}
 }
 
-func messagesHandler(base, model string) http.HandlerFunc {
+func messagesHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentSettings()
+		model := cfg.Model
 		auth := r.Header.Get("Authorization")
 		if auth == "" {
 			auth = r.Header.Get("x-api-key")
@@ -190,11 +187,38 @@ func messagesHandler(base, model string) http.HandlerFunc {
 			return
 		}
 		if err := json.Unmarshal(b, &req); err != nil {
-			log.Printf("JSON Unmarshal Error: %v", err)
+			requestLogger(r.Context(), httpLogger).Warn("invalid request body", "error", err)
 			http.Error(w, "bad request: "+err.Error(), 400)
 			return
 		}
 
+		// Target Model & Routing
+		targetModel := model
+		if req.Model != "" {
+			targetModel = req.Model
+		}
+
+		_, span := startSpan(r.Context(), "route", spanKindInternal)
+		route := resolveRoute(targetModel, cfg)
+		routeLabel := "default"
+		if route.Route != nil {
+			routeLabel = route.Route.Pattern
+		}
+		span.setAttr("gen_ai.request.model", targetModel)
+		span.setAttr("ant2oa.route", routeLabel)
+		span.setAttr("ant2oa.upstream_model", route.Model)
+		span.finish()
+		st := statsFrom(r.Context())
+		st.RequestedModel = targetModel
+		st.setUpstream(routeLabel, route.Upstream, route.Model, req.Stream)
+		st.Price = lookupPrice(route.Route, route.Model, cfg)
+		st.Capture = newCapture(r, st, route.Route, b)
+		st.ToolNames = newToolMapper(route.Route, req.Tools)
+		upstreamAuth := auth
+		if route.AuthKey != "" {
+			upstreamAuth = "Bearer " + route.AuthKey
+		}
+
 		// 1. Build OpenAI Tools
 		var oaTools []OATool
 		if len(req.Tools) > 0 {
@@ -203,38 +227,34 @@ func messagesHandler(base, model string) http.HandlerFunc {
 				oaTools[i] = OATool{
 					Type: "function",
 					Function: OAFunction{
-						Name:        t.Name,
+						Name:        st.ToolNames.upstreamName(t.Name),
 						Description: t.Description,
 						Parameters:  t.InputSchema,
 					},
 				}
+				if keepCacheControl(route.Route) {
+					oaTools[i].CacheControl = t.CacheControl
+				}
 			}
 		}
 
-		// 2. Build OpenAI Messages
-		finalMessages := buildOpenAIMessages(req)
-
-		// Target Model & Routing
-		targetModel := model
-		if req.Model != "" {
-			targetModel = req.Model
+		// Strict upstreams reject parts of JSON Schema
+		if route.Route != nil && route.Route.Tools != toolsPrompted {
+			sanitizeTools(oaTools, route.Route.Schema, requestLogger(r.Context(), proxyLogger))
 		}
 
-		upstreamBase, upstreamAuthKey := getUpstreamForModel(targetModel, base)
-		upstreamAuth := auth
-		if upstreamAuthKey != "" {
-			upstreamAuth = "Bearer " + upstreamAuthKey
-		}
+		// 2. Build OpenAI Messages
+		finalMessages := buildOpenAIMessages(r.Context(), req, route.Route, st.ToolNames)
 
 		// Extract numeric parameters with type safety
 		maxTokens := extractMaxTokens(req.MaxTokens)
 		temp := extractTemperature(req.Temperature)
 		stopSequences := req.StopSequences
-		toolChoice := normalizeToolChoice(req.ToolChoice)
+		toolChoice := st.ToolNames.toolChoice(normalizeToolChoice(req.ToolChoice))
 
 		// Build final request map
 		oaReqMap := map[string]any{
-			"model":    targetModel,
+			"model":    route.Model,
 			"messages": finalMessages,
 			"stream":   req.Stream,
 		}
@@ -247,26 +267,66 @@ func messagesHandler(base, model string) http.HandlerFunc {
 		if stopSequences != nil {
 			oaReqMap["stop_sequences"] = stopSequences
 		}
-		if len(oaTools) > 0 {
-			oaReqMap["tools"] = oaTools
+		if route.Route != nil && route.Route.PromptCache == promptCacheKey {
+			if key := promptCacheKeyFor(req); key != "" {
+				oaReqMap["prompt_cache_key"] = key
+			}
 		}
-		if toolChoice != nil {
-			oaReqMap["tool_choice"] = toolChoice
+		if route.Route != nil && route.Route.Tools == toolsPrompted {
+			st.PromptedTools = true
+			oaReqMap["messages"] = promptedMessages(finalMessages, promptedToolsPrompt(req.Tools, req.ToolChoice))
+		} else {
+			if len(oaTools) > 0 {
+				oaReqMap["tools"] = oaTools
+			}
+			if toolChoice != nil {
+				oaReqMap["tool_choice"] = toolChoice
+			}
 		}
 
-		forwardOAMap(w, r, upstreamBase, upstreamAuth, oaReqMap, req.Stream)
+		// Strict chat templates and continuing a partial assistant turn
+		messages := oaReqMap["messages"].([]map[string]any)
+		messages, st.Prefill = applyPrefill(oaReqMap, messages, route.Route)
+		if route.Route != nil && route.Route.Messages == messagesStrict {
+			messages = normalizeMessages(messages)
+		}
+		oaReqMap["messages"] = messages
+
+		forwardOAMap(st.Capture.wrap(w), r, route.Upstream, upstreamAuth, oaReqMap, req.Stream)
 	}
 }
 
-// buildOpenAIMessages 构建 OpenAI 兼容的消息格式
-func buildOpenAIMessages(req AnthropicMessagesReq) []map[string]any {
+// buildOpenAIMessages 构建 OpenAI 兼容的消息格式, with tool names and IDs
+// renamed by tm and images and documents converted for the route
+func buildOpenAIMessages(ctx context.Context, req AnthropicMessagesReq, route *RouteConfig, tm *toolMapper) []map[string]any {
 	messages := make([]map[string]any, 0)
+	logger := requestLogger(ctx, proxyLogger)
+	docMode := documentsText
+	if route != nil && route.Documents != "" {
+		docMode = route.Documents
+	}
+	imgOpts := routeImageOptions(route)
+	image := func(src *AnthropicSource) OAContentPart {
+		return imagePart(ctx, src, imgOpts, logger)
+	}
+	media := func(p AnthropicContent) []OAContentPart {
+		if p.Type == "document" {
+			return documentParts(p, docMode, image, logger)
+		}
+		return []OAContentPart{image(p.Source)}
+	}
 
 	// Handle System
+	keepCache := keepCacheControl(route)
+	cacheControl := func(p AnthropicContent) json.RawMessage {
+		if keepCache {
+			return p.CacheControl
+		}
+		return nil
+	}
 	if len(req.System) > 0 {
-		sysText := parseComplexContent(req.System)
-		if sysText != "" {
-			messages = append(messages, map[string]any{"role": "system", "content": sysText})
+		if sys := systemContent(req.System, keepCache); !contentEmpty(sys) {
+			messages = append(messages, map[string]any{"role": "system", "content": sys})
 		}
 	}
 
@@ -297,42 +357,27 @@ func buildOpenAIMessages(req AnthropicMessagesReq) []map[string]any {
 				messages = append(messages, map[string]any{"role": "system", "content": txt})
 			}
 		case "user":
-			var oaParts []OAContentPart
+			// Tool messages only hold text, so attachments of tool results
+			// go to the user message that follows them
+			var oaParts, lifted []OAContentPart
 			for _, p := range parts {
 				switch p.Type {
 				case "text":
 					if p.Text != "" {
-						oaParts = append(oaParts, OAContentPart{Type: "text", Text: p.Text})
-					}
-				case "image":
-					if p.Source != nil && p.Source.Type == "base64" {
-						oaParts = append(oaParts, OAContentPart{
-							Type: "image_url",
-							ImageURL: &OAImageURL{
-								URL: "data:" + p.Source.MediaType + ";base64," + p.Source.Data,
-							},
-						})
+						oaParts = append(oaParts, OAContentPart{Type: "text", Text: p.Text, CacheControl: cacheControl(p)})
 					}
+				case "image", "document":
+					oaParts = append(oaParts, withCacheControl(media(p), cacheControl(p))...)
 				case "tool_result":
-					contentStr := ""
-					if len(p.Content) > 0 {
-						var s string
-						if err := json.Unmarshal(p.Content, &s); err == nil {
-							contentStr = s
-						} else {
-							contentStr = string(p.Content)
-						}
-					}
-					messages = append(messages, map[string]any{
-						"role":         "tool",
-						"tool_call_id": p.ToolUseID,
-						"content":      contentStr,
-					})
+					msg, attached := toolResultMessage(p, tm.upstreamID(p.ToolUseID), route, media)
+					messages = append(messages, msg)
+					lifted = append(lifted, attached...)
 				}
 			}
 
+			oaParts = append(lifted, oaParts...)
 			if len(oaParts) > 0 {
-				if len(oaParts) == 1 && oaParts[0].Type == "text" {
+				if len(oaParts) == 1 && oaParts[0].Type == "text" && oaParts[0].CacheControl == nil {
 					messages = append(messages, map[string]any{"role": "user", "content": oaParts[0].Text})
 				} else {
 					messages = append(messages, map[string]any{"role": "user", "content": oaParts})
@@ -344,18 +389,22 @@ func buildOpenAIMessages(req AnthropicMessagesReq) []map[string]any {
 
 		case "assistant":
 			txt := ""
+			var textParts []OAContentPart // Only kept if one has a breakpoint
+			marked := false
 			var toolCalls []map[string]any
 
 			for _, p := range parts {
 				switch p.Type {
 				case "text":
 					txt += p.Text
+					textParts = append(textParts, OAContentPart{Type: "text", Text: p.Text, CacheControl: cacheControl(p)})
+					marked = marked || cacheControl(p) != nil
 				case "tool_use":
 					toolCalls = append(toolCalls, map[string]any{
-						"id":   p.ID,
+						"id":   tm.upstreamID(p.ID),
 						"type": "function",
 						"function": map[string]string{
-							"name":      p.Name,
+							"name":      tm.upstreamName(p.Name),
 							"arguments": string(p.Input),
 						},
 					})
@@ -365,6 +414,9 @@ func buildOpenAIMessages(req AnthropicMessagesReq) []map[string]any {
 				"role":    "assistant",
 				"content": txt,
 			}
+			if marked {
+				msg["content"] = textParts
+			}
 			if len(toolCalls) > 0 {
 				msg["tool_calls"] = toolCalls
 			}
@@ -380,7 +432,7 @@ func buildOpenAIMessages(req AnthropicMessagesReq) []map[string]any {
 		}
 	}
 
-	return messages
+	return fixToolAdjacency(messages)
 }
 
 // extractMaxTokens 安全提取 max_tokens 参数
@@ -419,8 +471,10 @@ func extractTemperature(temp any) float64 {
 	return 0
 }
 
-func completeHandler(base, model string) http.HandlerFunc {
+func completeHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentSettings()
+		base, model := cfg.BaseURL, cfg.Model
 		auth := r.Header.Get("Authorization")
 		if auth == "" {
 			auth = r.Header.Get("x-api-key")
@@ -440,7 +494,7 @@ func completeHandler(base, model string) http.HandlerFunc {
 			return
 		}
 		if err := json.Unmarshal(b, &req); err != nil {
-			log.Printf("complete JSON Unmarshal Error: %v", err)
+			requestLogger(r.Context(), httpLogger).Warn("invalid request body", "error", err)
 			http.Error(w, "bad request: "+err.Error(), 400)
 			return
 		}
@@ -464,12 +518,23 @@ func completeHandler(base, model string) http.HandlerFunc {
 			oaReqMap["temperature"] = req.Temperature
 		}
 
-		forwardOAMap(w, r, base, auth, oaReqMap, req.Stream)
+		if cfg.AuthKey != "" {
+			auth = "Bearer " + cfg.AuthKey
+		}
+
+		st := statsFrom(r.Context())
+		st.RequestedModel = targetModel
+		st.setUpstream("default", base, targetModel, req.Stream)
+		st.Price = lookupPrice(nil, targetModel, cfg)
+		st.Capture = newCapture(r, st, nil, b)
+		forwardOAMap(st.Capture.wrap(w), r, base, auth, oaReqMap, req.Stream)
 	}
 }
 
-func modelsHandler(base string) http.HandlerFunc {
+func modelsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentSettings()
+		base := cfg.BaseURL
 		auth := r.Header.Get("Authorization")
 		if auth == "" {
 			auth = r.Header.Get("x-api-key")
@@ -477,6 +542,9 @@ func modelsHandler(base string) http.HandlerFunc {
 		if auth != "" && !strings.HasPrefix(auth, "Bearer ") {
 			auth = "Bearer " + auth
 		}
+		if cfg.AuthKey != "" {
+			auth = "Bearer " + cfg.AuthKey
+		}
 
 		// Handle Gemini's /v1beta path
 		modelURL := strings.TrimSuffix(base, "/")
@@ -500,6 +568,9 @@ func modelsHandler(base string) http.HandlerFunc {
 			req.Header.Set("Authorization", auth)
 		}
 
+		st := statsFrom(r.Context())
+		st.setUpstream("default", base, "", false)
+		st.UpstreamStart = time.Now()
 		resp, err := HttpClient.Do(req)
 		if err != nil {
 			http.Error(w, err.Error(), 502)
@@ -509,7 +580,7 @@ func modelsHandler(base string) http.HandlerFunc {
 
 		var oaResp OAModelsResp
 		if err := json.NewDecoder(resp.Body).Decode(&oaResp); err != nil {
-			log.Printf("modelsHandler upstream decode error: %v", err)
+			requestLogger(r.Context(), proxyLogger).Warn("upstream models response decode failed", "error", err)
 		}
 
 		anthResp := AnthropicModelsResp{
@@ -541,16 +612,17 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "GET" {
-		_ = godotenv.Load(configEnvPath())
+		env, _ := readEnvFile()
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(map[string]string{
-			"listenAddr":     os.Getenv("LISTEN_ADDR"),
-			"baseUrl":        os.Getenv("OPENAI_BASE_URL"),
-			"model":          os.Getenv("OPENAI_MODEL"),
-			"rateLimit":      os.Getenv("RATE_LIMIT"),
-			"maxRequestSize": os.Getenv("MAX_REQUEST_SIZE"),
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"listenAddr":     env.get("LISTEN_ADDR"),
+			"baseUrl":        env.get("OPENAI_BASE_URL"),
+			"model":          env.get("OPENAI_MODEL"),
+			"rateLimit":      env.get("RATE_LIMIT"),
+			"maxRequestSize": env.get("MAX_REQUEST_SIZE"),
+			"lastReload":     lastReload.Load(),
 		}); err != nil {
-			log.Printf("Error encoding config response: %v", err)
+			configLogger.Warn("encoding config response failed", "error", err)
 		}
 		return
 	}
@@ -624,14 +696,41 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err := os.WriteFile(envPath, []byte(strings.Join(newLines, "\n")), 0600); err != nil {
-			log.Printf("Error writing .env file: %v", err)
+			configLogger.Error("writing env file failed", "path", envPath, "error", err)
 			http.Error(w, "failed to save config", 500)
 			return
 		}
-		w.WriteHeader(200)
-		w.Write([]byte(`{"status":"ok"}`))
+
+		// Apply immediately; a bad value leaves the running config in place
+		reloadConfig("api")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":     "ok",
+			"lastReload": lastReload.Load(),
+		})
 		return
 	}
 
 	http.Error(w, "method not allowed", 405)
 }
+
+// reloadHandler triggers a config reload and reports the result
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ant2oa"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := http.StatusOK
+	if err := reloadConfig("api"); err != nil {
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(lastReload.Load())
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
 	"sync"
 	"time"
@@ -9,9 +14,14 @@ import (
 )
 
 type APIKeyConfig struct {
-	RateLimit int    `json:"rate_limit"` // RPM
-	Role      string `json:"role"`       // "user", "admin"
-	Active    bool   `json:"active"`
+	Name              string  `json:"name,omitempty"` // Human-readable label, safe to log
+	RateLimit         int     `json:"rate_limit"`     // RPM
+	Role              string  `json:"role"`           // "user", "admin"
+	Active            bool    `json:"active"`
+	ClientCertSubject string  `json:"client_cert_subject,omitempty"` // mTLS subject ("CN=..." or full DN) that authenticates as this key
+	BudgetUSD         float64 `json:"budget_usd,omitempty"`          // Spend limit per period, 0 = unlimited
+	BudgetPeriod      string  `json:"budget_period,omitempty"`       // "day", "month" (default) or "total"
+	Capture           bool    `json:"capture,omitempty"`             // Record every request for debugging
 }
 
 var (
@@ -65,26 +75,72 @@ func (rl *RateLimiter) Allow() bool {
 	return false
 }
 
-// loadAPIKeys loads keys from keys.json
-func loadAPIKeys() error {
+// readAPIKeys parses keys.json without applying it
+func readAPIKeys() (map[string]*APIKeyConfig, error) {
 	data, err := os.ReadFile("keys.json")
 	if os.IsNotExist(err) {
-		return nil
+		return nil, nil
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var keys map[string]*APIKeyConfig
 	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for k, cfg := range keys {
+		if err := validateKeyConfig(cfg); err != nil {
+			return nil, fmt.Errorf("key %s: %w", MaskKey(k), err)
+		}
+	}
+	return keys, nil
+}
+
+// validateKeyConfig checks one keys.json entry
+func validateKeyConfig(cfg *APIKeyConfig) error {
+	if cfg == nil {
+		return errors.New("empty config")
+	}
+	if cfg.RateLimit < 0 {
+		return errors.New("rate_limit must be >= 0")
+	}
+	if cfg.BudgetUSD < 0 {
+		return errors.New("budget_usd must be >= 0")
+	}
+	if !validBudgetPeriod(cfg.BudgetPeriod) {
+		return errors.New("budget_period must be day, month or total")
+	}
+	return nil
+}
+
+// writeAPIKeys atomically replaces keys.json
+func writeAPIKeys(keys map[string]*APIKeyConfig) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := "keys.json.tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
 		return err
 	}
+	return os.Rename(tmp, "keys.json")
+}
 
+// setAPIKeys swaps in a new key set. Limiters of removed keys or keys whose
+// rate limit changed are dropped so the new limit takes effect immediately.
+func setAPIKeys(keys map[string]*APIKeyConfig) {
 	apiKeysMutex.Lock()
 	apiKeys = keys
-	// Reset limiters if needed? for now just keep simple
 	apiKeysMutex.Unlock()
-	return nil
+
+	limitersMu.Lock()
+	for k, l := range keyLimiters {
+		if cfg, ok := keys[k]; !ok || l == nil || cfg.RateLimit != l.max {
+			delete(keyLimiters, k)
+		}
+	}
+	limitersMu.Unlock()
 }
 
 // validateAPIKey checks key validity and rate limit
@@ -124,3 +180,41 @@ func validateAPIKey(key string) (bool, *APIKeyConfig) {
 
 	return true, config
 }
+
+// keyForClientCert returns the key mapped to a verified client certificate,
+// matching either the full subject DN or just "CN=<common name>".
+func keyForClientCert(cert *x509.Certificate) string {
+	subject, cn := cert.Subject.String(), "CN="+cert.Subject.CommonName
+
+	apiKeysMutex.RLock()
+	defer apiKeysMutex.RUnlock()
+	for key, cfg := range apiKeys {
+		if cfg.ClientCertSubject != "" && (cfg.ClientCertSubject == subject || cfg.ClientCertSubject == cn) {
+			return key
+		}
+	}
+	return ""
+}
+
+// keyLabel identifies a client key in metrics and logs without exposing it:
+// the configured name, or a short hash for unnamed and unknown keys.
+func keyLabel(key string, cfg *APIKeyConfig) string {
+	if cfg != nil && cfg.Name != "" {
+		return cfg.Name
+	}
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// keyID identifies a client key for budgets. Unlike the label it stays the
+// same when the key is renamed and differs between keys with one name.
+func keyID(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
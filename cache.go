@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Prompt Caching =================
+
+// Route prompt cache modes for the client's cache_control breakpoints.
+// Without one they are dropped, which suits upstreams that cache on their
+// own (OpenAI, DeepSeek).
+const (
+	promptCacheControl = "cache_control" // Keep cache_control on parts and tools (OpenRouter, LiteLLM, DashScope)
+	promptCacheKey     = "key"           // Send prompt_cache_key for the prefix up to the last breakpoint (OpenAI)
+)
+
+func validPromptCache(s string) bool {
+	return s == "" || s == promptCacheControl || s == promptCacheKey
+}
+
+// keepCacheControl reports whether the route forwards cache_control
+func keepCacheControl(route *RouteConfig) bool {
+	return route != nil && route.PromptCache == promptCacheControl
+}
+
+// systemContent flattens the system prompt to a string, or to text parts
+// when it has breakpoints that should reach the upstream
+func systemContent(raw json.RawMessage, keepCache bool) any {
+	if !keepCache {
+		return parseComplexContent(raw)
+	}
+	var blocks []AnthropicContent
+	if json.Unmarshal(raw, &blocks) != nil {
+		return parseComplexContent(raw)
+	}
+	var parts []OAContentPart
+	marked := false
+	for _, b := range blocks {
+		if b.Type != "text" {
+			continue
+		}
+		parts = append(parts, OAContentPart{Type: "text", Text: b.Text, CacheControl: b.CacheControl})
+		marked = marked || b.CacheControl != nil
+	}
+	if !marked {
+		return parseComplexContent(raw)
+	}
+	return parts
+}
+
+// withCacheControl puts a block's breakpoint on the last of the parts it
+// was converted to
+func withCacheControl(parts []OAContentPart, cc json.RawMessage) []OAContentPart {
+	if cc != nil && len(parts) > 0 {
+		parts[len(parts)-1].CacheControl = cc
+	}
+	return parts
+}
+
+// promptCacheKeyFor hashes the request up to its last cache_control
+// breakpoint, in Anthropic's cache order of tools, system and messages, so
+// requests sharing that prefix share a key. It is empty without breakpoints.
+func promptCacheKeyFor(req AnthropicMessagesReq) string {
+	var fragments []string
+	last := -1
+	add := func(raw []byte, marked bool) {
+		fragments = append(fragments, string(raw))
+		if marked {
+			last = len(fragments) - 1
+		}
+	}
+	blocks := func(raw json.RawMessage) {
+		var list []json.RawMessage
+		if json.Unmarshal(raw, &list) != nil {
+			add(raw, false)
+			return
+		}
+		for _, b := range list {
+			var head struct {
+				CacheControl json.RawMessage `json:"cache_control"`
+			}
+			json.Unmarshal(b, &head)
+			add(b, head.CacheControl != nil)
+		}
+	}
+
+	for _, t := range req.Tools {
+		b, _ := json.Marshal(t)
+		add(b, t.CacheControl != nil)
+	}
+	if len(req.System) > 0 {
+		blocks(req.System)
+	}
+	for _, m := range req.Messages {
+		add([]byte(m.Role), false)
+		blocks(m.Content)
+	}
+	if last < 0 {
+		return ""
+	}
+	return "ant2oa-" + shortHash(strings.Join(fragments[:last+1], "\n"), 32)
+}
+
+// anthropicUsage reports the upstream's usage the way Anthropic does, with
+// cache reads and writes counted apart from input_tokens
+func (st *requestStats) anthropicUsage() anthropicUsage {
+	return anthropicUsage{
+		InputTokens:              max(0, st.InputTokens-st.CachedTokens-st.CacheWriteTokens),
+		OutputTokens:             st.OutputTokens,
+		CacheCreationInputTokens: st.CacheWriteTokens,
+		CacheReadInputTokens:     st.CachedTokens,
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Debug Capture =================
+
+// CaptureConfig controls debug capture. A request is captured when its key
+// or route has capture enabled, or when it is picked by sampling.
+type CaptureConfig struct {
+	Dir         string  // One JSON file per request, named by capture ID
+	SampleRatio float64 // Share of all requests captured
+	MaxFiles    int     // Oldest captures are removed beyond this
+}
+
+// captureLimit caps each recorded stream so a long response can't exhaust memory
+const captureLimit = 4 << 20
+
+// Capture is the stored record of one request
+type Capture struct {
+	ID             string            `json:"id"`         // Names the file, see newCaptureID
+	RequestID      string            `json:"request_id"` // As sent by the client or generated
+	Time           time.Time         `json:"time"`
+	Endpoint       string            `json:"endpoint"`
+	Key            string            `json:"key,omitempty"`
+	RequestedModel string            `json:"requested_model,omitempty"`
+	Route          string            `json:"route,omitempty"`
+	Upstream       string            `json:"upstream,omitempty"`
+	Model          string            `json:"model,omitempty"`
+	Stream         bool              `json:"stream"`
+	Status         int               `json:"status"`
+	UpstreamStatus int               `json:"upstream_status,omitempty"`
+	DurationMs     int64             `json:"duration_ms"`
+	Truncated      bool              `json:"truncated,omitempty"`
+	RequestHeaders map[string]string `json:"request_headers"`
+
+	AnthropicRequest  any            `json:"anthropic_request"`
+	OpenAIRequest     any            `json:"openai_request,omitempty"`
+	UpstreamBody      any            `json:"upstream_body,omitempty"`   // Non-streaming upstream response
+	UpstreamChunks    []captureEvent `json:"upstream_chunks,omitempty"` // Streaming upstream response
+	AnthropicResponse any            `json:"anthropic_response,omitempty"`
+	AnthropicEvents   []captureEvent `json:"anthropic_events,omitempty"`
+}
+
+// captureEvent is one SSE event with its time since the request started
+type captureEvent struct {
+	TimeMs int64  `json:"t_ms"`
+	Event  string `json:"event,omitempty"`
+	Data   any    `json:"data"`
+}
+
+// capture collects a request while it is being proxied. All methods are
+// safe on a nil capture, which means the request isn't captured.
+type capture struct {
+	mu        sync.Mutex
+	rec       Capture
+	start     time.Time
+	upstream  timedBuffer
+	emitted   timedBuffer
+	streaming bool
+}
+
+// newCapture decides whether to capture a request and, if so, starts
+// recording it with the original request body
+func newCapture(r *http.Request, st *requestStats, route *RouteConfig, body []byte) *capture {
+	cfg := currentSettings().Capture
+	if cfg.Dir == "" {
+		return nil
+	}
+	want := (st.KeyConfig != nil && st.KeyConfig.Capture) || (route != nil && route.Capture) ||
+		(cfg.SampleRatio > 0 && rand.Float64() < cfg.SampleRatio)
+	if !want {
+		return nil
+	}
+
+	c := &capture{start: st.Start}
+	c.rec.RequestHeaders = make(map[string]string)
+	for k, v := range r.Header {
+		switch strings.ToLower(k) {
+		case "authorization", "x-api-key", "cookie", "proxy-authorization":
+			c.rec.RequestHeaders[k] = "[redacted]"
+		default:
+			c.rec.RequestHeaders[k] = strings.Join(v, ", ")
+		}
+	}
+	c.rec.AnthropicRequest = redactJSON(body)
+	return c
+}
+
+func (c *capture) openAIRequest(body []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.rec.OpenAIRequest = redactJSON(body)
+	c.mu.Unlock()
+}
+
+// upstreamResponse records the upstream status and tees the body as it is read
+func (c *capture) upstreamResponse(resp *http.Response, stream bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.rec.UpstreamStatus = resp.StatusCode
+	c.streaming = stream && resp.StatusCode == http.StatusOK
+	c.mu.Unlock()
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, captureSink{c, &c.upstream}), resp.Body}
+}
+
+// wrap returns a ResponseWriter that also records what is sent to the client
+func (c *capture) wrap(w http.ResponseWriter) http.ResponseWriter {
+	if c == nil {
+		return w
+	}
+	return &captureWriter{ResponseWriter: w, sink: captureSink{c, &c.emitted}}
+}
+
+type captureSink struct {
+	c   *capture
+	buf *timedBuffer
+}
+
+func (s captureSink) Write(p []byte) (int, error) {
+	s.c.mu.Lock()
+	s.buf.write(p, time.Since(s.c.start))
+	s.c.mu.Unlock()
+	return len(p), nil
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	sink captureSink
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	cw.sink.Write(p)
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *captureWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// save writes the capture once the response is complete
+func (c *capture) save(endpoint string, st *requestStats, status int, end time.Time) {
+	if c == nil {
+		return
+	}
+	cfg := currentSettings().Capture
+	if cfg.Dir == "" {
+		return
+	}
+
+	c.mu.Lock()
+	rec := c.rec
+	rec.ID = newCaptureID(st.Start)
+	rec.RequestID, rec.Time, rec.Endpoint = st.RequestID, st.Start.UTC(), endpoint
+	rec.Key, rec.RequestedModel, rec.Route = st.Key, st.RequestedModel, st.Route
+	rec.Upstream, rec.Model, rec.Stream = st.Upstream, st.Model, st.Stream
+	rec.Status, rec.DurationMs = status, end.Sub(st.Start).Milliseconds()
+	rec.Truncated = c.upstream.truncated || c.emitted.truncated
+	if c.streaming {
+		rec.UpstreamChunks = c.upstream.events()
+		rec.AnthropicEvents = c.emitted.events()
+	} else {
+		rec.UpstreamBody = redactJSON(c.upstream.buf.Bytes())
+		rec.AnthropicResponse = redactJSON(c.emitted.buf.Bytes())
+	}
+	c.mu.Unlock()
+
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		httpLogger.Error("capture encode failed", "request_id", st.RequestID, "error", err)
+		return
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		httpLogger.Error("capture dir create failed", "dir", cfg.Dir, "error", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Dir, rec.ID+".json"), b, 0600); err != nil {
+		httpLogger.Error("capture write failed", "request_id", st.RequestID, "error", err)
+		return
+	}
+	pruneCaptures(cfg)
+}
+
+// timedBuffer is a byte buffer that remembers when each write happened
+type timedBuffer struct {
+	buf       bytes.Buffer
+	marks     []timedMark
+	truncated bool
+}
+
+type timedMark struct {
+	end int // Buffer length after the write
+	at  time.Duration
+}
+
+func (b *timedBuffer) write(p []byte, at time.Duration) {
+	if n := captureLimit - b.buf.Len(); len(p) > n {
+		p = p[:max(n, 0)]
+		b.truncated = true
+	}
+	if len(p) == 0 {
+		return
+	}
+	b.buf.Write(p)
+	b.marks = append(b.marks, timedMark{b.buf.Len(), at})
+}
+
+// events splits the buffer into SSE events, each timed by the write that
+// completed it
+func (b *timedBuffer) events() []captureEvent {
+	data := b.buf.Bytes()
+	var out []captureEvent
+	pos, mark := 0, 0
+	for pos < len(data) {
+		n := bytes.Index(data[pos:], []byte("\n\n"))
+		end := len(data)
+		if n >= 0 {
+			end = pos + n + 2
+		}
+		for mark < len(b.marks)-1 && b.marks[mark].end < end {
+			mark++
+		}
+		ev := captureEvent{TimeMs: b.marks[mark].at.Milliseconds()}
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data[pos:end])), "\n") {
+			if v, ok := strings.CutPrefix(line, "event:"); ok {
+				ev.Event = strings.TrimSpace(v)
+			} else if v, ok := strings.CutPrefix(line, "data:"); ok {
+				lines = append(lines, strings.TrimSpace(v))
+			} else if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) > 0 {
+			ev.Data = redactJSON([]byte(strings.Join(lines, "\n")))
+			out = append(out, ev)
+		}
+		pos = end
+	}
+	return out
+}
+
+// ================= Redaction =================
+
+var (
+	secretValuePattern = regexp.MustCompile(`\b(sk-|sk_|key-)[A-Za-z0-9_\-]{8,}`)
+	secretFieldNames   = map[string]bool{
+		"authorization": true, "api_key": true, "apikey": true, "x-api-key": true,
+		"password": true, "secret": true, "access_token": true, "auth_key": true,
+	}
+)
+
+// redactJSON parses b and redacts secrets and inline images. Bodies that
+// aren't JSON are kept as (redacted) text.
+func redactJSON(b []byte) any {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return redactString(string(b))
+	}
+	return redactValue(v)
+}
+
+func redactValue(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		// Anthropic base64 sources: {"type": "base64", "media_type": ..., "data": ...}
+		if x["type"] == "base64" {
+			if d, ok := x["data"].(string); ok {
+				x["data"] = "[" + strconv.Itoa(len(d)) + " bytes redacted]"
+			}
+		}
+		for k, val := range x {
+			if secretFieldNames[strings.ToLower(k)] {
+				if _, ok := val.(string); ok {
+					x[k] = "[redacted]"
+					continue
+				}
+			}
+			x[k] = redactValue(val)
+		}
+		return x
+	case []any:
+		for i := range x {
+			x[i] = redactValue(x[i])
+		}
+		return x
+	case string:
+		return redactString(x)
+	}
+	return v
+}
+
+func redactString(s string) string {
+	// Data URLs, e.g. OpenAI image_url parts
+	if strings.HasPrefix(s, "data:") {
+		if i := strings.Index(s, ";base64,"); i >= 0 {
+			return s[:i+8] + "[" + strconv.Itoa(len(s)-i-8) + " bytes redacted]"
+		}
+	}
+	return secretValuePattern.ReplaceAllString(s, "${1}[redacted]")
+}
+
+// ================= Storage & Admin API =================
+
+// newCaptureID names a capture by its start time and a random suffix. Client
+// request IDs can repeat and hold characters some filesystems reject, so
+// they are only stored inside the capture.
+func newCaptureID(start time.Time) string {
+	return fmt.Sprintf("%s-%08x", start.UTC().Format("20060102T150405.000Z"), rand.Uint32())
+}
+
+var captureIDPattern = regexp.MustCompile(`^\d{8}T\d{6}\.\d{3}Z-[0-9a-f]{8}$`)
+
+// pruneCaptures removes the oldest captures beyond MaxFiles
+func pruneCaptures(cfg CaptureConfig) {
+	if cfg.MaxFiles <= 0 {
+		return
+	}
+	files, err := captureFiles(cfg.Dir)
+	if err != nil || len(files) <= cfg.MaxFiles {
+		return
+	}
+	for _, f := range files[cfg.MaxFiles:] {
+		os.Remove(filepath.Join(cfg.Dir, f.Name()))
+	}
+}
+
+// captureFiles lists capture files, newest first
+func captureFiles(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	return files, nil
+}
+
+// captureSummary is a capture without bodies, for listing
+type captureSummary struct {
+	ID             string    `json:"id"`
+	RequestID      string    `json:"request_id"`
+	Time           time.Time `json:"time"`
+	Endpoint       string    `json:"endpoint"`
+	Key            string    `json:"key,omitempty"`
+	RequestedModel string    `json:"requested_model,omitempty"`
+	Model          string    `json:"model,omitempty"`
+	Stream         bool      `json:"stream"`
+	Status         int       `json:"status"`
+	DurationMs     int64     `json:"duration_ms"`
+}
+
+// capturesHandler serves the capture admin API:
+// GET /api/captures lists captures, GET /api/captures/{id} returns one and
+// DELETE /api/captures/{id} removes it
+func capturesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ant2oa"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	dir := currentSettings().Capture.Dir
+	if dir == "" {
+		http.Error(w, "capture is disabled", http.StatusNotFound)
+		return
+	}
+
+	id := r.PathValue("id")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := 100
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			limit = n
+		}
+		files, err := captureFiles(dir)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := make([]captureSummary, 0, min(limit, len(files)))
+		for _, f := range files {
+			if len(list) >= limit {
+				break
+			}
+			b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				continue
+			}
+			var s captureSummary
+			if json.Unmarshal(b, &s) == nil {
+				list = append(list, s)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"captures": list})
+		return
+	}
+
+	if !captureIDPattern.MatchString(id) {
+		http.Error(w, "invalid capture id", http.StatusBadRequest)
+		return
+	}
+	path := filepath.Join(dir, id+".json")
+	switch r.Method {
+	case http.MethodGet:
+		b, err := os.ReadFile(path)
+		if err != nil {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case http.MethodDelete:
+		if err := os.Remove(path); err != nil {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// capturesWebHandler serves the side-by-side capture viewer
+func capturesWebHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ant2oa"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	b, err := webFS.ReadFile("web/captures.html")
+	if err != nil {
+		http.Error(w, "Web UI not found", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b)
+}
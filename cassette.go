@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Record & Replay =================
+
+// Cassette modes
+const (
+	cassetteOff    = ""
+	cassetteRecord = "record"
+	cassetteReplay = "replay"
+)
+
+// CassetteConfig controls recording upstream exchanges and serving them
+// back instead of calling the upstream
+type CassetteConfig struct {
+	Mode     string // "", "record" or "replay"
+	Dir      string
+	Realtime bool // Replay with the recorded delays instead of at once
+}
+
+func validCassetteMode(m string) bool {
+	switch m {
+	case cassetteOff, cassetteRecord, cassetteReplay:
+		return true
+	}
+	return false
+}
+
+// Cassette is one recorded upstream exchange
+type Cassette struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+type CassetteRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Body   any    `json:"body,omitempty"`
+}
+
+type CassetteResponse struct {
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	HeaderMs int64             `json:"header_ms"` // Time until the response headers arrived
+	Chunks   []CassetteChunk   `json:"chunks"`
+}
+
+// CassetteChunk is one read of the response body, in arrival order
+type CassetteChunk struct {
+	TimeMs int64  `json:"t_ms"`
+	Data   string `json:"data"`
+}
+
+// cassetteTransport records or replays upstream exchanges depending on the
+// current settings, and passes requests through when cassettes are off
+type cassetteTransport struct {
+	base http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := currentSettings().Cassette
+	if cfg.Mode == cassetteOff {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	key := cassetteKey(req.Method, req.URL.Path, body)
+	path := filepath.Join(cfg.Dir, key+".json")
+	logger := requestLogger(req.Context(), proxyLogger)
+
+	if cfg.Mode == cassetteReplay {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			logger.Warn("no cassette for upstream request", "cassette", key, "method", req.Method, "path", req.URL.Path)
+			return cassetteMiss(req, key), nil
+		}
+		var c Cassette
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, err
+		}
+		logger.Debug("replaying cassette", "cassette", key)
+		return c.Response.replay(req, cfg.Realtime)
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	rec := &cassetteRecorder{
+		ReadCloser: resp.Body,
+		path:       path,
+		start:      start,
+		head:       req.Method == http.MethodHead,
+	}
+	rec.c.Request = CassetteRequest{Method: req.Method, Path: req.URL.Path}
+	if len(body) > 0 {
+		rec.c.Request.Body = json.RawMessage(body)
+		if !json.Valid(body) {
+			rec.c.Request.Body = string(body)
+		}
+	}
+	rec.c.Response = CassetteResponse{
+		Status:   resp.StatusCode,
+		Headers:  make(map[string]string),
+		HeaderMs: time.Since(start).Milliseconds(),
+	}
+	for k, v := range resp.Header {
+		switch k {
+		case "Set-Cookie", "Date", "Content-Length":
+			continue
+		}
+		rec.c.Response.Headers[k] = strings.Join(v, ", ")
+	}
+	resp.Body = rec
+	return resp, nil
+}
+
+// cassetteKey identifies a request by method, path and body. The upstream
+// host and credentials are left out so cassettes work against any base URL.
+func cassetteKey(method, path string, body []byte) string {
+	// Re-encode JSON so key order and whitespace don't matter
+	var v any
+	if json.Unmarshal(body, &v) == nil {
+		if b, err := json.Marshal(v); err == nil {
+			body = b
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// cassetteMiss answers an unrecorded request with a 404, which isn't
+// retried, so replay runs fail fast
+func cassetteMiss(req *http.Request, key string) *http.Response {
+	b, _ := json.Marshal(map[string]any{"error": map[string]any{
+		"type":    "cassette_not_found",
+		"message": "no cassette " + key + " for " + req.Method + " " + req.URL.Path,
+	}})
+	return &http.Response{
+		Status:        "404 Not Found",
+		StatusCode:    http.StatusNotFound,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}
+}
+
+// replay builds a response that yields the recorded chunks one read at a
+// time, so streaming code sees the same chunk boundaries as when recording
+func (cr *CassetteResponse) replay(req *http.Request, realtime bool) (*http.Response, error) {
+	start := time.Now()
+	if realtime {
+		if err := sleepCtx(req, start, cr.HeaderMs); err != nil {
+			return nil, err
+		}
+	}
+	h := make(http.Header, len(cr.Headers))
+	for k, v := range cr.Headers {
+		h.Set(k, v)
+	}
+	return &http.Response{
+		Status:     strconv.Itoa(cr.Status) + " " + http.StatusText(cr.Status),
+		StatusCode: cr.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+		Body: &cassettePlayer{
+			chunks:   cr.Chunks,
+			req:      req,
+			start:    start,
+			realtime: realtime,
+		},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+func sleepCtx(req *http.Request, start time.Time, ms int64) error {
+	d := time.Until(start.Add(time.Duration(ms) * time.Millisecond))
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// cassettePlayer is a replayed response body
+type cassettePlayer struct {
+	chunks   []CassetteChunk
+	req      *http.Request
+	start    time.Time
+	realtime bool
+	pending  []byte
+}
+
+func (p *cassettePlayer) Read(b []byte) (int, error) {
+	if len(p.pending) == 0 {
+		if len(p.chunks) == 0 {
+			return 0, io.EOF
+		}
+		c := p.chunks[0]
+		p.chunks = p.chunks[1:]
+		if p.realtime {
+			if err := sleepCtx(p.req, p.start, c.TimeMs); err != nil {
+				return 0, err
+			}
+		}
+		p.pending = []byte(c.Data)
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *cassettePlayer) Close() error { return nil }
+
+// cassetteRecorder tees a response body into a cassette, written when the
+// body is closed. Whatever the reader left unread (e.g. after a stream's
+// [DONE]) is drained first; bodies that fail before the end aren't saved.
+type cassetteRecorder struct {
+	io.ReadCloser
+	c     Cassette
+	path  string
+	start time.Time
+	head  bool
+	eof   bool
+	once  sync.Once
+}
+
+func (r *cassetteRecorder) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.c.Response.Chunks = append(r.c.Response.Chunks, CassetteChunk{
+			TimeMs: time.Since(r.start).Milliseconds(),
+			Data:   string(b[:n]),
+		})
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *cassetteRecorder) Close() error {
+	if !r.head {
+		io.Copy(io.Discard, r)
+	}
+	err := r.ReadCloser.Close()
+	if r.eof || r.head {
+		r.once.Do(r.save)
+	}
+	return err
+}
+
+func (r *cassetteRecorder) save() {
+	if r.c.Response.Chunks == nil {
+		r.c.Response.Chunks = []CassetteChunk{}
+	}
+	b, err := json.MarshalIndent(r.c, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(r.path), 0755); err == nil {
+			err = os.WriteFile(r.path, b, 0644)
+		}
+	}
+	if err != nil {
+		proxyLogger.Error("cassette write failed", "path", r.path, "error", err)
+		return
+	}
+	proxyLogger.Debug("recorded cassette", "path", r.path, "status", r.c.Response.Status, "chunks", len(r.c.Response.Chunks))
+}
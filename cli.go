@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Command Line =================
+
+const usageText = `Usage: ant2oa [command] [flags]
+
+Commands:
+  serve                     Run the proxy server (default)
+  install [flags]           Install and start the systemd service
+  uninstall [flags]         Stop and remove the systemd service
+  keys add [flags]          Create a client key in keys.json
+  keys list                 List client keys
+  keys revoke <key|name>    Deactivate a client key
+  routes test [model]       Show which route and upstream a model resolves to
+  config check              Validate the configuration
+  status [--addr URL]       Query a running instance
+  mock-upstream [flags]     Serve scripted OpenAI-compatible test scenarios
+  conformance [flags]       Check /v1/messages output against the scenarios
+
+Run 'ant2oa <command> -h' for command flags.
+`
+
+// runCLI dispatches to a subcommand and returns the exit code
+func runCLI(args []string) int {
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	// Legacy flags from before subcommands existed
+	if cmd == "serve" && len(args) > 0 {
+		switch args[0] {
+		case "-install", "--install":
+			cmd, args = "install", args[1:]
+		case "-uninstall", "--uninstall":
+			cmd, args = "uninstall", args[1:]
+		}
+	}
+
+	switch cmd {
+	case "serve":
+		return serve(args)
+	case "install", "uninstall":
+		return serviceCommand(cmd, args)
+	case "keys":
+		return keysCommand(args)
+	case "routes":
+		return routesCommand(args)
+	case "config":
+		if len(args) == 1 && args[0] == "check" {
+			return configCheck()
+		}
+		fmt.Fprint(os.Stderr, "Usage: ant2oa config check\n")
+		return 2
+	case "status":
+		return statusCommand(args)
+	case "mock-upstream":
+		return mockUpstreamCommand(args)
+	case "conformance":
+		return conformanceCommand(args)
+	case "help":
+		fmt.Print(usageText)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usageText)
+		return 2
+	}
+}
+
+func serviceCommand(cmd string, args []string) int {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	var opts installOptions
+	fs.BoolVar(&opts.User, "user", false, "Use a user-level systemd unit (systemctl --user)")
+	fs.StringVar(&opts.Name, "name", "ant2oa", "Unit name, use different names to run several instances")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Print what would be done instead of doing it")
+	if cmd == "install" {
+		fs.StringVar(&opts.ConfigDir, "config-dir", "", "Working directory with env/keys.json/routes.json/ant2oa.yaml (default: directory of the binary)")
+		fs.StringVar(&opts.RunAs, "run-as", "ant2oa", "Dedicated service user for system units (\"root\" to disable)")
+		fs.StringVar(&opts.Args, "args", "", "Extra flags passed to 'serve'")
+		fs.StringVar(&opts.Socket, "socket", "", "Enable socket activation on these addresses (comma separated, e.g. 8080 or /run/ant2oa.sock)")
+	}
+	fs.Parse(args)
+
+	if opts.Name == "" || strings.ContainsAny(opts.Name, "/ ") {
+		fmt.Fprintf(os.Stderr, "invalid unit name %q\n", opts.Name)
+		return 2
+	}
+
+	var err error
+	if cmd == "install" {
+		err = installService(opts)
+	} else {
+		err = uninstallService(opts)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// ================= keys =================
+
+func keysCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, "Usage: ant2oa keys add|list|revoke\n")
+		return 2
+	}
+
+	env, _ := readEnvFile()
+	if fc, _ := readConfigFile(env.configFilePath(), env); fc != nil && fc.Keys != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s defines keys; keys.json is ignored while it does\n", env.configFilePath())
+	}
+
+	keys, err := readAPIKeys()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keys.json: %v\n", err)
+		return 1
+	}
+	if keys == nil {
+		keys = make(map[string]*APIKeyConfig)
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("keys add", flag.ExitOnError)
+		name := fs.String("name", "", "Label for the key")
+		key := fs.String("key", "", "Use this key instead of generating one")
+		rateLimit := fs.Int("rate-limit", 0, "Per-key RPM limit (0 = unlimited)")
+		role := fs.String("role", "user", "Role: user or admin")
+		budget := fs.Float64("budget", 0, "Spend limit in USD per budget period (0 = unlimited)")
+		budgetPeriod := fs.String("budget-period", "", "Budget period: day, month (default) or total")
+		fs.Parse(args[1:])
+
+		if *key == "" {
+			*key = generateAPIKey()
+		}
+		if _, exists := keys[*key]; exists {
+			fmt.Fprintln(os.Stderr, "key already exists")
+			return 1
+		}
+		if *role != "user" && *role != "admin" {
+			fmt.Fprintf(os.Stderr, "invalid role %q\n", *role)
+			return 2
+		}
+		cfg := &APIKeyConfig{Name: *name, RateLimit: *rateLimit, Role: *role, Active: true,
+			BudgetUSD: *budget, BudgetPeriod: *budgetPeriod}
+		if err := validateKeyConfig(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid key: %v\n", err)
+			return 2
+		}
+		keys[*key] = cfg
+		if err := writeAPIKeys(keys); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write keys.json: %v\n", err)
+			return 1
+		}
+		fmt.Println(*key)
+		return 0
+
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tNAME\tROLE\tRATE LIMIT\tBUDGET\tACTIVE")
+		for _, k := range sortedKeys(keys) {
+			cfg := keys[k]
+			limit := "unlimited"
+			if cfg.RateLimit > 0 {
+				limit = fmt.Sprintf("%d rpm", cfg.RateLimit)
+			}
+			budget := "unlimited"
+			if cfg.BudgetUSD > 0 {
+				period := cfg.BudgetPeriod
+				if period == "" {
+					period = budgetMonth
+				}
+				budget = fmt.Sprintf("$%g/%s", cfg.BudgetUSD, period)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\n", MaskKey(k), cfg.Name, cfg.Role, limit, budget, cfg.Active)
+		}
+		tw.Flush()
+		return 0
+
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, "Usage: ant2oa keys revoke <key|name>\n")
+			return 2
+		}
+		var matched []string
+		for k, cfg := range keys {
+			if k == args[1] || (cfg.Name != "" && cfg.Name == args[1]) {
+				matched = append(matched, k)
+			}
+		}
+		if len(matched) != 1 {
+			fmt.Fprintf(os.Stderr, "%d keys match %q, expected exactly one\n", len(matched), args[1])
+			return 1
+		}
+		keys[matched[0]].Active = false
+		if err := writeAPIKeys(keys); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write keys.json: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Revoked %s\n", MaskKey(matched[0]))
+		return 0
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown keys command %q\n", args[0])
+		return 2
+	}
+}
+
+func generateAPIKey() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "sk-ant2oa-" + hex.EncodeToString(b)
+}
+
+func sortedKeys(keys map[string]*APIKeyConfig) []string {
+	out := make([]string, 0, len(keys))
+	for k := range keys {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if keys[out[i]].Name != keys[out[j]].Name {
+			return keys[out[i]].Name < keys[out[j]].Name
+		}
+		return out[i] < out[j]
+	})
+	return out
+}
+
+// ================= routes =================
+
+func routesCommand(args []string) int {
+	if len(args) < 1 || args[0] != "test" || len(args) > 2 {
+		fmt.Fprint(os.Stderr, "Usage: ant2oa routes test [model]\n")
+		return 2
+	}
+
+	env, err := readEnvFile()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg, err := loadConfig(env)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	setModelRoutes(cfg.Routes)
+
+	model := cfg.Settings.Model
+	if len(args) == 2 {
+		model = args[1]
+	}
+	if model == "" {
+		fmt.Fprintln(os.Stderr, "no model given and no default model configured")
+		return 2
+	}
+
+	res := resolveRoute(model, cfg.Settings)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Model:\t%s\n", model)
+	if res.Route != nil {
+		fmt.Fprintf(tw, "Route:\t#%d %s\n", res.Index, res.Route.Pattern)
+	} else {
+		fmt.Fprintf(tw, "Route:\tdefault upstream (no pattern matched)\n")
+	}
+	fmt.Fprintf(tw, "Upstream:\t%s\n", res.Upstream)
+	fmt.Fprintf(tw, "Upstream model:\t%s\n", res.Model)
+	if res.AuthKey != "" {
+		fmt.Fprintf(tw, "Auth:\tconfigured key %s\n", MaskKey(res.AuthKey))
+	} else {
+		fmt.Fprintf(tw, "Auth:\tclient key forwarded\n")
+	}
+	tw.Flush()
+	return 0
+}
+
+// ================= status =================
+
+func statusCommand(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("addr", "", "Base URL of the running instance (default derived from the listen address)")
+	timeout := fs.Duration("timeout", 5*time.Second, "Request timeout")
+	fs.Parse(args)
+
+	base, client := *addr, http.DefaultClient
+	if base == "" {
+		env, _ := readEnvFile()
+		listeners := parseListenAddrs(env.get("LISTEN_ADDR"))
+		if cfg, err := loadConfig(env); err == nil {
+			listeners = cfg.Settings.Listeners
+		}
+		var l ListenerConfig
+		if len(listeners) > 0 {
+			l = listeners[0]
+		}
+		base, client = localURL(l)
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	var health map[string]any
+	healthCode, err := fetchJSON(ctx, client, base+"/health", &health)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is not reachable: %v\n", base, err)
+		return 1
+	}
+	var m map[string]any
+	_, metricsErr := fetchJSON(ctx, client, base+"/metrics/json", &m)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Instance:\t%s\n", base)
+	fmt.Fprintf(tw, "Status:\t%v\n", health["status"])
+	fmt.Fprintf(tw, "Upstream:\t%v (%vms)\n", health["upstream_status"], health["upstream_latency_ms"])
+	fmt.Fprintf(tw, "Rate limit:\t%v\n", health["rate_limit_enabled"])
+	if lr, ok := health["last_reload"].(map[string]any); ok {
+		result := "ok"
+		if ok, _ := lr["ok"].(bool); !ok {
+			result = fmt.Sprintf("failed: %v", lr["error"])
+		}
+		fmt.Fprintf(tw, "Last reload:\t%v (%v) %s\n", lr["time"], lr["trigger"], result)
+	}
+	if metricsErr == nil {
+		fmt.Fprintf(tw, "Uptime:\t%s\n", (time.Duration(toFloat(m["uptime_seconds"])) * time.Second).String())
+		fmt.Fprintf(tw, "Requests:\t%v total, %v ok, %v errors\n", m["total_requests"], m["success_requests"], m["error_requests"])
+		fmt.Fprintf(tw, "Upstream:\t%v errors, %v retries\n", m["upstream_errors"], m["upstream_retries"])
+		fmt.Fprintf(tw, "Active connections:\t%v\n", m["active_connections"])
+		fmt.Fprintf(tw, "Latency:\tavg %.1fms, p50 %.0fms, p95 %.0fms, p99 %.0fms\n", toFloat(m["avg_latency_ms"]),
+			toFloat(m["latency_p50_ms"]), toFloat(m["latency_p95_ms"]), toFloat(m["latency_p99_ms"]))
+		fmt.Fprintf(tw, "Time to first token:\tp50 %.0fms, p95 %.0fms\n", toFloat(m["ttft_p50_ms"]), toFloat(m["ttft_p95_ms"]))
+	} else {
+		fmt.Fprintf(tw, "Metrics:\tunavailable (%v)\n", metricsErr)
+	}
+	tw.Flush()
+
+	if healthCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// localURL turns a listener into a URL and client reachable from this host.
+// Unix sockets are dialed directly; TLS listeners are probed without
+// certificate verification since we only talk to ourselves.
+func localURL(l ListenerConfig) (string, *http.Client) {
+	if l.isUnix() {
+		path := l.unixPath()
+		return "http://unix", &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}}
+	}
+
+	scheme, client := "http", http.DefaultClient
+	if l.TLS != nil {
+		scheme = "https"
+		client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+	}
+	listen := l.Addr
+	if listen == "" {
+		listen = ":8080"
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return scheme + "://" + listen, client
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), client
+}
+
+func fetchJSON(ctx context.Context, client *http.Client, url string, v any) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp.StatusCode, nil
+}
+
+func toFloat(v any) float64 {
+	f, _ := v.(float64)
+	return f
+}
@@ -0,0 +1,800 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ================= Structured Config (ant2oa.yaml) =================
+
+// FileConfig is the optional single config file. Every section is optional;
+// anything left out falls back to the legacy sources (env vars, keys.json,
+// routes.json), which keep working unchanged.
+type FileConfig struct {
+	Listen    string                    `yaml:"listen"` // Shorthand for listeners, comma separated
+	Listeners []ListenerConfig          `yaml:"listeners"`
+	Upstream  UpstreamConfig            `yaml:"upstream"`
+	Providers map[string]UpstreamConfig `yaml:"providers"`
+	Routes    []RouteConfig             `yaml:"routes"`
+	Prices    map[string]Price          `yaml:"prices"` // Upstream model -> price
+	Keys      []KeyEntry                `yaml:"keys"`
+	Limits    LimitsConfig              `yaml:"limits"`
+	Logging   LoggingConfig             `yaml:"logging"`
+	Metrics   MetricsConfig             `yaml:"metrics"`
+	Usage     UsageConfig               `yaml:"usage"`
+	Tracing   TracingFileConfig         `yaml:"tracing"`
+	Capture   CaptureFileConfig         `yaml:"capture"`
+	Cassette  CassetteFileConfig        `yaml:"cassette"`
+	Admin     AdminConfig               `yaml:"admin"`
+}
+
+// UpstreamConfig describes an OpenAI-compatible upstream
+type UpstreamConfig struct {
+	BaseURL    string `yaml:"base_url"`
+	Model      string `yaml:"model"`
+	APIKey     string `yaml:"api_key"`
+	APIKeyFile string `yaml:"api_key_file"`
+}
+
+// KeyEntry is a client key in ant2oa.yaml. Unlike keys.json, keys are
+// active unless explicitly disabled.
+type KeyEntry struct {
+	Name      string `yaml:"name"`
+	Key       string `yaml:"key"`
+	KeyFile   string `yaml:"key_file"`
+	RateLimit int    `yaml:"rate_limit"`
+	Role      string `yaml:"role"`
+	Active    *bool  `yaml:"active"`
+	// mTLS certificate subject that authenticates as this key
+	ClientCertSubject string  `yaml:"client_cert_subject"`
+	BudgetUSD         float64 `yaml:"budget_usd"`
+	BudgetPeriod      string  `yaml:"budget_period"`
+	Capture           bool    `yaml:"capture"`
+}
+
+type LimitsConfig struct {
+	RateLimit      *int   `yaml:"rate_limit"`       // Global RPM
+	MaxRequestSize *int64 `yaml:"max_request_size"` // Bytes
+}
+
+type LoggingConfig struct {
+	File   string            `yaml:"file"`   // Append log output to this file instead of stderr
+	Format string            `yaml:"format"` // text or json
+	Level  string            `yaml:"level"`
+	Levels map[string]string `yaml:"levels"` // Subsystem -> level
+}
+
+type MetricsConfig struct {
+	Enabled        *bool `yaml:"enabled"`
+	MaxLabelValues *int  `yaml:"max_label_values"` // Distinct values per label before "other"
+}
+
+type UsageConfig struct {
+	File      string `yaml:"file"`        // Usage log path, "off" disables
+	MaxSizeMB *int   `yaml:"max_size_mb"` // Rotate after this many MB
+	MaxFiles  *int   `yaml:"max_files"`   // Rotated files to keep
+}
+
+type TracingFileConfig struct {
+	Endpoint    string            `yaml:"endpoint"` // OTLP collector URL
+	Protocol    string            `yaml:"protocol"` // http/json, http/protobuf or grpc
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	SampleRatio *float64          `yaml:"sample_ratio"`
+}
+
+type CaptureFileConfig struct {
+	Dir         string   `yaml:"dir"`          // Capture directory, "off" disables
+	SampleRatio *float64 `yaml:"sample_ratio"` // Share of all requests captured
+	MaxFiles    *int     `yaml:"max_files"`    // Captures to keep
+}
+
+type CassetteFileConfig struct {
+	Mode     string `yaml:"mode"` // record or replay
+	Dir      string `yaml:"dir"`
+	Realtime *bool  `yaml:"realtime"` // Replay with recorded delays
+}
+
+type AdminConfig struct {
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// Config is the fully resolved configuration from all sources
+type Config struct {
+	Settings *Settings
+	Keys     map[string]*APIKeyConfig
+	Routes   []RouteConfig
+}
+
+// ConfigError is a single problem found at a config path
+type ConfigError struct {
+	Path string
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// ConfigErrors collects every problem instead of stopping at the first
+type ConfigErrors []ConfigError
+
+func (es ConfigErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (es *ConfigErrors) add(path, format string, args ...any) {
+	*es = append(*es, ConfigError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// configFilePath returns the config file location (ANT2OA_CONFIG, default ant2oa.yaml)
+func configFilePath() string {
+	return currentEnv().configFilePath()
+}
+
+func (e envFile) configFilePath() string {
+	if p := e.get("ANT2OA_CONFIG"); p != "" {
+		return p
+	}
+	return "ant2oa.yaml"
+}
+
+// loadConfig resolves the configuration from ant2oa.yaml and the legacy
+// sources, with variables looked up in env. All errors are collected and
+// returned as ConfigErrors.
+func loadConfig(env envFile) (*Config, error) {
+	var errs ConfigErrors
+
+	path := env.configFilePath()
+	fc, err := readConfigFile(path, env)
+	if err != nil {
+		var ce ConfigErrors
+		if errors.As(err, &ce) {
+			errs = append(errs, ce...)
+		} else {
+			errs.add(path, "%v", err)
+		}
+	}
+	if fc == nil {
+		fc = &FileConfig{}
+	}
+
+	s := resolveSettings(fc, path, env, &errs)
+
+	// Keys: ant2oa.yaml takes precedence over keys.json
+	var keys map[string]*APIKeyConfig
+	if fc.Keys != nil {
+		keys = resolveKeys(fc.Keys, path, &errs)
+	} else if keys, err = readAPIKeys(); err != nil {
+		errs.add("keys.json", "%v", err)
+	}
+
+	// Routes: ant2oa.yaml takes precedence over routes.json
+	var routes []RouteConfig
+	if fc.Routes != nil {
+		routes = resolveRoutes(fc.Routes, fc.Providers, path+":routes", path, &errs)
+	} else if legacy, err := readModelRoutes(); err != nil {
+		errs.add("routes.json", "%v", err)
+	} else {
+		routes = resolveRoutes(legacy, nil, "routes.json", path, &errs)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &Config{Settings: s, Keys: keys, Routes: routes}, nil
+}
+
+// readConfigFile parses ant2oa.yaml, expanding ${ENV} references. A missing
+// file is not an error.
+func readConfigFile(path string, env envFile) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return &FileConfig{}, nil
+	}
+	doc := root.Content[0]
+
+	var errs ConfigErrors
+	interpolateNode(doc, path+":", env, &errs)
+	checkKnownFields(doc, reflect.TypeOf(FileConfig{}), path+":", &errs)
+
+	var fc FileConfig
+	if err := doc.Decode(&fc); err != nil {
+		var te *yaml.TypeError
+		if errors.As(err, &te) {
+			for _, msg := range te.Errors {
+				errs.add(path, "%s", msg)
+			}
+		} else {
+			errs.add(path, "%v", err)
+		}
+	}
+	if len(errs) > 0 {
+		return &fc, errs
+	}
+	return &fc, nil
+}
+
+var envRefPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolateNode expands ${VAR} and ${VAR:-default} in all scalar values.
+// "$$" produces a literal "$". Unset variables without a default are errors.
+func interpolateNode(n *yaml.Node, path string, env envFile, errs *ConfigErrors) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(n.Value, "$") {
+			return
+		}
+		n.Value = envRefPattern.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			if ref == "$$" {
+				return "$"
+			}
+			m := envRefPattern.FindStringSubmatch(ref)
+			if v, ok := env.lookup(m[1]); ok && v != "" {
+				return v
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			errs.add(path, "environment variable %s is not set", m[1])
+			return ""
+		})
+		// Expanded values get their type re-resolved (e.g. rate_limit: ${RPM})
+		if n.Style == 0 {
+			n.Tag = ""
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			interpolateNode(n.Content[i+1], joinPath(path, n.Content[i].Value), env, errs)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			interpolateNode(c, fmt.Sprintf("%s[%d]", path, i), env, errs)
+		}
+	case yaml.DocumentNode, yaml.AliasNode:
+		for _, c := range n.Content {
+			interpolateNode(c, path, env, errs)
+		}
+	}
+}
+
+// checkKnownFields reports mapping keys that don't correspond to a yaml
+// field of t, so typos don't get silently ignored.
+func checkKnownFields(n *yaml.Node, t reflect.Type, path string, errs *ConfigErrors) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fields[name] = f.Type
+			}
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			ft, ok := fields[key]
+			if !ok {
+				errs.add(joinPath(path, key), "unknown field (line %d)", n.Content[i].Line)
+				continue
+			}
+			checkKnownFields(n.Content[i+1], ft, joinPath(path, key), errs)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, c := range n.Content {
+			checkKnownFields(c, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			checkKnownFields(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value), errs)
+		}
+	}
+}
+
+// joinPath appends a field name to a config error path
+func joinPath(path, field string) string {
+	if strings.HasSuffix(path, ":") {
+		return path + field
+	}
+	return path + "." + field
+}
+
+// sourcePath names where a setting came from: the config file path or the
+// environment variable
+func sourcePath(inFile bool, filePath, env string) string {
+	if inFile {
+		return filePath
+	}
+	return env
+}
+
+// readSecret returns value, or the trimmed contents of file if set
+func readSecret(value, file, path string, errs *ConfigErrors) string {
+	if file == "" {
+		return value
+	}
+	if value != "" {
+		errs.add(path, "set either the value or the _file reference, not both")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		errs.add(path+"_file", "%v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// resolveSettings merges ant2oa.yaml over environment variables
+func resolveSettings(fc *FileConfig, path string, env envFile, errs *ConfigErrors) *Settings {
+	s := &Settings{
+		BaseURL:        env.get("OPENAI_BASE_URL"),
+		Model:          env.get("OPENAI_MODEL"),
+		AdminPassword:  env.get("ADMIN_PASSWORD"),
+		MaxRequestSize: 10 * 1024 * 1024,
+		MetricsEnabled: true,
+		MaxLabelValues: 100,
+		UsageLog:       UsageLogConfig{Path: "usage.jsonl", MaxSize: 100 << 20, MaxFiles: 10},
+	}
+
+	if v := env.get("RATE_LIMIT"); v != "" {
+		rpm, err := strconv.Atoi(v)
+		if err != nil || rpm < 0 {
+			errs.add("RATE_LIMIT", "invalid value '%s' (expected >=0 int)", v)
+		}
+		s.RateLimit = rpm
+	}
+	if v := env.get("MAX_REQUEST_SIZE"); v != "" {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil && size > 0 {
+			s.MaxRequestSize = size
+		}
+	}
+
+	s.Log.Format = "text"
+	if v := env.get("LOG_FORMAT"); v != "" {
+		s.Log.Format = v
+	}
+	if v := env.get("LOG_LEVEL"); v != "" {
+		if err := parseLogLevels(v, &s.Log); err != nil {
+			errs.add("LOG_LEVEL", "%v", err)
+		}
+	}
+
+	if v := env.get("METRICS_MAX_LABEL_VALUES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			errs.add("METRICS_MAX_LABEL_VALUES", "invalid value '%s' (expected >0 int)", v)
+		}
+		s.MaxLabelValues = n
+	}
+
+	if v := env.get("USAGE_LOG_FILE"); v != "" {
+		s.UsageLog.Path = v
+	}
+	if v := env.get("USAGE_LOG_MAX_SIZE"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb <= 0 {
+			errs.add("USAGE_LOG_MAX_SIZE", "invalid value '%s' (expected >0 MB)", v)
+		}
+		s.UsageLog.MaxSize = int64(mb) << 20
+	}
+	if v := env.get("USAGE_LOG_MAX_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs.add("USAGE_LOG_MAX_FILES", "invalid value '%s' (expected >=0 int)", v)
+		}
+		s.UsageLog.MaxFiles = n
+	}
+
+	s.Tracing = TracingConfig{
+		Endpoint:    env.get("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		Protocol:    env.get("OTEL_EXPORTER_OTLP_PROTOCOL"),
+		ServiceName: env.get("OTEL_SERVICE_NAME"),
+		SampleRatio: 1,
+	}
+	if v := env.get("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+		s.Tracing.Headers = make(map[string]string)
+		for _, kv := range strings.Split(v, ",") {
+			k, val, ok := strings.Cut(kv, "=")
+			if !ok {
+				errs.add("OTEL_EXPORTER_OTLP_HEADERS", "invalid entry %q (expected key=value)", kv)
+				continue
+			}
+			if uv, err := url.QueryUnescape(strings.TrimSpace(val)); err == nil {
+				val = uv
+			}
+			s.Tracing.Headers[strings.TrimSpace(k)] = val
+		}
+	}
+	if v := env.get("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			errs.add("OTEL_TRACES_SAMPLER_ARG", "invalid value '%s' (expected 0..1)", v)
+		}
+		s.Tracing.SampleRatio = ratio
+	}
+
+	s.Capture = CaptureConfig{Dir: "captures", MaxFiles: 1000}
+	if v := env.get("CAPTURE_DIR"); v != "" {
+		s.Capture.Dir = v
+	}
+	if v := env.get("CAPTURE_SAMPLE_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			errs.add("CAPTURE_SAMPLE_RATIO", "invalid value '%s' (expected 0..1)", v)
+		}
+		s.Capture.SampleRatio = ratio
+	}
+	if v := env.get("CAPTURE_MAX_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs.add("CAPTURE_MAX_FILES", "invalid value '%s' (expected >=0 int)", v)
+		}
+		s.Capture.MaxFiles = n
+	}
+
+	s.Cassette = CassetteConfig{Mode: env.get("CASSETTE_MODE"), Dir: "cassettes"}
+	if v := env.get("CASSETTE_DIR"); v != "" {
+		s.Cassette.Dir = v
+	}
+	if v := env.get("CASSETTE_REALTIME"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs.add("CASSETTE_REALTIME", "invalid value '%s' (expected true or false)", v)
+		}
+		s.Cassette.Realtime = b
+	}
+
+	switch {
+	case len(fc.Listeners) > 0:
+		s.Listeners = fc.Listeners
+	case fc.Listen != "":
+		s.Listeners = parseListenAddrs(fc.Listen)
+	default:
+		s.Listeners = parseListenAddrs(env.get("LISTEN_ADDR"))
+		if tlsCert := env.get("TLS_CERT_FILE"); tlsCert != "" {
+			for i := range s.Listeners {
+				if !s.Listeners[i].isUnix() {
+					s.Listeners[i].TLS = &TLSConfig{
+						CertFile:     tlsCert,
+						KeyFile:      env.get("TLS_KEY_FILE"),
+						ClientCAFile: env.get("TLS_CLIENT_CA_FILE"),
+					}
+				}
+			}
+		}
+	}
+	if len(s.Listeners) == 0 {
+		s.Listeners = []ListenerConfig{{Addr: ":8080"}}
+	}
+	for i, l := range s.Listeners {
+		validateListener(l, fmt.Sprintf("%s:listeners[%d]", path, i), errs)
+	}
+
+	if fc.Upstream.BaseURL != "" {
+		s.BaseURL = fc.Upstream.BaseURL
+	}
+	if fc.Upstream.Model != "" {
+		s.Model = fc.Upstream.Model
+	}
+	s.AuthKey = readSecret(fc.Upstream.APIKey, fc.Upstream.APIKeyFile, path+":upstream.api_key", errs)
+	if s.BaseURL == "" {
+		errs.add(path+":upstream.base_url", "required (or set OPENAI_BASE_URL)")
+	} else if !strings.HasPrefix(s.BaseURL, "http://") && !strings.HasPrefix(s.BaseURL, "https://") {
+		errs.add(path+":upstream.base_url", "must be an http(s) URL, got %q", s.BaseURL)
+	}
+
+	if fc.Limits.RateLimit != nil {
+		if *fc.Limits.RateLimit < 0 {
+			errs.add(path+":limits.rate_limit", "must be >= 0")
+		}
+		s.RateLimit = *fc.Limits.RateLimit
+	}
+	if fc.Limits.MaxRequestSize != nil {
+		if *fc.Limits.MaxRequestSize <= 0 {
+			errs.add(path+":limits.max_request_size", "must be > 0")
+		}
+		s.MaxRequestSize = *fc.Limits.MaxRequestSize
+	}
+
+	s.Log.File = fc.Logging.File
+	if fc.Logging.Format != "" {
+		s.Log.Format = fc.Logging.Format
+	}
+	if fc.Logging.Level != "" {
+		if err := s.Log.Level.UnmarshalText([]byte(fc.Logging.Level)); err != nil {
+			errs.add(path+":logging.level", "invalid level %q", fc.Logging.Level)
+		}
+	}
+	for _, sub := range slices.Sorted(maps.Keys(fc.Logging.Levels)) {
+		if err := setSubsystemLevel(&s.Log, sub, fc.Logging.Levels[sub]); err != nil {
+			errs.add(path+":logging.levels."+sub, "%v", err)
+		}
+	}
+	if s.Log.Format != "text" && s.Log.Format != "json" {
+		errs.add(sourcePath(fc.Logging.Format != "", path+":logging.format", "LOG_FORMAT"), "must be text or json, got %q", s.Log.Format)
+	}
+	if fc.Metrics.Enabled != nil {
+		s.MetricsEnabled = *fc.Metrics.Enabled
+	}
+	if fc.Metrics.MaxLabelValues != nil {
+		if *fc.Metrics.MaxLabelValues <= 0 {
+			errs.add(path+":metrics.max_label_values", "must be > 0")
+		}
+		s.MaxLabelValues = *fc.Metrics.MaxLabelValues
+	}
+
+	if fc.Usage.File != "" {
+		s.UsageLog.Path = fc.Usage.File
+	}
+	if fc.Usage.MaxSizeMB != nil {
+		if *fc.Usage.MaxSizeMB <= 0 {
+			errs.add(path+":usage.max_size_mb", "must be > 0")
+		}
+		s.UsageLog.MaxSize = int64(*fc.Usage.MaxSizeMB) << 20
+	}
+	if fc.Usage.MaxFiles != nil {
+		if *fc.Usage.MaxFiles < 0 {
+			errs.add(path+":usage.max_files", "must be >= 0")
+		}
+		s.UsageLog.MaxFiles = *fc.Usage.MaxFiles
+	}
+	if s.UsageLog.Path == "off" {
+		s.UsageLog.Path = ""
+	}
+
+	if fc.Tracing.Endpoint != "" {
+		s.Tracing.Endpoint = fc.Tracing.Endpoint
+	}
+	if fc.Tracing.Protocol != "" {
+		s.Tracing.Protocol = fc.Tracing.Protocol
+	}
+	if fc.Tracing.Headers != nil {
+		s.Tracing.Headers = fc.Tracing.Headers
+	}
+	if fc.Tracing.ServiceName != "" {
+		s.Tracing.ServiceName = fc.Tracing.ServiceName
+	}
+	if fc.Tracing.SampleRatio != nil {
+		if r := *fc.Tracing.SampleRatio; r < 0 || r > 1 {
+			errs.add(path+":tracing.sample_ratio", "must be between 0 and 1")
+		}
+		s.Tracing.SampleRatio = *fc.Tracing.SampleRatio
+	}
+	validateTracing(&s.Tracing,
+		sourcePath(fc.Tracing.Protocol != "", path+":tracing.protocol", "OTEL_EXPORTER_OTLP_PROTOCOL"),
+		sourcePath(fc.Tracing.Endpoint != "", path+":tracing.endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT"), errs)
+
+	if fc.Capture.Dir != "" {
+		s.Capture.Dir = fc.Capture.Dir
+	}
+	if fc.Capture.SampleRatio != nil {
+		if r := *fc.Capture.SampleRatio; r < 0 || r > 1 {
+			errs.add(path+":capture.sample_ratio", "must be between 0 and 1")
+		}
+		s.Capture.SampleRatio = *fc.Capture.SampleRatio
+	}
+	if fc.Capture.MaxFiles != nil {
+		if *fc.Capture.MaxFiles < 0 {
+			errs.add(path+":capture.max_files", "must be >= 0")
+		}
+		s.Capture.MaxFiles = *fc.Capture.MaxFiles
+	}
+	if s.Capture.Dir == "off" {
+		s.Capture.Dir = ""
+	}
+
+	if fc.Cassette.Mode != "" {
+		s.Cassette.Mode = fc.Cassette.Mode
+	}
+	if fc.Cassette.Dir != "" {
+		s.Cassette.Dir = fc.Cassette.Dir
+	}
+	if fc.Cassette.Realtime != nil {
+		s.Cassette.Realtime = *fc.Cassette.Realtime
+	}
+	if s.Cassette.Mode == "off" {
+		s.Cassette.Mode = cassetteOff
+	}
+	if !validCassetteMode(s.Cassette.Mode) {
+		errs.add(sourcePath(fc.Cassette.Mode != "", path+":cassette.mode", "CASSETTE_MODE"), "must be off, record or replay")
+	}
+
+	for _, model := range slices.Sorted(maps.Keys(fc.Prices)) {
+		p := fc.Prices[model]
+		validatePrice(&p, path+":prices."+model, errs)
+	}
+	s.Prices = fc.Prices
+
+	if pw := readSecret(fc.Admin.Password, fc.Admin.PasswordFile, path+":admin.password", errs); pw != "" {
+		s.AdminPassword = pw
+	}
+	if s.AdminPassword == "" {
+		s.AdminPassword = "admin"
+	}
+	return s
+}
+
+func resolveKeys(entries []KeyEntry, path string, errs *ConfigErrors) map[string]*APIKeyConfig {
+	keys := make(map[string]*APIKeyConfig, len(entries))
+	for i, e := range entries {
+		p := fmt.Sprintf("%s:keys[%d]", path, i)
+		key := readSecret(e.Key, e.KeyFile, p+".key", errs)
+		if key == "" {
+			errs.add(p+".key", "required")
+			continue
+		}
+		if _, dup := keys[key]; dup {
+			errs.add(p+".key", "duplicate key %s", MaskKey(key))
+			continue
+		}
+		if e.RateLimit < 0 {
+			errs.add(p+".rate_limit", "must be >= 0")
+		}
+		if e.BudgetUSD < 0 {
+			errs.add(p+".budget_usd", "must be >= 0")
+		}
+		if !validBudgetPeriod(e.BudgetPeriod) {
+			errs.add(p+".budget_period", "must be day, month or total")
+		}
+		cfg := &APIKeyConfig{Name: e.Name, RateLimit: e.RateLimit, Role: e.Role, Active: true,
+			ClientCertSubject: e.ClientCertSubject, BudgetUSD: e.BudgetUSD, BudgetPeriod: e.BudgetPeriod,
+			Capture: e.Capture}
+		if e.Active != nil {
+			cfg.Active = *e.Active
+		}
+		if cfg.Role == "" {
+			cfg.Role = "user"
+		}
+		keys[key] = cfg
+	}
+	return keys
+}
+
+// resolveRoutes fills in provider references, reads secrets and compiles
+// patterns. prefix is the error path of the route list.
+func resolveRoutes(routes []RouteConfig, providers map[string]UpstreamConfig, prefix, path string, errs *ConfigErrors) []RouteConfig {
+	out := make([]RouteConfig, 0, len(routes))
+	for i, r := range routes {
+		p := fmt.Sprintf("%s[%d]", prefix, i)
+		before := len(*errs)
+		unknownProvider := false
+		if r.Provider != "" {
+			prov, ok := providers[r.Provider]
+			if !ok {
+				errs.add(p+".provider", "unknown provider %q", r.Provider)
+				unknownProvider = true
+			} else {
+				if r.Upstream == "" {
+					r.Upstream = prov.BaseURL
+				}
+				if r.AuthKey == "" && r.AuthKeyFile == "" {
+					r.AuthKey = readSecret(prov.APIKey, prov.APIKeyFile, fmt.Sprintf("%s:providers.%s.api_key", path, r.Provider), errs)
+				}
+			}
+		}
+		r.AuthKey = readSecret(r.AuthKey, r.AuthKeyFile, p+".auth_key", errs)
+		r.AuthKeyFile = ""
+		if r.Upstream == "" && !unknownProvider {
+			errs.add(p+".upstream", "required (or set provider)")
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			errs.add(p+".pattern", "invalid regex: %v", err)
+		}
+		r.re = re
+		if r.Price != nil {
+			validatePrice(r.Price, p+".price", errs)
+		}
+		switch r.Tools {
+		case "", toolsNative, toolsPrompted:
+		default:
+			errs.add(p+".tools", "must be %s or %s, got %q", toolsNative, toolsPrompted, r.Tools)
+		}
+		if !validSchemaProfile(r.Schema) {
+			errs.add(p+".schema", "must be raw, strict or gemini, got %q", r.Schema)
+		}
+		if !validToolIDStyle(r.ToolIDs) {
+			errs.add(p+".tool_ids", "must be %s, got %q", toolIDsMistral, r.ToolIDs)
+		}
+		if !validDocumentMode(r.Documents) {
+			errs.add(p+".documents", "must be %s or %s, got %q", documentsText, documentsFile, r.Documents)
+		}
+		if !validImageMode(r.Images) {
+			errs.add(p+".images", "must be %s, %s or %s, got %q", imagesURL, imagesFetch, imagesNone, r.Images)
+		}
+		if r.ImageMaxSide < 0 {
+			errs.add(p+".image_max_side", "must not be negative, got %d", r.ImageMaxSide)
+		}
+		if r.ImageMaxBytes < 0 {
+			errs.add(p+".image_max_bytes", "must not be negative, got %d", r.ImageMaxBytes)
+		}
+		switch r.ToolErrorField {
+		case "role", "content", "tool_call_id":
+			errs.add(p+".tool_error_field", "must not be a standard message field, got %q", r.ToolErrorField)
+		}
+		if !validMessageMode(r.Messages) {
+			errs.add(p+".messages", "must be %s, got %q", messagesStrict, r.Messages)
+		}
+		if !validPrefill(r.Prefill) {
+			errs.add(p+".prefill", "must be %s, %s or %s, got %q", prefillPrefix, prefillContinue, prefillEmulate, r.Prefill)
+		}
+		if !validPromptCache(r.PromptCache) {
+			errs.add(p+".prompt_cache", "must be %s or %s, got %q", promptCacheControl, promptCacheKey, r.PromptCache)
+		}
+		// Every field is checked, so all mistakes are reported at once
+		if len(*errs) > before {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// configCheck validates the full configuration and prints every error.
+// It returns the process exit code.
+func configCheck() int {
+	env, err := readEnvFile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	cfg, err := loadConfig(env)
+	if err != nil {
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				fmt.Fprintln(os.Stderr, e.Error())
+			}
+			fmt.Fprintf(os.Stderr, "%d error(s) found\n", len(errs))
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+
+	source := env.configFilePath()
+	if _, err := os.Stat(source); err != nil {
+		source = "environment and legacy files"
+	}
+	fmt.Printf("Config OK (%s): upstream=%s, %d route(s), %d key(s)\n",
+		source, cfg.Settings.BaseURL, len(cfg.Routes), len(cfg.Keys))
+	return 0
+}
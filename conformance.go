@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Conformance Runner =================
+
+// messageResult is what a response adds up to, for comparing with a
+// scenario's expectations
+type messageResult struct {
+	Status       int
+	Blocks       []string
+	Text         string
+	Thinking     string
+	ToolInputs   []any
+	ToolNames    []string
+	StopReason   string
+	OutputTokens int
+	InputTokens  int // Without cache reads, as Anthropic counts them
+	CacheRead    int
+	Error        bool
+}
+
+type sseEvent struct {
+	Event string
+	Data  map[string]any
+}
+
+var validStopReasons = map[string]bool{
+	"end_turn": true, "max_tokens": true, "stop_sequence": true,
+	"tool_use": true, "pause_turn": true, "refusal": true,
+}
+
+// deltaTypes maps content block types to the delta types allowed in them
+var deltaTypes = map[string][]string{
+	"text":     {"text_delta"},
+	"thinking": {"thinking_delta", "signature_delta"},
+	"tool_use": {"input_json_delta"},
+}
+
+// readSSE parses an event stream. Malformed data is reported as a problem.
+func readSSE(r io.Reader) ([]sseEvent, []string) {
+	var events []sseEvent
+	var problems []string
+	var ev sseEvent
+	var data []string
+	flush := func() {
+		if ev.Event == "" && len(data) == 0 {
+			return
+		}
+		raw := strings.Join(data, "\n")
+		if err := json.Unmarshal([]byte(raw), &ev.Data); err != nil {
+			problems = append(problems, fmt.Sprintf("event %d (%s): invalid JSON data: %s", len(events), ev.Event, raw))
+		}
+		events = append(events, ev)
+		ev, data = sseEvent{}, nil
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "event:"):
+			ev.Event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	flush()
+	if err := sc.Err(); err != nil {
+		problems = append(problems, "reading stream: "+err.Error())
+	}
+	return events, problems
+}
+
+// checkEventStream validates the order and shape of Anthropic streaming
+// events and collects what they add up to
+func checkEventStream(events []sseEvent) (messageResult, []string) {
+	var res messageResult
+	var problems []string
+	fail := func(i int, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("event %d: ", i)+fmt.Sprintf(format, args...))
+	}
+
+	started, delta, stopped := false, false, false
+	open := -1 // Index of the open content block
+	var toolJSON []string
+	for i, ev := range events {
+		typ, _ := ev.Data["type"].(string)
+		if ev.Event != "" && typ != ev.Event {
+			fail(i, "event %q has data type %q", ev.Event, typ)
+		}
+		if stopped {
+			fail(i, "%s after message_stop", typ)
+		}
+		if res.Error {
+			fail(i, "%s after error", typ)
+		}
+		if typ != "message_start" && typ != "error" && typ != "ping" && !started {
+			fail(i, "%s before message_start", typ)
+		}
+		index := -1
+		if f, ok := ev.Data["index"].(float64); ok {
+			index = int(f)
+		}
+
+		switch typ {
+		case "ping":
+		case "message_start":
+			if started {
+				fail(i, "duplicate message_start")
+			}
+			started = true
+			msg, _ := ev.Data["message"].(map[string]any)
+			if msg["role"] != "assistant" || msg["type"] != "message" {
+				fail(i, "message_start without an assistant message")
+			}
+			u, _ := msg["usage"].(map[string]any)
+			res.readInputUsage(u)
+		case "content_block_start":
+			if delta {
+				fail(i, "content_block_start after message_delta")
+			}
+			if open >= 0 {
+				fail(i, "content_block_start while block %d is open", open)
+			}
+			if index != len(res.Blocks) {
+				fail(i, "content_block_start index %d, expected %d", index, len(res.Blocks))
+			}
+			block, _ := ev.Data["content_block"].(map[string]any)
+			btype, _ := block["type"].(string)
+			if _, ok := deltaTypes[btype]; !ok && btype != "redacted_thinking" {
+				fail(i, "unknown content block type %q", btype)
+			}
+			if btype == "tool_use" {
+				if id, _ := block["id"].(string); id == "" {
+					fail(i, "tool_use block without id")
+				}
+				name, _ := block["name"].(string)
+				if name == "" {
+					fail(i, "tool_use block without name")
+				}
+				res.ToolNames = append(res.ToolNames, name)
+				toolJSON = append(toolJSON, "")
+			}
+			res.Blocks = append(res.Blocks, btype)
+			open = index
+		case "content_block_delta":
+			if open < 0 || index != open {
+				fail(i, "content_block_delta for index %d, open block is %d", index, open)
+				continue
+			}
+			d, _ := ev.Data["delta"].(map[string]any)
+			dtype, _ := d["type"].(string)
+			btype := res.Blocks[len(res.Blocks)-1]
+			ok := false
+			for _, t := range deltaTypes[btype] {
+				ok = ok || t == dtype
+			}
+			if !ok {
+				fail(i, "%s in a %s block", dtype, btype)
+				continue
+			}
+			switch dtype {
+			case "text_delta":
+				s, _ := d["text"].(string)
+				res.Text += s
+			case "thinking_delta":
+				s, _ := d["thinking"].(string)
+				res.Thinking += s
+			case "input_json_delta":
+				s, _ := d["partial_json"].(string)
+				toolJSON[len(toolJSON)-1] += s
+			}
+		case "content_block_stop":
+			if open < 0 || index != open {
+				fail(i, "content_block_stop for index %d, open block is %d", index, open)
+			}
+			open = -1
+		case "message_delta":
+			if open >= 0 {
+				fail(i, "message_delta while block %d is open", open)
+			}
+			if delta {
+				fail(i, "duplicate message_delta")
+			}
+			delta = true
+			d, _ := ev.Data["delta"].(map[string]any)
+			res.StopReason, _ = d["stop_reason"].(string)
+			if !validStopReasons[res.StopReason] {
+				fail(i, "invalid stop_reason %q", res.StopReason)
+			}
+			if u, ok := ev.Data["usage"].(map[string]any); ok {
+				if n, ok := u["output_tokens"].(float64); ok {
+					res.OutputTokens = int(n)
+				}
+				res.readInputUsage(u)
+			} else {
+				fail(i, "message_delta without usage")
+			}
+		case "message_stop":
+			if !delta {
+				fail(i, "message_stop without message_delta")
+			}
+			stopped = true
+		case "error":
+			e, _ := ev.Data["error"].(map[string]any)
+			if t, _ := e["type"].(string); t == "" {
+				fail(i, "error event without error.type")
+			}
+			res.Error = true
+		default:
+			fail(i, "unknown event type %q", typ)
+		}
+	}
+	if !stopped && !res.Error {
+		problems = append(problems, "stream ended without message_stop or error")
+	}
+	for i, s := range toolJSON {
+		if s == "" {
+			s = "{}"
+		}
+		var input any
+		if err := json.Unmarshal([]byte(s), &input); err != nil {
+			problems = append(problems, fmt.Sprintf("tool_use %d: arguments are not valid JSON: %s", i, s))
+		}
+		res.ToolInputs = append(res.ToolInputs, input)
+	}
+	return res, problems
+}
+
+// checkMessage validates a non-streaming Anthropic message
+func checkMessage(b []byte) (messageResult, []string) {
+	var res messageResult
+	var problems []string
+	var msg struct {
+		Type       string           `json:"type"`
+		Role       string           `json:"role"`
+		Content    []map[string]any `json:"content"`
+		StopReason string           `json:"stop_reason"`
+		Usage      map[string]any   `json:"usage"`
+	}
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return res, []string{"response is not JSON: " + err.Error()}
+	}
+	if msg.Type != "message" || msg.Role != "assistant" {
+		problems = append(problems, fmt.Sprintf("type %q role %q, expected an assistant message", msg.Type, msg.Role))
+	}
+	res.StopReason = msg.StopReason
+	if !validStopReasons[msg.StopReason] {
+		problems = append(problems, fmt.Sprintf("invalid stop_reason %q", msg.StopReason))
+	}
+	if msg.Usage == nil {
+		problems = append(problems, "missing usage")
+	} else {
+		n, _ := msg.Usage["output_tokens"].(float64)
+		res.OutputTokens = int(n)
+		res.readInputUsage(msg.Usage)
+	}
+	for i, block := range msg.Content {
+		btype, _ := block["type"].(string)
+		res.Blocks = append(res.Blocks, btype)
+		switch btype {
+		case "text":
+			s, _ := block["text"].(string)
+			res.Text += s
+		case "thinking":
+			s, _ := block["thinking"].(string)
+			res.Thinking += s
+		case "tool_use":
+			if id, _ := block["id"].(string); id == "" {
+				problems = append(problems, fmt.Sprintf("content %d: tool_use without id", i))
+			}
+			if _, ok := block["input"].(map[string]any); !ok {
+				problems = append(problems, fmt.Sprintf("content %d: tool_use input is not an object", i))
+			}
+			res.ToolInputs = append(res.ToolInputs, block["input"])
+			name, _ := block["name"].(string)
+			res.ToolNames = append(res.ToolNames, name)
+		case "redacted_thinking":
+		default:
+			problems = append(problems, fmt.Sprintf("content %d: unknown block type %q", i, btype))
+		}
+	}
+	return res, problems
+}
+
+// compare reports where a result differs from the expectations
+func (e *MockExpect) compare(res messageResult) []string {
+	var problems []string
+	if e.StopReason != "" && res.StopReason != e.StopReason {
+		problems = append(problems, fmt.Sprintf("stop_reason %q, expected %q", res.StopReason, e.StopReason))
+	}
+	if e.Blocks != nil && strings.Join(res.Blocks, ",") != strings.Join(e.Blocks, ",") {
+		problems = append(problems, fmt.Sprintf("blocks [%s], expected [%s]", strings.Join(res.Blocks, ", "), strings.Join(e.Blocks, ", ")))
+	}
+	if e.Text != nil && res.Text != *e.Text {
+		problems = append(problems, fmt.Sprintf("text %q, expected %q", res.Text, *e.Text))
+	}
+	if e.Thinking != nil && res.Thinking != *e.Thinking {
+		problems = append(problems, fmt.Sprintf("thinking %q, expected %q", res.Thinking, *e.Thinking))
+	}
+	if e.ToolInputs != nil {
+		// Compare as canonical JSON, YAML and JSON decode to different types
+		got, _ := json.Marshal(res.ToolInputs)
+		want, _ := json.Marshal(e.ToolInputs)
+		var g, w any
+		json.Unmarshal(got, &g)
+		json.Unmarshal(want, &w)
+		got, _ = json.Marshal(g)
+		want, _ = json.Marshal(w)
+		if !bytes.Equal(got, want) {
+			problems = append(problems, fmt.Sprintf("tool inputs %s, expected %s", got, want))
+		}
+	}
+	if e.ToolNames != nil && strings.Join(res.ToolNames, ",") != strings.Join(e.ToolNames, ",") {
+		problems = append(problems, fmt.Sprintf("tool names [%s], expected [%s]", strings.Join(res.ToolNames, ", "), strings.Join(e.ToolNames, ", ")))
+	}
+	if e.OutputTokens != nil && res.OutputTokens != *e.OutputTokens {
+		problems = append(problems, fmt.Sprintf("output_tokens %d, expected %d", res.OutputTokens, *e.OutputTokens))
+	}
+	if e.InputTokens != nil && res.InputTokens != *e.InputTokens {
+		problems = append(problems, fmt.Sprintf("input_tokens %d, expected %d", res.InputTokens, *e.InputTokens))
+	}
+	if e.CacheReadTokens != nil && res.CacheRead != *e.CacheReadTokens {
+		problems = append(problems, fmt.Sprintf("cache_read_input_tokens %d, expected %d", res.CacheRead, *e.CacheReadTokens))
+	}
+	if e.Error != res.Error {
+		problems = append(problems, fmt.Sprintf("error event %v, expected %v", res.Error, e.Error))
+	}
+	return problems
+}
+
+// readInputUsage takes the input counts of a usage object; later events
+// override earlier ones, as in Anthropic's SDKs
+func (res *messageResult) readInputUsage(u map[string]any) {
+	if n, ok := u["input_tokens"].(float64); ok {
+		res.InputTokens = int(n)
+	}
+	if n, ok := u["cache_read_input_tokens"].(float64); ok {
+		res.CacheRead = int(n)
+	}
+}
+
+// runScenario sends a scenario's request to target and checks the response
+func runScenario(ctx context.Context, client *http.Client, target, key string, sc *MockScenario, verbose bool) []string {
+	req := make(map[string]any, len(sc.Request)+1)
+	for k, v := range sc.Request {
+		req[k] = v
+	}
+	req["model"] = sc.Name
+	stream, _ := req["stream"].(bool)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return []string{"encoding request: " + err.Error()}
+	}
+
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(target, "/")+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	hr.Header.Set("x-api-key", key)
+	hr.Header.Set("anthropic-version", "2023-06-01")
+	resp, err := client.Do(hr)
+	if err != nil {
+		return []string{"request failed: " + err.Error()}
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []string{"reading response: " + err.Error()}
+	}
+	if verbose {
+		fmt.Printf("--- %s: %s\n%s\n", sc.Name, resp.Status, b)
+	}
+
+	want := sc.Expect.Status
+	if want == 0 {
+		want = http.StatusOK
+	}
+	if resp.StatusCode != want {
+		return []string{fmt.Sprintf("status %d, expected %d: %s", resp.StatusCode, want, strings.TrimSpace(string(b)))}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var res messageResult
+	var problems []string
+	if stream {
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+			problems = append(problems, fmt.Sprintf("content type %q, expected text/event-stream", ct))
+		}
+		events, p := readSSE(bytes.NewReader(b))
+		problems = append(problems, p...)
+		res, p = checkEventStream(events)
+		problems = append(problems, p...)
+	} else {
+		res, problems = checkMessage(b)
+	}
+	return append(problems, sc.Expect.compare(res)...)
+}
+
+// serveLocal serves h on a free loopback port until close is called
+func serveLocal(h http.Handler) (url string, close func(), err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: h, ErrorLog: slog.NewLogLogger(serverLogger.Handler(), slog.LevelDebug)}
+	go srv.Serve(ln)
+	return "http://" + ln.Addr().String(), func() { srv.Close() }, nil
+}
+
+// serveConformance runs the mock upstream for scenarios and a proxy in
+// front of it, returning the proxy URL
+func serveConformance(scenarios map[string]*MockScenario) (string, func(), error) {
+	upstream, closeUpstream, err := serveLocal(mockUpstreamHandler(scenarios))
+	if err != nil {
+		return "", nil, err
+	}
+	settings.Store(&Settings{BaseURL: upstream, Model: "mock", MaxRequestSize: 10 << 20, AdminPassword: "admin"})
+	// Scenarios named prompted-* go through a prompted tools route
+	var errs ConfigErrors
+	setModelRoutes(resolveRoutes([]RouteConfig{{Pattern: "^prompted-", Upstream: upstream, Tools: toolsPrompted}}, nil, "routes", "", &errs))
+	proxy, closeProxy, err := serveLocal(newHandler(currentSettings()))
+	if err != nil {
+		closeUpstream()
+		return "", nil, err
+	}
+	return proxy, func() { closeProxy(); closeUpstream() }, nil
+}
+
+// conformanceCommand drives /v1/messages with every scenario and checks
+// that the Anthropic responses are valid. Without --target it runs the
+// mock upstream and the proxy in-process.
+func conformanceCommand(args []string) int {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	target := fs.String("target", "", "URL of a running ant2oa whose upstream is 'ant2oa mock-upstream' (default: run both in-process)")
+	key := fs.String("key", "conformance", "Client key sent to the target")
+	dir := fs.String("scenarios", "", "Directory with extra *.yaml scenarios")
+	run := fs.String("run", "", "Only run scenarios matching this regexp")
+	verbose := fs.Bool("v", false, "Print responses and proxy logs")
+	fs.Parse(args)
+
+	scenarios, err := loadScenarios(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var filter *regexp.Regexp
+	if *run != "" {
+		if filter, err = regexp.Compile(*run); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -run: %v\n", err)
+			return 2
+		}
+	}
+
+	if *target == "" {
+		level := slog.LevelError + 4 // Expected failures would be noise
+		if *verbose {
+			level = slog.LevelDebug
+		}
+		configureLogging(LogConfig{Format: "text", Level: level})
+		proxy, closeAll, err := serveConformance(scenarios)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer closeAll()
+		*target = proxy
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	passed, failed := 0, 0
+	for _, name := range scenarioNames(scenarios) {
+		if filter != nil && !filter.MatchString(name) {
+			continue
+		}
+		problems := runScenario(context.Background(), client, *target, *key, scenarios[name], *verbose)
+		if len(problems) == 0 {
+			passed++
+			fmt.Printf("PASS  %s\n", name)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s\n", name)
+		for _, p := range problems {
+			fmt.Printf("      %s\n", p)
+		}
+	}
+	fmt.Printf("\n%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
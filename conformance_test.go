@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startConformance serves the embedded scenarios through the proxy
+func startConformance(t *testing.T) (map[string]*MockScenario, string, func()) {
+	t.Helper()
+	configureLogging(LogConfig{Format: "text", Level: slog.LevelError + 4})
+	scenarios, err := loadScenarios("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, closeAll, err := serveConformance(scenarios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scenarios, target, closeAll
+}
+
+// runScenarios runs every scenario against target as a subtest
+func runScenarios(t *testing.T, scenarios map[string]*MockScenario, target string, replay bool) {
+	client := &http.Client{Timeout: time.Minute}
+	for _, name := range scenarioNames(scenarios) {
+		t.Run(name, func(t *testing.T) {
+			if replay && aborts(scenarios[name]) {
+				t.Skip("streams that fail before the end aren't recorded")
+			}
+			if problems := runScenario(context.Background(), client, target, "test", scenarios[name], false); len(problems) > 0 {
+				t.Error(strings.Join(problems, "\n"))
+			}
+		})
+	}
+}
+
+func aborts(sc *MockScenario) bool {
+	for _, step := range sc.Stream {
+		if step.Abort {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConformance(t *testing.T) {
+	scenarios, target, closeAll := startConformance(t)
+	defer closeAll()
+	runScenarios(t, scenarios, target, false)
+}
+
+// TestCassetteReplay records the scenarios, then replays them with the
+// upstream gone and expects the same results
+func TestCassetteReplay(t *testing.T) {
+	scenarios, target, closeAll := startConformance(t)
+	defer closeAll()
+	s := *currentSettings()
+	s.Cassette = CassetteConfig{Mode: cassetteRecord, Dir: t.TempDir()}
+	settings.Store(&s)
+	runScenarios(t, scenarios, target, false)
+
+	s.BaseURL = "http://127.0.0.1:1"
+	s.Cassette.Mode = cassetteReplay
+	settings.Store(&s)
+	var errs ConfigErrors
+	setModelRoutes(resolveRoutes([]RouteConfig{{Pattern: "^prompted-", Upstream: s.BaseURL, Tools: toolsPrompted}}, nil, "routes", "", &errs))
+	runScenarios(t, scenarios, target, true)
+}
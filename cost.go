@@ -0,0 +1,265 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Cost Accounting =================
+
+// Price is what an upstream charges, in USD per million tokens
+type Price struct {
+	Input       float64 `json:"input" yaml:"input"`
+	Output      float64 `json:"output" yaml:"output"`
+	CachedInput float64 `json:"cached_input,omitempty" yaml:"cached_input"` // Defaults to Input
+}
+
+// cost returns the USD cost of one request. cached is the part of input
+// that was served from the upstream's prompt cache.
+func (p *Price) cost(input, cached, output int) float64 {
+	if cached > input {
+		cached = input
+	}
+	cachedPrice := p.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = p.Input
+	}
+	return (float64(input-cached)*p.Input + float64(cached)*cachedPrice + float64(output)*p.Output) / 1e6
+}
+
+func validatePrice(p *Price, path string, errs *ConfigErrors) {
+	if p.Input < 0 || p.Output < 0 || p.CachedInput < 0 {
+		errs.add(path, "prices must be >= 0")
+	}
+}
+
+// lookupPrice finds the price for a request: a price on the matched route
+// wins over the per-model price table.
+func lookupPrice(route *RouteConfig, model string, s *Settings) *Price {
+	if route != nil && route.Price != nil {
+		return route.Price
+	}
+	if p, ok := s.Prices[model]; ok {
+		return &p
+	}
+	return nil
+}
+
+// setUsage records the token usage reported by the upstream
+func (st *requestStats) setUsage(u *OAUsage) {
+	st.InputTokens = u.PromptTokens
+	st.OutputTokens = u.CompletionTokens
+	st.CachedTokens = u.cachedTokens()
+	st.CacheWriteTokens = u.cacheCreationTokens()
+}
+
+// finishCost computes the request's cost and adds it to the key's spend
+func (st *requestStats) finishCost() {
+	if st.Price == nil {
+		return
+	}
+	st.CostUSD = st.Price.cost(st.InputTokens, st.CachedTokens, st.OutputTokens)
+	spend.add(st.KeyID, st.CostUSD, st.Start)
+}
+
+// ================= Budgets =================
+
+// Budget periods for APIKeyConfig.BudgetPeriod
+const (
+	budgetDay   = "day"
+	budgetMonth = "month" // Default
+	budgetTotal = "total"
+)
+
+func validBudgetPeriod(p string) bool {
+	switch p {
+	case "", budgetDay, budgetMonth, budgetTotal:
+		return true
+	}
+	return false
+}
+
+// periodStart returns when the current budget period began (UTC)
+func periodStart(period string, now time.Time) time.Time {
+	now = now.UTC()
+	switch period {
+	case budgetDay:
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	case budgetTotal:
+		return time.Time{}
+	default:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// spendTracker sums cost per key ID and UTC day. It is seeded from the
+// usage log and its spend archive at startup so budgets survive restarts
+// and log rotation.
+type spendTracker struct {
+	mu    sync.Mutex
+	byKey map[string]map[string]float64 // key ID -> day -> USD
+}
+
+var spend = &spendTracker{byKey: make(map[string]map[string]float64)}
+
+func (t *spendTracker) add(key string, usd float64, at time.Time) {
+	if key == "" || usd <= 0 {
+		return
+	}
+	day := at.UTC().Format(time.DateOnly)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	days, ok := t.byKey[key]
+	if !ok {
+		days = make(map[string]float64)
+		t.byKey[key] = days
+	}
+	days[day] += usd
+}
+
+// spent returns the USD spent by key in the period containing now
+func (t *spendTracker) spent(key, period string, now time.Time) float64 {
+	from := periodStart(period, now).Format(time.DateOnly)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var total float64
+	for day, usd := range t.byKey[key] {
+		if period == budgetTotal || day >= from {
+			total += usd
+		}
+	}
+	return total
+}
+
+// load seeds the tracker from the spend archive and the usage log
+func (t *spendTracker) load() {
+	if path := currentSettings().UsageLog.Path; path != "" {
+		archive, err := readSpendArchive(path)
+		if err != nil {
+			usageLogger.Error("failed to load spend archive", "error", err)
+		}
+		t.mu.Lock()
+		for id, days := range archive {
+			t.byKey[id] = days
+		}
+		t.mu.Unlock()
+	}
+
+	var n int
+	err := usage.scan(func(rec *UsageRecord) {
+		if rec.CostUSD > 0 && rec.KeyID != "" {
+			t.add(rec.KeyID, rec.CostUSD, rec.Time)
+			n++
+		}
+	})
+	if err != nil {
+		usageLogger.Error("failed to load spend from usage log", "error", err)
+		return
+	}
+	if n > 0 {
+		usageLogger.Info("loaded spend from usage log", "requests", n)
+	}
+}
+
+// overBudget reports whether a key has used up its budget
+func overBudget(key string, cfg *APIKeyConfig) bool {
+	if cfg == nil || cfg.BudgetUSD <= 0 {
+		return false
+	}
+	return spend.spent(key, cfg.BudgetPeriod, time.Now()) >= cfg.BudgetUSD
+}
+
+// writeBudgets exports spend and budget of keys that have a budget
+func writeBudgets(e *expositionWriter) {
+	type budget struct {
+		key         string
+		spent, usd  float64
+		periodLabel string
+	}
+	var budgets []budget
+	now := time.Now()
+	apiKeysMutex.RLock()
+	for k, cfg := range apiKeys {
+		if cfg.BudgetUSD > 0 {
+			label := keyLabel(k, cfg)
+			period := cfg.BudgetPeriod
+			if period == "" {
+				period = budgetMonth
+			}
+			budgets = append(budgets, budget{label, spend.spent(keyID(k), period, now), cfg.BudgetUSD, period})
+		}
+	}
+	apiKeysMutex.RUnlock()
+	sort.Slice(budgets, func(i, j int) bool { return budgets[i].key < budgets[j].key })
+
+	labels := []string{"key", "period"}
+	e.header("ant2oa_key_spend_usd", "gauge", "Spend of keys with a budget in the current period")
+	for _, b := range budgets {
+		e.sample("ant2oa_key_spend_usd", labels, []string{b.key, b.periodLabel}, b.spent)
+	}
+	e.header("ant2oa_key_budget_usd", "gauge", "Configured key budgets")
+	for _, b := range budgets {
+		e.sample("ant2oa_key_budget_usd", labels, []string{b.key, b.periodLabel}, b.usd)
+	}
+}
+
+// ================= Spend Archive =================
+
+// The spend archive keeps the spend of usage log files that rotation has
+// deleted, per key ID and day, so older spend still counts against budgets
+func spendArchivePath(usagePath string) string {
+	return usagePath + ".spend.json"
+}
+
+func readSpendArchive(usagePath string) (map[string]map[string]float64, error) {
+	archive := make(map[string]map[string]float64)
+	data, err := os.ReadFile(spendArchivePath(usagePath))
+	if os.IsNotExist(err) {
+		return archive, nil
+	}
+	if err != nil {
+		return archive, err
+	}
+	return archive, json.Unmarshal(data, &archive)
+}
+
+// archiveSpend adds the spend recorded in a usage log file that is about
+// to be deleted to the archive
+func archiveSpend(usagePath, file string) error {
+	archive, err := readSpendArchive(usagePath)
+	if err != nil {
+		return err
+	}
+	changed := false
+	err = scanUsageFile(file, func(rec *UsageRecord) {
+		if rec.KeyID == "" || rec.CostUSD <= 0 {
+			return
+		}
+		days, ok := archive[rec.KeyID]
+		if !ok {
+			days = make(map[string]float64)
+			archive[rec.KeyID] = days
+		}
+		days[rec.Time.UTC().Format(time.DateOnly)] += rec.CostUSD
+		changed = true
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || !changed {
+		return err
+	}
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	tmp := spendArchivePath(usagePath) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, spendArchivePath(usagePath))
+}
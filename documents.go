@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Documents =================
+
+// Route document modes. "file" routes take PDFs as OpenAI file parts; the
+// rest get the text, extracted here for PDFs.
+const (
+	documentsText = "text"
+	documentsFile = "file"
+)
+
+func validDocumentMode(s string) bool {
+	return s == "" || s == documentsText || s == documentsFile
+}
+
+// documentParts converts a document block for the upstream. Documents that
+// can't be read become a note saying so, never an error: the model is
+// better off knowing a document was attached.
+func documentParts(p AnthropicContent, mode string, image func(*AnthropicSource) OAContentPart, logger *slog.Logger) []OAContentPart {
+	if enabled, _ := parseCitations(p.Citations); enabled {
+		// OpenAI responses have no citation blocks
+		logger.Info("document citations are not supported upstream, sending the document without them", "title", p.Title)
+	}
+	src := p.Source
+	if src == nil {
+		return []OAContentPart{{Type: "text", Text: wrapDocument(p, "(empty document)")}}
+	}
+
+	switch src.Type {
+	case "text":
+		return []OAContentPart{{Type: "text", Text: wrapDocument(p, src.Data)}}
+	case "content":
+		return contentDocumentParts(p, src.Content, image)
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(src.Data)
+		if err != nil {
+			logger.Warn("document is not valid base64", "title", p.Title, "error", err)
+			return []OAContentPart{{Type: "text", Text: wrapDocument(p, "(the document could not be decoded)")}}
+		}
+		if strings.HasPrefix(src.MediaType, "text/") {
+			return []OAContentPart{{Type: "text", Text: wrapDocument(p, string(data))}}
+		}
+		if mode == documentsFile {
+			var parts []OAContentPart
+			if p.Title != "" || p.Context != "" {
+				parts = append(parts, OAContentPart{Type: "text", Text: wrapDocument(p, "")})
+			}
+			return append(parts, OAContentPart{Type: "file", File: &OAFile{
+				Filename: documentFilename(p.Title),
+				FileData: "data:" + src.MediaType + ";base64," + src.Data,
+			}})
+		}
+		text, err := extractPDFText(data)
+		if err != nil {
+			logger.Warn("document text extraction failed", "title", p.Title, "error", err)
+			return []OAContentPart{{Type: "text", Text: wrapDocument(p, "(the text of this document could not be extracted: "+err.Error()+")")}}
+		}
+		if text == "" {
+			text = "(this document has no extractable text; it may be scanned images)"
+		}
+		return []OAContentPart{{Type: "text", Text: wrapDocument(p, text)}}
+	case "url":
+		return []OAContentPart{{Type: "text", Text: wrapDocument(p, "(document at "+src.URL+", not retrieved)")}}
+	default:
+		logger.Warn("unsupported document source", "type", src.Type, "title", p.Title)
+		return []OAContentPart{{Type: "text", Text: wrapDocument(p, fmt.Sprintf("(unsupported %s document source)", src.Type))}}
+	}
+}
+
+// contentDocumentParts handles custom content documents, a string or text
+// and image blocks. The text joins into one document, images follow it.
+func contentDocumentParts(p AnthropicContent, raw json.RawMessage, image func(*AnthropicSource) OAContentPart) []OAContentPart {
+	var blocks []AnthropicContent
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return []OAContentPart{{Type: "text", Text: wrapDocument(p, parseComplexContent(raw))}}
+	}
+	var texts []string
+	var images []OAContentPart
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			texts = append(texts, b.Text)
+		case "image":
+			images = append(images, image(b.Source))
+		}
+	}
+	return append([]OAContentPart{{Type: "text", Text: wrapDocument(p, strings.Join(texts, "\n\n"))}}, images...)
+}
+
+// wrapDocument frames document text with its title and context
+func wrapDocument(p AnthropicContent, text string) string {
+	var sb strings.Builder
+	sb.WriteString("<document")
+	if p.Title != "" {
+		fmt.Fprintf(&sb, " title=%q", p.Title)
+	}
+	sb.WriteString(">\n")
+	if p.Context != "" {
+		sb.WriteString("<context>\n" + p.Context + "\n</context>\n")
+	}
+	if text != "" {
+		sb.WriteString("<document_content>\n" + text + "\n</document_content>\n")
+	}
+	sb.WriteString("</document>")
+	return sb.String()
+}
+
+func documentFilename(title string) string {
+	if title == "" {
+		return "document.pdf"
+	}
+	if !strings.HasSuffix(strings.ToLower(title), ".pdf") {
+		return title + ".pdf"
+	}
+	return title
+}
+
+func parseCitations(raw json.RawMessage) (enabled bool, err error) {
+	if len(raw) == 0 {
+		return false, nil
+	}
+	var c struct {
+		Enabled bool `json:"enabled"`
+	}
+	err = json.Unmarshal(raw, &c)
+	return c.Enabled, err
+}
@@ -4,4 +4,8 @@ go 1.25.5
 
 require github.com/joho/godotenv v1.5.1
 
-require github.com/goccy/go-json v0.10.5
+require (
+	github.com/goccy/go-json v0.10.5
+	golang.org/x/image v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
+)
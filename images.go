@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ================= Images =================
+
+// Route image modes. URL sources are passed through by default; "fetch"
+// inlines them for upstreams that can't download images, and "none" is for
+// models without vision, which get a placeholder instead.
+const (
+	imagesURL   = "url"
+	imagesFetch = "fetch"
+	imagesNone  = "none"
+)
+
+func validImageMode(s string) bool {
+	return s == "" || s == imagesURL || s == imagesFetch || s == imagesNone
+}
+
+const (
+	imageFetchMaxBytes = 20 << 20
+	imageFetchTimeout  = 15 * time.Second
+	imageMaxPixels     = 50_000_000 // Refuse to decode anything larger
+)
+
+// imageOptions are a route's image settings
+type imageOptions struct {
+	mode     string
+	maxSide  int // Longest side in pixels, 0 for no limit
+	maxBytes int // Encoded size, 0 for no limit
+}
+
+func routeImageOptions(route *RouteConfig) imageOptions {
+	if route == nil {
+		return imageOptions{mode: imagesURL}
+	}
+	o := imageOptions{mode: route.Images, maxSide: route.ImageMaxSide, maxBytes: route.ImageMaxBytes}
+	if o.mode == "" {
+		o.mode = imagesURL
+	}
+	return o
+}
+
+// imagePart converts an image source for the upstream. Images that can't be
+// used become a text note so the model knows one was there.
+func imagePart(ctx context.Context, src *AnthropicSource, o imageOptions, logger *slog.Logger) OAContentPart {
+	if o.mode == imagesNone {
+		return OAContentPart{Type: "text", Text: "[image omitted: this model cannot view images]"}
+	}
+	if src == nil {
+		return OAContentPart{Type: "text", Text: "[image omitted: no source]"}
+	}
+
+	var data []byte
+	mediaType := src.MediaType
+	switch src.Type {
+	case "base64":
+		if o.maxSide == 0 && o.maxBytes == 0 {
+			return imageURLPart("data:" + mediaType + ";base64," + src.Data)
+		}
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(src.Data); err != nil {
+			logger.Warn("image is not valid base64", "error", err)
+			return OAContentPart{Type: "text", Text: "[image omitted: invalid base64 data]"}
+		}
+	case "url":
+		if o.mode != imagesFetch {
+			return imageURLPart(src.URL)
+		}
+		var err error
+		if data, mediaType, err = fetchImage(ctx, src.URL); err != nil {
+			logger.Warn("image fetch failed", "url", src.URL, "error", err)
+			return OAContentPart{Type: "text", Text: fmt.Sprintf("[image at %s could not be retrieved]", src.URL)}
+		}
+	default:
+		logger.Warn("unsupported image source", "type", src.Type)
+		return OAContentPart{Type: "text", Text: fmt.Sprintf("[image omitted: unsupported %s source]", src.Type)}
+	}
+
+	fitted, fittedType, err := fitImage(data, mediaType, o.maxSide, o.maxBytes)
+	if err != nil {
+		// Let the upstream decide about images we can't process
+		logger.Warn("image resize failed, sending it unchanged", "media_type", mediaType, "error", err)
+		fitted, fittedType = data, mediaType
+	} else if len(fitted) != len(data) {
+		logger.Debug("image resized", "from_bytes", len(data), "to_bytes", len(fitted), "media_type", fittedType)
+	}
+	return imageURLPart("data:" + fittedType + ";base64," + base64.StdEncoding.EncodeToString(fitted))
+}
+
+func imageURLPart(url string) OAContentPart {
+	return OAContentPart{Type: "image_url", ImageURL: &OAImageURL{URL: url}}
+}
+
+// ================= Image Fetching =================
+
+var errBlockedAddress = errors.New("address not allowed")
+
+// imageClient only connects to public addresses. The check runs on the
+// address actually dialed, so redirects and DNS rebinding can't get around it.
+var imageClient = &http.Client{
+	Timeout: imageFetchTimeout,
+	Transport: &http.Transport{
+		Proxy: nil, // A proxy would dial for us, past the address check
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				ap, err := netip.ParseAddrPort(address)
+				if err != nil || !publicAddr(ap.Addr()) {
+					return errBlockedAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %s URL", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func publicAddr(a netip.Addr) bool {
+	a = a.Unmap()
+	return a.IsGlobalUnicast() && !a.IsPrivate() && !sharedAddressSpace.Contains(a)
+}
+
+// fetchImage downloads an image, up to imageFetchMaxBytes
+func fetchImage(ctx context.Context, url string) ([]byte, string, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, "", errors.New("only http and https URLs are fetched")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "image/*")
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > imageFetchMaxBytes {
+		return nil, "", fmt.Errorf("image is %d bytes, over the %d byte limit", resp.ContentLength, imageFetchMaxBytes)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, imageFetchMaxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > imageFetchMaxBytes {
+		return nil, "", fmt.Errorf("image is over the %d byte limit", imageFetchMaxBytes)
+	}
+	// Trust the bytes over the header
+	mediaType := http.DetectContentType(data)
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil, "", fmt.Errorf("not an image: %s", mediaType)
+	}
+	return data, mediaType, nil
+}
+
+// ================= Image Fitting =================
+
+// fitImage downscales an image to maxSide and re-encodes it until it fits
+// in maxBytes. Images already within both limits are returned unchanged.
+// PNG and GIF stay PNG where that fits; the rest become JPEG.
+func fitImage(data []byte, mediaType string, maxSide, maxBytes int) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	side := max(cfg.Width, cfg.Height)
+	if (maxSide == 0 || side <= maxSide) && (maxBytes == 0 || len(data) <= maxBytes) {
+		return data, mediaType, nil
+	}
+	if cfg.Width*cfg.Height > imageMaxPixels {
+		return nil, "", fmt.Errorf("image is %dx%d, too large to process", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if maxSide > 0 && side > maxSide {
+		img = scaleImage(img, maxSide)
+	}
+	lossless := format == "png" || format == "gif"
+	for {
+		if lossless {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				return nil, "", err
+			}
+			if maxBytes == 0 || buf.Len() <= maxBytes {
+				return buf.Bytes(), "image/png", nil
+			}
+		}
+		flat := flatten(img)
+		for _, q := range []int{85, 70, 55, 40} {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: q}); err != nil {
+				return nil, "", err
+			}
+			if maxBytes == 0 || buf.Len() <= maxBytes {
+				return buf.Bytes(), "image/jpeg", nil
+			}
+		}
+		// Still too big: halve the size and try again
+		b := img.Bounds()
+		if b.Dx() < 64 || b.Dy() < 64 {
+			return nil, "", fmt.Errorf("cannot fit image in %d bytes", maxBytes)
+		}
+		img = scaleImage(img, max(b.Dx(), b.Dy())/2)
+	}
+}
+
+// scaleImage resizes img so its longest side is side pixels
+func scaleImage(img image.Image, side int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w >= h {
+		w, h = side, max(1, h*side/w)
+	} else {
+		w, h = max(1, w*side/h), side
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// flatten puts an image on a white background, as JPEG has no alpha
+func flatten(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
@@ -1,74 +1,341 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 )
 
-func installService() {
+// installOptions controls how the systemd unit is generated
+type installOptions struct {
+	User      bool   // Install a user-level unit (systemctl --user)
+	Name      string // Unit name without suffix, allows several instances
+	ConfigDir string // Working directory holding env, keys.json, routes.json, ant2oa.yaml
+	RunAs     string // Service account for system units ("root" disables the dedicated user)
+	Args      string // Extra flags appended to "serve"
+	Socket    string // Comma separated ListenStream addresses for socket activation
+	DryRun    bool   // Print the unit files instead of installing
+}
+
+// serviceTarget describes where the unit lives and how systemctl is invoked
+type serviceTarget struct {
+	user     bool
+	unitDir  string
+	wantedBy string
+}
+
+func newServiceTarget(opts installOptions) (*serviceTarget, error) {
 	if runtime.GOOS != "linux" {
-		log.Fatal("Service installation is only supported on Linux.")
+		return nil, fmt.Errorf("service installation is only supported on Linux")
+	}
+	if !opts.User {
+		if os.Geteuid() != 0 && !opts.DryRun {
+			return nil, fmt.Errorf("run with sudo to install a system service (or use --user)")
+		}
+		return &serviceTarget{
+			unitDir:  "/etc/systemd/system",
+			wantedBy: "multi-user.target",
+		}, nil
 	}
 
-	if os.Geteuid() != 0 {
-		log.Fatal("Run with sudo to install service.")
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
 	}
+	return &serviceTarget{
+		user:     true,
+		unitDir:  filepath.Join(configDir, "systemd", "user"),
+		wantedBy: "default.target",
+	}, nil
+}
+
+func (t *serviceTarget) unitPath(name, suffix string) string {
+	return filepath.Join(t.unitDir, name+suffix)
+}
 
+// systemctl runs systemctl with --user when needed
+func (t *serviceTarget) systemctl(args ...string) error {
+	if t.user {
+		args = append([]string{"--user"}, args...)
+	}
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// defaultConfigDir is the directory of the executable, as before
+func defaultConfigDir() (string, string, error) {
 	exePath, err := os.Executable()
 	if err != nil {
-		log.Fatal(err)
+		return "", "", err
 	}
 	exePath, _ = filepath.Abs(exePath)
-	workDir := filepath.Dir(exePath)
-	envFile := filepath.Join(workDir, "env")
+	return exePath, filepath.Dir(exePath), nil
+}
 
+// renderServiceUnit builds the .service file
+func renderServiceUnit(opts installOptions, t *serviceTarget, exePath string) string {
+	envFile := filepath.Join(opts.ConfigDir, "env")
 	if _, err := os.Stat(envFile); os.IsNotExist(err) {
-		if _, err := os.Stat(filepath.Join(workDir, ".env")); err == nil {
-			envFile = filepath.Join(workDir, ".env")
+		if _, err := os.Stat(filepath.Join(opts.ConfigDir, ".env")); err == nil {
+			envFile = filepath.Join(opts.ConfigDir, ".env")
 		}
 	}
 
-	serviceContent := fmt.Sprintf(`[Unit]
-Description=Anthropic to OpenAI Proxy
-After=network.target
+	execStart := exePath + " serve"
+	if opts.Args != "" {
+		execStart += " " + opts.Args
+	}
 
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `[Unit]
+Description=Anthropic to OpenAI Proxy (%s)
+After=network-online.target
+Wants=network-online.target
+`, opts.Name)
+	if opts.Socket != "" {
+		fmt.Fprintf(&b, "Requires=%s.socket\nAfter=%s.socket\n", opts.Name, opts.Name)
+	}
+
+	fmt.Fprintf(&b, `
 [Service]
 Type=simple
 ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
 WorkingDirectory=%s
 EnvironmentFile=-%s
 Restart=always
 RestartSec=5
+`, execStart, opts.ConfigDir, envFile)
+
+	if t.user {
+		// User managers can't drop privileges or remount the filesystem
+		b.WriteString("\n# Hardening\nNoNewPrivileges=true\n")
+	} else {
+		if opts.RunAs != "root" {
+			// The service account can't create files in a root-owned config
+			// directory, so what it writes goes to /var/lib/<name>. The env
+			// file and ant2oa.yaml can still point elsewhere.
+			fmt.Fprintf(&b, "User=%s\nGroup=%s\nStateDirectory=%s\n", opts.RunAs, opts.RunAs, opts.Name)
+			fmt.Fprintf(&b, "Environment=USAGE_LOG_FILE=/var/lib/%s/usage.jsonl CAPTURE_DIR=/var/lib/%s/captures\n", opts.Name, opts.Name)
+		}
 
+		protectHome := "true"
+		if strings.HasPrefix(opts.ConfigDir, "/home/") || strings.HasPrefix(opts.ConfigDir, "/root") {
+			protectHome = "read-only"
+		}
+		fmt.Fprintf(&b, `
+# Hardening
+NoNewPrivileges=true
+PrivateTmp=true
+PrivateDevices=true
+ProtectSystem=strict
+ProtectHome=%s
+ReadWritePaths=%s
+ProtectKernelTunables=true
+ProtectKernelModules=true
+ProtectKernelLogs=true
+ProtectControlGroups=true
+ProtectClock=true
+ProtectHostname=true
+RestrictSUIDSGID=true
+RestrictNamespaces=true
+RestrictRealtime=true
+LockPersonality=true
+RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX
+CapabilityBoundingSet=CAP_NET_BIND_SERVICE
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+`, protectHome, opts.ConfigDir)
+	}
+
+	fmt.Fprintf(&b, `
 [Install]
-WantedBy=multi-user.target
-`, exePath, workDir, envFile)
+WantedBy=%s
+`, t.wantedBy)
+	return b.String()
+}
+
+// renderSocketUnit builds the .socket file for socket activation
+func renderSocketUnit(opts installOptions) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Unit]\nDescription=Anthropic to OpenAI Proxy socket (%s)\n\n[Socket]\n", opts.Name)
+	for _, addr := range strings.Split(opts.Socket, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			fmt.Fprintf(&b, "ListenStream=%s\n", addr)
+		}
+	}
+	b.WriteString("\n[Install]\nWantedBy=sockets.target\n")
+	return b.String()
+}
+
+func installService(opts installOptions) error {
+	t, err := newServiceTarget(opts)
+	if err != nil {
+		return err
+	}
+
+	exePath, exeDir, err := defaultConfigDir()
+	if err != nil {
+		return err
+	}
+	if opts.ConfigDir == "" {
+		opts.ConfigDir = exeDir
+	}
+	if opts.ConfigDir, err = filepath.Abs(opts.ConfigDir); err != nil {
+		return err
+	}
+
+	serviceContent := renderServiceUnit(opts, t, exePath)
+	var socketContent string
+	if opts.Socket != "" {
+		socketContent = renderSocketUnit(opts)
+	}
+
+	if opts.DryRun {
+		fmt.Printf("# %s\n%s", t.unitPath(opts.Name, ".service"), serviceContent)
+		if socketContent != "" {
+			fmt.Printf("\n# %s\n%s", t.unitPath(opts.Name, ".socket"), socketContent)
+		}
+		return nil
+	}
+
+	if !t.user && opts.RunAs != "root" {
+		if err := ensureServiceUser(opts.RunAs); err != nil {
+			return err
+		}
+		grantConfigFiles(opts.ConfigDir, opts.RunAs)
+	}
 
-	servicePath := "/etc/systemd/system/ant2oa.service"
-	if err := os.WriteFile(servicePath, []byte(serviceContent), 0644); err != nil {
-		log.Fatalf("Failed to write service file: %v", err)
+	if err := os.MkdirAll(t.unitDir, 0755); err != nil {
+		return err
 	}
+	if err := os.WriteFile(t.unitPath(opts.Name, ".service"), []byte(serviceContent), 0644); err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+	log.Printf("Service file written to %s", t.unitPath(opts.Name, ".service"))
 
-	log.Printf("Service file written to %s", servicePath)
+	unit := opts.Name + ".service"
+	if socketContent != "" {
+		if err := os.WriteFile(t.unitPath(opts.Name, ".socket"), []byte(socketContent), 0644); err != nil {
+			return fmt.Errorf("failed to write socket file: %w", err)
+		}
+		log.Printf("Socket file written to %s", t.unitPath(opts.Name, ".socket"))
+		unit = opts.Name + ".socket"
+	}
 
-	cmds := [][]string{
-		{"systemctl", "daemon-reload"},
-		{"systemctl", "enable", "ant2oa"},
-		{"systemctl", "restart", "ant2oa"},
+	if err := t.systemctl("daemon-reload"); err != nil {
+		return fmt.Errorf("systemctl daemon-reload failed: %w", err)
+	}
+	if err := t.systemctl("enable", unit); err != nil {
+		return fmt.Errorf("systemctl enable failed: %w", err)
 	}
 
-	for _, args := range cmds {
-		cmd := exec.Command(args[0], args[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			log.Fatalf("Command failed: %v", err)
+	// The unit is installed at this point; a failed start is usually a
+	// config problem the user has to fix, not an installation failure.
+	if err := t.systemctl("restart", unit); err != nil {
+		journal := "journalctl -u " + opts.Name
+		if t.user {
+			journal = "journalctl --user -u " + opts.Name
 		}
+		log.Printf("Warning: service installed but failed to start: %v (see '%s')", err, journal)
+		return nil
 	}
 
 	log.Println("Service installed and started successfully!")
+	return nil
+}
+
+func uninstallService(opts installOptions) error {
+	t, err := newServiceTarget(opts)
+	if err != nil {
+		return err
+	}
+
+	units := []string{opts.Name + ".socket", opts.Name + ".service"}
+	if opts.DryRun {
+		for _, u := range units {
+			fmt.Printf("disable --now %s\nremove %s\n", u, filepath.Join(t.unitDir, u))
+		}
+		return nil
+	}
+
+	for _, u := range units {
+		path := filepath.Join(t.unitDir, u)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		// The unit may already be stopped or disabled; only log failures here
+		if err := t.systemctl("disable", "--now", u); err != nil {
+			log.Printf("Warning: systemctl disable %s failed: %v", u, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		log.Printf("Unit file %s removed", path)
+	}
+
+	if err := t.systemctl("daemon-reload"); err != nil {
+		return fmt.Errorf("systemctl daemon-reload failed: %w", err)
+	}
+
+	log.Println("Service uninstalled successfully!")
+	return nil
+}
+
+// ensureServiceUser creates a system account without login or home if needed
+func ensureServiceUser(name string) error {
+	if _, err := user.Lookup(name); err == nil {
+		return nil
+	}
+	cmd := exec.Command("useradd", "--system", "--no-create-home", "--home-dir", "/nonexistent",
+		"--shell", "/usr/sbin/nologin", "--user-group", name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to create service user %s: %w", name, err)
+	}
+	log.Printf("Created service user %s", name)
+	return nil
+}
+
+// grantConfigFiles hands the config directory and its files to the service
+// user so the Web UI, hot reload and the keys command keep working under the
+// dedicated account. They replace files through a temporary file next to
+// them, so the directory has to be writable too.
+func grantConfigFiles(dir, name string) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if sharedDirs[dir] {
+		log.Printf("Warning: not handing %s to %s; key and config changes will fail, use --config-dir for a directory of its own", dir, name)
+	} else if err := os.Chown(dir, uid, gid); err != nil {
+		log.Printf("Warning: failed to chown %s: %v", dir, err)
+	}
+	for _, f := range []string{"env", ".env", "keys.json", "routes.json", "ant2oa.yaml"} {
+		path := filepath.Join(dir, f)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			log.Printf("Warning: failed to chown %s: %v", path, err)
+		}
+	}
+}
+
+// sharedDirs are directories the binary may sit in that must stay owned by root
+var sharedDirs = map[string]bool{
+	"/": true, "/bin": true, "/sbin": true, "/usr/bin": true, "/usr/sbin": true,
+	"/usr/local/bin": true, "/usr/local/sbin": true, "/etc": true, "/opt": true,
+	"/root": true, "/home": true, "/tmp": true,
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ================= Listeners =================
+
+// ListenerConfig is one address the server accepts connections on
+type ListenerConfig struct {
+	Addr  string     `yaml:"addr"`  // host:port or unix:/path/to.sock
+	Mode  string     `yaml:"mode"`  // Unix socket file mode (octal, e.g. "0660")
+	Owner string     `yaml:"owner"` // Unix socket owner user
+	Group string     `yaml:"group"` // Unix socket group
+	TLS   *TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig enables HTTPS on a TCP listener
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"` // Enables client certificate (mTLS) authentication
+	ClientAuth   string `yaml:"client_auth"`    // "optional" (default with a CA) or "require"
+}
+
+func (l ListenerConfig) isUnix() bool {
+	return strings.HasPrefix(l.Addr, "unix:")
+}
+
+func (l ListenerConfig) unixPath() string {
+	return strings.TrimPrefix(l.Addr, "unix:")
+}
+
+// validateListener checks a listener config, including that TLS files load
+func validateListener(l ListenerConfig, path string, errs *ConfigErrors) {
+	if l.isUnix() {
+		if l.unixPath() == "" {
+			errs.add(path+".addr", "unix socket path is empty")
+		}
+		if l.TLS != nil {
+			errs.add(path+".tls", "TLS is not supported on unix sockets")
+		}
+	} else {
+		if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+			errs.add(path+".addr", "%v", err)
+		}
+		if l.Mode != "" || l.Owner != "" || l.Group != "" {
+			errs.add(path, "mode/owner/group only apply to unix sockets")
+		}
+	}
+	if l.Mode != "" {
+		if _, err := strconv.ParseUint(l.Mode, 8, 32); err != nil {
+			errs.add(path+".mode", "invalid octal mode %q", l.Mode)
+		}
+	}
+	if l.Owner != "" {
+		if _, err := user.Lookup(l.Owner); err != nil {
+			errs.add(path+".owner", "%v", err)
+		}
+	}
+	if l.Group != "" {
+		if _, err := user.LookupGroup(l.Group); err != nil {
+			errs.add(path+".group", "%v", err)
+		}
+	}
+	if l.TLS != nil {
+		if _, err := tls.LoadX509KeyPair(l.TLS.CertFile, l.TLS.KeyFile); err != nil {
+			errs.add(path+".tls", "%v", err)
+		}
+		if l.TLS.ClientCAFile != "" {
+			if _, err := loadCertPool(l.TLS.ClientCAFile); err != nil {
+				errs.add(path+".tls.client_ca_file", "%v", err)
+			}
+		}
+		switch l.TLS.ClientAuth {
+		case "", "optional", "require":
+		default:
+			errs.add(path+".tls.client_auth", "must be \"optional\" or \"require\"")
+		}
+		if l.TLS.ClientAuth == "require" && l.TLS.ClientCAFile == "" {
+			errs.add(path+".tls.client_auth", "\"require\" needs client_ca_file")
+		}
+	}
+}
+
+// parseListenAddrs splits a comma separated LISTEN_ADDR value
+func parseListenAddrs(v string) []ListenerConfig {
+	var out []ListenerConfig
+	for _, addr := range strings.Split(v, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			out = append(out, ListenerConfig{Addr: addr})
+		}
+	}
+	return out
+}
+
+// openListeners opens every configured listener. On error the already
+// opened ones are closed.
+func openListeners(cfgs []ListenerConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	fail := func(err error) ([]net.Listener, error) {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return nil, err
+	}
+
+	for _, c := range cfgs {
+		var ln net.Listener
+		var err error
+		if c.isUnix() {
+			ln, err = listenUnix(c)
+		} else {
+			ln, err = net.Listen("tcp", c.Addr)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if c.TLS != nil {
+			state, err := newTLSState(*c.TLS)
+			if err != nil {
+				ln.Close()
+				return fail(fmt.Errorf("%s: %w", c.Addr, err))
+			}
+			ln = tls.NewListener(ln, state.config())
+			serverLogger.Info("listening", "addr", c.Addr, "tls", true)
+		} else {
+			serverLogger.Info("listening", "addr", ln.Addr().String())
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func listenUnix(c ListenerConfig) (net.Listener, error) {
+	path := c.unixPath()
+	// Remove a stale socket left behind by a crash
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Mode != "" {
+		mode, _ := strconv.ParseUint(c.Mode, 8, 32)
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if c.Owner != "" || c.Group != "" {
+		uid, gid := -1, -1
+		if c.Owner != "" {
+			u, err := user.Lookup(c.Owner)
+			if err != nil {
+				ln.Close()
+				return nil, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		if c.Group != "" {
+			g, err := user.LookupGroup(c.Group)
+			if err != nil {
+				ln.Close()
+				return nil, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// ================= TLS =================
+
+// tlsState holds the current certificate and client CA pool for a listener.
+// Both are swapped atomically on reload so new handshakes pick them up
+// without restarting.
+type tlsState struct {
+	cfg  TLSConfig
+	cert atomic.Pointer[tls.Certificate]
+	cas  atomic.Pointer[x509.CertPool]
+}
+
+var (
+	tlsStates   []*tlsState
+	tlsStatesMu sync.Mutex
+)
+
+func newTLSState(cfg TLSConfig) (*tlsState, error) {
+	s := &tlsState{cfg: cfg}
+	cert, cas, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.cert.Store(cert)
+	s.cas.Store(cas)
+
+	tlsStatesMu.Lock()
+	tlsStates = append(tlsStates, s)
+	tlsStatesMu.Unlock()
+	return s, nil
+}
+
+func (s *tlsState) load() (*tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cas *x509.CertPool
+	if s.cfg.ClientCAFile != "" {
+		if cas, err = loadCertPool(s.cfg.ClientCAFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &cert, cas, nil
+}
+
+func (s *tlsState) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert.Load()},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if cas := s.cas.Load(); cas != nil {
+				c.ClientCAs = cas
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+				if s.cfg.ClientAuth == "require" {
+					c.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return c, nil
+		},
+	}
+}
+
+// loadTLS re-reads all certificates and client CAs. It fails unless every
+// listener loads successfully; the returned func swaps them in.
+func loadTLS() (func(), error) {
+	tlsStatesMu.Lock()
+	states := slices.Clone(tlsStates)
+	tlsStatesMu.Unlock()
+
+	type loaded struct {
+		cert *tls.Certificate
+		cas  *x509.CertPool
+	}
+	next := make([]loaded, len(states))
+	for i, s := range states {
+		cert, cas, err := s.load()
+		if err != nil {
+			return nil, fmt.Errorf("tls %s: %w", s.cfg.CertFile, err)
+		}
+		next[i] = loaded{cert, cas}
+	}
+	return func() {
+		for i, s := range states {
+			s.cert.Store(next[i].cert)
+			s.cas.Store(next[i].cas)
+		}
+	}, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// systemdListeners returns sockets passed in by systemd socket activation
+// (LISTEN_FDS/LISTEN_PID). It returns nil when the process was not
+// socket-activated.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	// Don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	const firstFD = 3 // SD_LISTEN_FDS_START
+	listeners := make([]net.Listener, 0, n)
+	for fd := firstFD; fd < firstFD+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ================= Logging =================
+
+// Log subsystems. Every line carries its subsystem, and each subsystem can
+// have its own level.
+const (
+	logServer  = "server"
+	logConfig  = "config"
+	logHTTP    = "http"
+	logAuth    = "auth"
+	logProxy   = "proxy"
+	logUsage   = "usage"
+	logTracing = "tracing"
+)
+
+var logSubsystems = []string{logServer, logConfig, logHTTP, logAuth, logProxy, logUsage, logTracing}
+
+var (
+	serverLogger  = newSubsystemLogger(logServer)
+	configLogger  = newSubsystemLogger(logConfig)
+	httpLogger    = newSubsystemLogger(logHTTP)
+	authLogger    = newSubsystemLogger(logAuth)
+	proxyLogger   = newSubsystemLogger(logProxy)
+	usageLogger   = newSubsystemLogger(logUsage)
+	tracingLogger = newSubsystemLogger(logTracing)
+)
+
+// LogConfig controls log output, format and verbosity
+type LogConfig struct {
+	File   string // Append to this file instead of stderr
+	Format string // "text" (default) or "json"
+	Level  slog.Level
+	Levels map[string]slog.Level // Per-subsystem overrides
+}
+
+// logState is the active logging setup, swapped atomically on reload
+type logState struct {
+	cfg      LogConfig
+	file     *os.File
+	handlers map[string]slog.Handler // Subsystem -> base handler with "subsystem" attr
+}
+
+var (
+	logging   atomic.Pointer[logState]
+	loggingMu sync.Mutex
+)
+
+func init() {
+	logging.Store(newLogState(LogConfig{Format: "text", Level: slog.LevelInfo}, os.Stderr, nil))
+}
+
+func newLogState(cfg LogConfig, out io.Writer, f *os.File) *logState {
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelDebug, // Filtering happens per subsystem
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if src, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+				return slog.String(slog.SourceKey, filepath.Base(src.File)+":"+strconv.Itoa(src.Line))
+			}
+			return a
+		},
+	}
+	var base slog.Handler
+	if cfg.Format == "json" {
+		base = slog.NewJSONHandler(out, opts)
+	} else {
+		base = slog.NewTextHandler(out, opts)
+	}
+	s := &logState{cfg: cfg, file: f, handlers: make(map[string]slog.Handler, len(logSubsystems))}
+	for _, sub := range logSubsystems {
+		s.handlers[sub] = base.WithAttrs([]slog.Attr{slog.String("subsystem", sub)})
+	}
+	return s
+}
+
+func (s *logState) level(subsystem string) slog.Level {
+	if l, ok := s.cfg.Levels[subsystem]; ok {
+		return l
+	}
+	return s.cfg.Level
+}
+
+// configureLogging applies cfg
+func configureLogging(cfg LogConfig) error {
+	s, err := newLogging(cfg)
+	if err != nil {
+		return err
+	}
+	useLogging(s)
+	return nil
+}
+
+// newLogging builds the logging setup for cfg without switching to it. The
+// log file is only reopened when its path changes.
+func newLogging(cfg LogConfig) (*logState, error) {
+	old := logging.Load()
+	f := old.file
+	if cfg.File != old.cfg.File {
+		f = nil
+		if cfg.File != "" {
+			var err error
+			if f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var out io.Writer = os.Stderr
+	if f != nil {
+		out = f
+	}
+	return newLogState(cfg, out, f), nil
+}
+
+// useLogging switches to s, closing the previous log file if s has another
+func useLogging(s *logState) {
+	loggingMu.Lock()
+	defer loggingMu.Unlock()
+
+	old := logging.Swap(s)
+	if old.file != nil && old.file != s.file {
+		old.file.Close()
+	}
+}
+
+// subsystemHandler routes records to the active handler of its subsystem
+type subsystemHandler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler // WithAttrs/WithGroup calls to replay
+}
+
+func newSubsystemLogger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logging.Load().level(h.subsystem)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	base := logging.Load().handlers[h.subsystem]
+	for _, op := range h.ops {
+		base = op(base)
+	}
+	return base.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithGroup(name) })
+}
+
+func (h *subsystemHandler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	return &subsystemHandler{subsystem: h.subsystem, ops: append(slices.Clip(h.ops), op)}
+}
+
+// parseLogLevels parses "info" or "info,proxy=debug,http=warn" into cfg
+func parseLogLevels(v string, cfg *LogConfig) error {
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		sub, lvl, ok := strings.Cut(part, "=")
+		if !ok {
+			if err := cfg.Level.UnmarshalText([]byte(part)); err != nil {
+				return fmt.Errorf("invalid level %q", part)
+			}
+			continue
+		}
+		if err := setSubsystemLevel(cfg, strings.TrimSpace(sub), strings.TrimSpace(lvl)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setSubsystemLevel(cfg *LogConfig, sub, lvl string) error {
+	if !slices.Contains(logSubsystems, sub) {
+		return fmt.Errorf("unknown subsystem %q (one of %s)", sub, strings.Join(logSubsystems, ", "))
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("invalid level %q for %s", lvl, sub)
+	}
+	if cfg.Levels == nil {
+		cfg.Levels = make(map[string]slog.Level)
+	}
+	cfg.Levels[sub] = l
+	return nil
+}
+
+// ================= Request IDs =================
+
+// requestID returns the client's x-request-id if it is reasonable, or a
+// new ID in Anthropic's "req_..." style
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("x-request-id"); validRequestID(id) {
+		return id
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns l with the request ID of ctx attached
+func requestLogger(ctx context.Context, l *slog.Logger) *slog.Logger {
+	if id := statsFrom(ctx).RequestID; id != "" {
+		return l.With("request_id", id)
+	}
+	return l
+}
@@ -5,15 +5,13 @@ import (
 	"embed"
 	"flag"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
 //go:embed web
@@ -26,146 +24,123 @@ func init() {
 }
 
 func main() {
-	// Attempt to load .env file
-	_ = godotenv.Load()
-
-	installFlag := flag.Bool("install", false, "Install as systemd service (Linux only)")
-	flag.Parse()
+	os.Exit(runCLI(os.Args[1:]))
+}
 
-	if *installFlag {
-		installService()
-		return
+// serve runs the proxy server until SIGINT/SIGTERM
+func serve(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to ant2oa.yaml (default $ANT2OA_CONFIG or ./ant2oa.yaml)")
+	fs.Parse(args)
+	if *configPath != "" {
+		os.Setenv("ANT2OA_CONFIG", *configPath)
 	}
 
-	// Load configurations
-	if err := loadAPIKeys(); err != nil {
-		log.Printf("Warning: Failed to load keys.json: %v", err)
+	// Load configurations. At startup any config error is fatal; later
+	// reloads keep the previous config instead.
+	if err := reloadConfig("startup"); err != nil {
+		serverLogger.Error("invalid configuration (run 'ant2oa config check' for details)", "error", err)
+		return 1
+	}
+	spend.load()
+	if !rateLimitEnabled() {
+		serverLogger.Info("rate limit unlimited (set RATE_LIMIT to enable)")
 	}
-	if err := loadModelRoutes(); err != nil {
-		log.Printf("Warning: Failed to load routes.json: %v", err)
+	if c := currentSettings().Cassette; c.Mode != cassetteOff {
+		serverLogger.Warn("cassette mode active, upstream traffic is "+c.Mode+"ed", "mode", c.Mode, "dir", c.Dir)
 	}
 
-	// ================= Rate Limiter Setup =================
-	rpmStr := os.Getenv("RATE_LIMIT")
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel() // Catch-all for main exit
-
-	if rpmStr != "" {
-		rpm, err := strconv.Atoi(rpmStr)
-		if err == nil && rpm > 0 {
-			rateLimitEnabled = true
-			burst := 5 // Default burst
-			if rpm < 5 {
-				burst = rpm
-			}
-			limiter = make(chan struct{}, burst)
+	watchDone := make(chan struct{})
+	defer close(watchDone)
+	go watchConfig(reloadInterval(), watchDone)
 
-			// Initial fill
-			for i := 0; i < burst; i++ {
-				limiter <- struct{}{}
-			}
+	// ================= Server Setup =================
+	cfg := currentSettings()
 
-			interval := time.Minute / time.Duration(rpm)
-			go func(ctx context.Context) {
-				ticker := time.NewTicker(interval)
-				defer ticker.Stop()
-				for {
-					select {
-					case <-ticker.C:
-						select {
-						case limiter <- struct{}{}:
-						default:
-						}
-					case <-ctx.Done():
-						return
-					}
-				}
-			}(ctx)
-			log.Printf("Rate Limit Enabled: %d RPM", rpm)
-		} else {
-			log.Printf("Warning: Invalid RATE_LIMIT '%s' (expected >0 int). Rate limiting disabled.", rpmStr)
+	maxRequestSize := cfg.MaxRequestSize
+	handler := newHandler(cfg)
+
+	// Prefer sockets inherited from systemd socket activation
+	listeners, err := systemdListeners()
+	if err != nil {
+		serverLogger.Error("failed to use inherited sockets", "error", err)
+		return 1
+	}
+	if len(listeners) > 0 {
+		for _, ln := range listeners {
+			serverLogger.Info("listening", "addr", ln.Addr().String(), "socket_activation", true)
 		}
-	} else {
-		log.Println("Rate Limit: Unlimited (set RATE_LIMIT env var to enable)")
+	} else if listeners, err = openListeners(cfg.Listeners); err != nil {
+		serverLogger.Error("failed to start server", "error", err)
+		return 1
 	}
+	serverLogger.Info("max request size", "bytes", maxRequestSize)
 
-	// ================= Server Setup =================
-	listen := os.Getenv("LISTEN_ADDR")
-	if listen == "" {
-		listen = ":8080"
+	srv := &http.Server{Handler: handler, ErrorLog: slog.NewLogLogger(httpLogger.Handler(), slog.LevelWarn)}
+
+	// Run Server in Goroutines
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				serverLogger.Error("server listen error", "error", err)
+				os.Exit(1)
+			}
+		}(ln)
 	}
 
-	base := os.Getenv("OPENAI_BASE_URL")
-	if base == "" {
-		log.Fatal("OPENAI_BASE_URL environment variable is required")
+	// Graceful Shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	serverLogger.Info("shutting down server")
+
+	ctxGrace, cancelGrace := context.WithTimeout(context.Background(), 10*time.Second) // 10s grace period
+	defer cancelGrace()
+
+	if err := srv.Shutdown(ctxGrace); err != nil {
+		serverLogger.Warn("server forced to shut down", "error", err)
+	} else {
+		serverLogger.Info("server shut down gracefully")
 	}
-	model := os.Getenv("OPENAI_MODEL")
+	shutdownTracing(ctxGrace)
 
+	serverLogger.Info("server exited cleanly")
+	return 0
+}
+
+// newHandler builds the routes and middleware of the server
+func newHandler(cfg *Settings) http.Handler {
 	mux := http.NewServeMux()
 
 	// API routes
-	mux.HandleFunc("/v1/messages", messagesHandler(base, model))
-	mux.HandleFunc("/v1/complete", completeHandler(base, model))
-	mux.HandleFunc("/v1/models", modelsHandler(base))
-	mux.HandleFunc("/health", enhancedHealthHandler(base))
+	mux.HandleFunc("/v1/messages", messagesHandler())
+	mux.HandleFunc("/v1/complete", completeHandler())
+	mux.HandleFunc("/v1/models", modelsHandler())
+	mux.HandleFunc("/health", enhancedHealthHandler())
 
 	// Metrics routes
-	mux.HandleFunc("/metrics", metricsHandler())
-	mux.HandleFunc("/metrics/json", metricsJSONHandler())
+	if cfg.MetricsEnabled {
+		mux.HandleFunc("/metrics", metricsHandler())
+		mux.HandleFunc("/metrics/json", metricsJSONHandler())
+	}
 
 	// Web UI routes
 	mux.HandleFunc("/config", configWebHandler)
+	mux.HandleFunc("/captures", capturesWebHandler)
 
 	// Config API
 	mux.HandleFunc("/api/config", configHandler)
-
-	// Get max request size from env (default 10MB)
-	maxRequestSize := int64(10 * 1024 * 1024)
-	if maxSizeStr := os.Getenv("MAX_REQUEST_SIZE"); maxSizeStr != "" {
-		if size, err := strconv.ParseInt(maxSizeStr, 10, 64); err == nil && size > 0 {
-			maxRequestSize = size
-		}
-	}
+	mux.HandleFunc("/api/reload", reloadHandler)
+	mux.HandleFunc("/api/usage", usageHandler)
+	mux.HandleFunc("/api/captures", capturesHandler)
+	mux.HandleFunc("/api/captures/{id}", capturesHandler)
 
 	// Apply middleware chain
-	handler := chainMiddleware(
+	return chainMiddleware(
 		mux,
 		loggingMiddleware,
 		corsMiddleware,
 		apiKeyAuthMiddleware,
-		maxBytesMiddleware(maxRequestSize),
+		maxBytesMiddleware(cfg.MaxRequestSize),
 	)
-
-	ln, err := net.Listen("tcp", listen)
-	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
-	log.Println("Listening on", ln.Addr())
-	log.Printf("Max request size: %d bytes", maxRequestSize)
-
-	srv := &http.Server{Handler: handler}
-
-	// Run Server in Goroutine
-	go func() {
-		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server Listen Error: %s", err)
-		}
-	}()
-
-	// Graceful Shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
-
-	ctxGrace, cancelGrace := context.WithTimeout(context.Background(), 10*time.Second) // 10s grace period
-	defer cancelGrace()
-
-	if err := srv.Shutdown(ctxGrace); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
-	} else {
-		log.Println("Server shutdown gracefully")
-	}
-
-	log.Println("Server exited cleanly")
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"net/http"
-	"sync"
+	"net/url"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -22,93 +24,200 @@ type Metrics struct {
 	RateLimitedCount  atomic.Int64
 	ActiveConnections atomic.Int64
 	StartTime         time.Time
-
-	// Per-endpoint metrics
-	endpointMetrics sync.Map // map[string]*EndpointMetrics
-}
-
-// EndpointMetrics holds per-endpoint statistics
-type EndpointMetrics struct {
-	Requests  atomic.Int64
-	Errors    atomic.Int64
-	LatencyMs atomic.Int64
 }
 
 var metrics = &Metrics{
 	StartTime: time.Now(),
 }
 
-// RecordRequest records a request metric
-func (m *Metrics) RecordRequest(endpoint string, latencyMs int64, isError bool) {
+// Per-request counters, labeled by endpoint, requested model, upstream
+// model, upstream host and key name
+var (
+	requestLabels = []string{"endpoint", "requested_model", "upstream_model", "upstream", "key"}
+
+	httpRequests = newCounterVec("ant2oa_http_requests_total",
+		"Requests by endpoint, model, upstream and key", requestLabels)
+	httpErrors = newCounterVec("ant2oa_http_errors_total",
+		"Failed requests by status class", append(append([]string(nil), requestLabels...), "class"))
+	inputTokens = newCounterVec("ant2oa_input_tokens_total",
+		"Prompt tokens reported by the upstream", requestLabels)
+	outputTokens = newCounterVec("ant2oa_output_tokens_total",
+		"Completion tokens reported by the upstream", requestLabels)
+	requestRetries = newCounterVec("ant2oa_request_retries_total",
+		"Upstream retry attempts", requestLabels)
+	cachedTokens = newCounterVec("ant2oa_cached_input_tokens_total",
+		"Prompt tokens served from the upstream's prompt cache", requestLabels)
+	costUSD = newCounterVec("ant2oa_cost_usd_total",
+		"Estimated cost in USD from the price table", requestLabels)
+
+	streamRepairs = newCounterVec("ant2oa_stream_repairs_total",
+		"Streaming events repaired to keep the Anthropic event order valid", []string{"kind", "upstream_model"})
+)
+
+// Latency histograms, labeled by route, upstream host, upstream model and
+// whether the response was streamed
+var (
+	upstreamLabels = []string{"route", "upstream", "model", "stream"}
+
+	requestDuration = newHistogramVec("ant2oa_request_duration_seconds",
+		"Total request duration", upstreamLabels,
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300})
+	timeToFirstToken = newHistogramVec("ant2oa_time_to_first_token_seconds",
+		"Time from request start to the first streamed token", upstreamLabels,
+		[]float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60})
+	upstreamConnect = newHistogramVec("ant2oa_upstream_connect_seconds",
+		"Time to obtain an upstream connection (DNS, TCP and TLS for new connections)", upstreamLabels,
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5})
+	outputTokensPerSecond = newHistogramVec("ant2oa_output_tokens_per_second",
+		"Output tokens per second of generation time", upstreamLabels,
+		[]float64{1, 5, 10, 20, 40, 60, 80, 100, 150, 200, 300})
+)
+
+// RecordRequest records a finished request in the global counters, the
+// labeled counters and, for requests that were routed upstream, the
+// latency histograms.
+func (m *Metrics) RecordRequest(endpoint string, st *requestStats, status int, end time.Time) {
+	latency := end.Sub(st.Start)
 	m.TotalRequests.Add(1)
-	m.TotalLatencyMs.Add(latencyMs)
+	m.TotalLatencyMs.Add(latency.Milliseconds())
 
+	isError := status >= http.StatusBadRequest
 	if isError {
 		m.ErrorRequests.Add(1)
 	} else {
 		m.SuccessRequests.Add(1)
 	}
 
-	// Per-endpoint
-	val, _ := m.endpointMetrics.LoadOrStore(endpoint, &EndpointMetrics{})
-	em := val.(*EndpointMetrics)
-	em.Requests.Add(1)
-	em.LatencyMs.Add(latencyMs)
+	labels := []string{endpoint, st.RequestedModel, st.Model, st.Upstream, st.Key}
+	httpRequests.add(labels, 1)
 	if isError {
-		em.Errors.Add(1)
+		httpErrors.add(append(labels, strconv.Itoa(status/100)+"xx"), 1)
+	}
+	inputTokens.add(labels, float64(st.InputTokens))
+	outputTokens.add(labels, float64(st.OutputTokens))
+	requestRetries.add(labels, float64(st.Retries))
+	cachedTokens.add(labels, float64(st.CachedTokens))
+	costUSD.add(labels, st.CostUSD)
+
+	if st.Upstream != "" {
+		m.recordLatency(st, end)
 	}
 }
 
+// ================= Request Stats =================
+
+// requestStats collects details about a proxied request as it moves through
+// the handlers. loggingMiddleware records them once the response is done.
+type requestStats struct {
+	Start          time.Time
+	RequestID      string
+	Key            string // Key label (name or hash), never the raw key
+	KeyID          string // Full key hash, which spend is tracked under
+	KeyConfig      *APIKeyConfig
+	RequestedModel string // Model name sent by the client
+	Route          string // Route pattern, "default" for the default upstream
+	Upstream       string // Upstream host
+	Model          string // Model name sent upstream
+	Stream         bool
+
+	UpstreamStart    time.Time     // When the (last) upstream attempt was sent
+	UpstreamConnect  time.Duration // Time to get a connection for the last attempt
+	FirstToken       time.Time     // First streamed token written to the client
+	Retries          int
+	InputTokens      int
+	OutputTokens     int
+	CachedTokens     int // Part of InputTokens read from the prompt cache
+	CacheWriteTokens int // Part of InputTokens written to the prompt cache
+	Price            *Price
+	CostUSD          float64
+	Capture          *capture    // Non-nil when the request is being captured
+	PromptedTools    bool        // Tool calls are parsed out of the text (see prompted.go)
+	ToolNames        *toolMapper // Tool names and IDs renamed for the upstream
+	Prefill          string      // Assistant prefill to cut if the response repeats it
+}
+
+type requestStatsKey struct{}
+
+func withRequestStats(r *http.Request, st *requestStats) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestStatsKey{}, st))
+}
+
+// statsFrom returns the request's stats; a throwaway value if there are none
+func statsFrom(ctx context.Context) *requestStats {
+	if st, ok := ctx.Value(requestStatsKey{}).(*requestStats); ok {
+		return st
+	}
+	return &requestStats{Start: time.Now()}
+}
+
+// setUpstream records where a request is routed
+func (st *requestStats) setUpstream(route, base, model string, stream bool) {
+	st.Route, st.Model, st.Stream = route, model, stream
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		st.Upstream = u.Host
+	} else {
+		st.Upstream = base
+	}
+}
+
+// recordLatency observes the latency histograms of a finished request
+func (m *Metrics) recordLatency(st *requestStats, end time.Time) {
+	labels := []string{st.Route, st.Upstream, st.Model, strconv.FormatBool(st.Stream)}
+
+	requestDuration.observe(labels, end.Sub(st.Start).Seconds())
+	if !st.UpstreamStart.IsZero() {
+		upstreamConnect.observe(labels, st.UpstreamConnect.Seconds())
+	}
+	if !st.FirstToken.IsZero() {
+		timeToFirstToken.observe(labels, st.FirstToken.Sub(st.Start).Seconds())
+	}
+
+	// Generation time excludes the wait for the first token when streaming
+	genStart := st.UpstreamStart
+	if st.Stream {
+		genStart = st.FirstToken
+	}
+	if st.OutputTokens > 0 && !genStart.IsZero() {
+		if secs := end.Sub(genStart).Seconds(); secs > 0 {
+			outputTokensPerSecond.observe(labels, float64(st.OutputTokens)/secs)
+		}
+	}
+}
+
+// ================= Handlers =================
+
 // metricsHandler returns metrics in Prometheus-compatible format
 func metricsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		uptime := time.Since(metrics.StartTime).Seconds()
 		totalReqs := metrics.TotalRequests.Load()
 		avgLatency := float64(0)
 		if totalReqs > 0 {
 			avgLatency = float64(metrics.TotalLatencyMs.Load()) / float64(totalReqs)
 		}
 
-		// Prometheus text format
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-
-		output := "# HELP ant2oa_uptime_seconds Time since server start\n"
-		output += "# TYPE ant2oa_uptime_seconds gauge\n"
-		output += "ant2oa_uptime_seconds " + formatFloat(uptime) + "\n\n"
-
-		output += "# HELP ant2oa_requests_total Total number of requests\n"
-		output += "# TYPE ant2oa_requests_total counter\n"
-		output += "ant2oa_requests_total " + formatInt(totalReqs) + "\n\n"
-
-		output += "# HELP ant2oa_requests_success_total Successful requests\n"
-		output += "# TYPE ant2oa_requests_success_total counter\n"
-		output += "ant2oa_requests_success_total " + formatInt(metrics.SuccessRequests.Load()) + "\n\n"
-
-		output += "# HELP ant2oa_requests_error_total Failed requests\n"
-		output += "# TYPE ant2oa_requests_error_total counter\n"
-		output += "ant2oa_requests_error_total " + formatInt(metrics.ErrorRequests.Load()) + "\n\n"
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		e := newExpositionWriter(w)
 
-		output += "# HELP ant2oa_upstream_errors_total Upstream errors\n"
-		output += "# TYPE ant2oa_upstream_errors_total counter\n"
-		output += "ant2oa_upstream_errors_total " + formatInt(metrics.UpstreamErrors.Load()) + "\n\n"
+		e.single("ant2oa_uptime_seconds", "gauge", "Time since server start", time.Since(metrics.StartTime).Seconds())
+		e.single("ant2oa_requests_total", "counter", "Total number of requests", float64(totalReqs))
+		e.single("ant2oa_requests_success_total", "counter", "Successful requests", float64(metrics.SuccessRequests.Load()))
+		e.single("ant2oa_requests_error_total", "counter", "Failed requests", float64(metrics.ErrorRequests.Load()))
+		e.single("ant2oa_upstream_errors_total", "counter", "Upstream errors", float64(metrics.UpstreamErrors.Load()))
+		e.single("ant2oa_upstream_retries_total", "counter", "Upstream retry attempts", float64(metrics.UpstreamRetries.Load()))
+		e.single("ant2oa_rate_limited_total", "counter", "Rate limited requests", float64(metrics.RateLimitedCount.Load()))
+		e.single("ant2oa_active_connections", "gauge", "Current active connections", float64(metrics.ActiveConnections.Load()))
+		e.single("ant2oa_avg_latency_ms", "gauge", "Average request latency in milliseconds", avgLatency)
 
-		output += "# HELP ant2oa_upstream_retries_total Upstream retry attempts\n"
-		output += "# TYPE ant2oa_upstream_retries_total counter\n"
-		output += "ant2oa_upstream_retries_total " + formatInt(metrics.UpstreamRetries.Load()) + "\n\n"
-
-		output += "# HELP ant2oa_rate_limited_total Rate limited requests\n"
-		output += "# TYPE ant2oa_rate_limited_total counter\n"
-		output += "ant2oa_rate_limited_total " + formatInt(metrics.RateLimitedCount.Load()) + "\n\n"
-
-		output += "# HELP ant2oa_active_connections Current active connections\n"
-		output += "# TYPE ant2oa_active_connections gauge\n"
-		output += "ant2oa_active_connections " + formatInt(metrics.ActiveConnections.Load()) + "\n\n"
-
-		output += "# HELP ant2oa_avg_latency_ms Average request latency in milliseconds\n"
-		output += "# TYPE ant2oa_avg_latency_ms gauge\n"
-		output += "ant2oa_avg_latency_ms " + formatFloat(avgLatency) + "\n"
+		for _, c := range []*counterVec{httpRequests, httpErrors, inputTokens, outputTokens, requestRetries, cachedTokens, costUSD, streamRepairs} {
+			c.write(e)
+		}
+		for _, h := range []*histogramVec{requestDuration, timeToFirstToken, upstreamConnect, outputTokensPerSecond} {
+			h.write(e)
+		}
+		writeBudgets(e)
+		labelLimits.write(e)
 
-		w.Write([]byte(output))
+		e.flush()
 	}
 }
 
@@ -131,6 +240,15 @@ func metricsJSONHandler() http.HandlerFunc {
 			"rate_limited":       metrics.RateLimitedCount.Load(),
 			"active_connections": metrics.ActiveConnections.Load(),
 			"avg_latency_ms":     avgLatency,
+			"latency_p50_ms":     requestDuration.quantile(0.5) * 1000,
+			"latency_p95_ms":     requestDuration.quantile(0.95) * 1000,
+			"latency_p99_ms":     requestDuration.quantile(0.99) * 1000,
+			"ttft_p50_ms":        timeToFirstToken.quantile(0.5) * 1000,
+			"ttft_p95_ms":        timeToFirstToken.quantile(0.95) * 1000,
+			"endpoints":          breakdown("endpoint"),
+			"models":             breakdown("upstream_model"),
+			"keys":               breakdown("key"),
+			"stream_repairs":     streamRepairs.sumBy("kind"),
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -138,24 +256,25 @@ func metricsJSONHandler() http.HandlerFunc {
 	}
 }
 
-func formatFloat(f float64) string {
-	return json.Number(json.RawMessage(floatToString(f))).String()
-}
-
-func formatInt(i int64) string {
-	return json.Number(json.RawMessage(intToString(i))).String()
-}
-
-func floatToString(f float64) string {
-	return string(json.RawMessage([]byte(func() []byte {
-		b, _ := json.Marshal(f)
-		return b
-	}())))
-}
-
-func intToString(i int64) string {
-	return string(json.RawMessage([]byte(func() []byte {
-		b, _ := json.Marshal(i)
-		return b
-	}())))
+// breakdown groups the labeled counters by one label for /metrics/json
+func breakdown(label string) map[string]map[string]float64 {
+	out := make(map[string]map[string]float64)
+	for name, c := range map[string]*counterVec{
+		"requests":      httpRequests,
+		"errors":        httpErrors,
+		"input_tokens":  inputTokens,
+		"output_tokens": outputTokens,
+		"cost_usd":      costUSD,
+	} {
+		for value, n := range c.sumBy(label) {
+			if value == "" {
+				continue
+			}
+			if out[value] == nil {
+				out[value] = make(map[string]float64)
+			}
+			out[value][name] = n
+		}
+	}
+	return out
 }
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
@@ -34,13 +34,29 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 		start := time.Now()
 		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-
-		next.ServeHTTP(rw, r)
-
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, rw.statusCode, duration)
-
-		metrics.RecordRequest(r.URL.Path, duration.Milliseconds(), rw.statusCode >= http.StatusBadRequest)
+		st := &requestStats{Start: start, RequestID: requestID(r)}
+		w.Header().Set("request-id", st.RequestID)
+		ctx, span := startServerSpan(r)
+		span.setAttr("ant2oa.request_id", st.RequestID)
+
+		next.ServeHTTP(rw, withRequestStats(r.WithContext(ctx), st))
+
+		end := time.Now()
+		st.finishCost()
+		finishServerSpan(span, st, rw.statusCode)
+		level := slog.LevelInfo
+		if rw.statusCode >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		httpLogger.Log(ctx, level, "request", "request_id", st.RequestID,
+			"method", r.Method, "path", r.URL.Path, "status", rw.statusCode,
+			"duration_ms", end.Sub(start).Milliseconds(), "key", st.Key, "model", st.RequestedModel)
+
+		st.Capture.save(r.URL.Path, st, rw.statusCode, end)
+		metrics.RecordRequest(r.URL.Path, st, rw.statusCode, end)
+		if st.Model != "" {
+			usage.record(newUsageRecord(r.URL.Path, st, rw.statusCode, end))
+		}
 	})
 }
 
@@ -51,24 +67,15 @@ func apiKeyAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
-			auth = r.Header.Get("x-api-key")
+		_, span := startSpan(r.Context(), "auth", spanKindInternal)
+		code, msg := authorizeRequest(r)
+		span.setAttr("ant2oa.key", statsFrom(r.Context()).Key)
+		if code != 0 {
+			span.setError(msg)
 		}
-		if auth == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		if !strings.HasPrefix(auth, "Bearer ") {
-			auth = "Bearer " + auth
-		}
-		r.Header.Set("Authorization", auth)
-
-		bearerToken := strings.TrimPrefix(auth, "Bearer ")
-		allowed, _ := validateAPIKey(bearerToken)
-		if !allowed {
-			http.Error(w, "unauthorized: invalid key or rate limit exceeded", http.StatusUnauthorized)
+		span.finish()
+		if code != 0 {
+			http.Error(w, msg, code)
 			return
 		}
 
@@ -76,6 +83,49 @@ func apiKeyAuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// authorizeRequest checks the client key, normalizing it into a Bearer
+// Authorization header. It returns the HTTP status and message of a
+// rejection, or 0 if the request may proceed.
+func authorizeRequest(r *http.Request) (int, string) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		auth = r.Header.Get("x-api-key")
+	}
+	// A verified mTLS client certificate can stand in for a key
+	if auth == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		auth = keyForClientCert(r.TLS.VerifiedChains[0][0])
+	}
+	if auth == "" {
+		return http.StatusUnauthorized, "unauthorized"
+	}
+
+	if !strings.HasPrefix(auth, "Bearer ") {
+		auth = "Bearer " + auth
+	}
+	r.Header.Set("Authorization", auth)
+
+	bearerToken := strings.TrimPrefix(auth, "Bearer ")
+	allowed, keyCfg := validateAPIKey(bearerToken)
+	st := statsFrom(r.Context())
+	if !allowed && keyCfg == nil {
+		// Don't let random invalid keys use up label values
+		st.Key = "invalid"
+	} else {
+		st.Key = keyLabel(bearerToken, keyCfg)
+		st.KeyID = keyID(bearerToken)
+	}
+	if !allowed {
+		requestLogger(r.Context(), authLogger).Debug("key rejected", "key", st.Key, "known", keyCfg != nil)
+		return http.StatusUnauthorized, "unauthorized: invalid key or rate limit exceeded"
+	}
+	st.KeyConfig = keyCfg
+	if overBudget(st.KeyID, keyCfg) {
+		requestLogger(r.Context(), authLogger).Info("key over budget", "key", st.Key)
+		return http.StatusPaymentRequired, "budget exceeded for this key"
+	}
+	return 0, ""
+}
+
 func isProtectedPath(path string) bool {
 	switch path {
 	case "/v1/messages", "/v1/complete", "/v1/models":
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"gopkg.in/yaml.v3"
+)
+
+// ================= Mock Upstream =================
+
+//go:embed scenarios
+var scenarioFS embed.FS
+
+// MockScenario is a scripted /v1/chat/completions exchange. The conformance
+// runner sends Request through the proxy and checks the result against Expect.
+type MockScenario struct {
+	Name        string         `yaml:"name"`
+	Description string         `yaml:"description"`
+	Request     map[string]any `yaml:"request"`  // Anthropic request, its model is set to Name
+	Status      int            `yaml:"status"`   // Upstream HTTP status, default 200
+	Response    any            `yaml:"response"` // Body for non-streaming requests and errors
+	Stream      []MockStep     `yaml:"stream"`   // SSE stream for streaming requests
+	Expect      MockExpect     `yaml:"expect"`
+}
+
+// MockStep is one write to the upstream stream
+type MockStep struct {
+	DelayMs int    `yaml:"delay_ms"`
+	Data    any    `yaml:"data"`  // Sent as one "data: <json>" event
+	Raw     string `yaml:"raw"`   // Sent as is, e.g. half an event
+	Done    bool   `yaml:"done"`  // "data: [DONE]"
+	Abort   bool   `yaml:"abort"` // Drop the connection
+}
+
+// MockExpect is what the proxy should turn a scenario into
+type MockExpect struct {
+	Status          int      `yaml:"status"`      // HTTP status, default 200
+	StopReason      string   `yaml:"stop_reason"` // Checked if set
+	Blocks          []string `yaml:"blocks"`      // Content block types in order
+	Text            *string  `yaml:"text"`        // Concatenated text blocks
+	Thinking        *string  `yaml:"thinking"`    // Concatenated thinking blocks
+	ToolInputs      []any    `yaml:"tool_inputs"` // Input of each tool_use block
+	ToolNames       []string `yaml:"tool_names"`  // Name of each tool_use block
+	OutputTokens    *int     `yaml:"output_tokens"`
+	InputTokens     *int     `yaml:"input_tokens"`      // Excluding cache reads
+	CacheReadTokens *int     `yaml:"cache_read_tokens"` // cache_read_input_tokens
+	Error           bool     `yaml:"error"`             // Stream must end with an error event
+}
+
+// loadScenarios returns the built-in scenarios, overridden and extended by
+// the *.yaml files in dir
+func loadScenarios(dir string) (map[string]*MockScenario, error) {
+	scenarios := make(map[string]*MockScenario)
+	load := func(fsys fs.FS, root string) error {
+		files, err := fs.Glob(fsys, root+"/*.yaml")
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			b, err := fs.ReadFile(fsys, f)
+			if err != nil {
+				return err
+			}
+			var sc MockScenario
+			dec := yaml.NewDecoder(strings.NewReader(string(b)))
+			dec.KnownFields(true)
+			if err := dec.Decode(&sc); err != nil {
+				return fmt.Errorf("%s: %v", f, err)
+			}
+			if sc.Name == "" {
+				sc.Name = strings.TrimSuffix(filepath.Base(f), ".yaml")
+			}
+			scenarios[sc.Name] = &sc
+		}
+		return nil
+	}
+	if err := load(scenarioFS, "scenarios"); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := load(os.DirFS(dir), "."); err != nil {
+			return nil, err
+		}
+	}
+	return scenarios, nil
+}
+
+func scenarioNames(scenarios map[string]*MockScenario) []string {
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mockUpstreamHandler serves scenarios as an OpenAI-compatible API. The
+// scenario is picked by the X-Mock-Scenario header or the request model.
+func mockUpstreamHandler(scenarios map[string]*MockScenario) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		data := make([]map[string]any, 0, len(scenarios))
+		for _, name := range scenarioNames(scenarios) {
+			data = append(data, map[string]any{"id": name, "object": "model", "owned_by": "mock"})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+	})
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &req); err != nil {
+			mockError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		name := r.Header.Get("X-Mock-Scenario")
+		if name == "" {
+			name = req.Model
+		}
+		sc, ok := scenarios[name]
+		if !ok {
+			mockError(w, http.StatusNotFound, fmt.Sprintf("unknown scenario %q (one of %s)", name, strings.Join(scenarioNames(scenarios), ", ")))
+			return
+		}
+		sc.serve(w, req.Stream)
+	})
+	return mux
+}
+
+func mockError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"message": msg, "type": "invalid_request_error"}})
+}
+
+func (sc *MockScenario) serve(w http.ResponseWriter, stream bool) {
+	status := sc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if !stream || status != http.StatusOK || len(sc.Stream) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(sc.Response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	for _, step := range sc.Stream {
+		if step.DelayMs > 0 {
+			time.Sleep(time.Duration(step.DelayMs) * time.Millisecond)
+		}
+		switch {
+		case step.Abort:
+			// Ends the response without a clean chunked terminator
+			panic(http.ErrAbortHandler)
+		case step.Done:
+			io.WriteString(w, "data: [DONE]\n\n")
+		case step.Raw != "":
+			io.WriteString(w, step.Raw)
+		case step.Data != nil:
+			b, _ := json.Marshal(step.Data)
+			io.WriteString(w, "data: "+string(b)+"\n\n")
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// mockUpstreamCommand runs the mock upstream as a standalone server
+func mockUpstreamCommand(args []string) int {
+	fs := flag.NewFlagSet("mock-upstream", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "Listen address")
+	dir := fs.String("scenarios", "", "Directory with extra *.yaml scenarios")
+	list := fs.Bool("list", false, "List scenarios and exit")
+	fs.Parse(args)
+
+	scenarios, err := loadScenarios(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *list {
+		for _, name := range scenarioNames(scenarios) {
+			fmt.Printf("%-24s %s\n", name, scenarios[name].Description)
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "mock upstream on http://%s serving %d scenarios (use the scenario name as model)\n", *addr, len(scenarios))
+	if err := http.ListenAndServe(*addr, mockUpstreamHandler(scenarios)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
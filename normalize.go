@@ -0,0 +1,156 @@
+package main
+
+import "strings"
+
+// ================= Message Normalization =================
+
+// Route message modes. Strict chat templates (Mistral, Llama on vLLM) want
+// one leading system message, then user and assistant turns alternating,
+// with no empty content.
+const (
+	messagesStrict = "strict"
+)
+
+func validMessageMode(s string) bool {
+	return s == "" || s == messagesStrict
+}
+
+// Starts the conversation when it would otherwise open with the assistant
+const strictFillerText = "Continue."
+
+// normalizeMessages rewrites messages for strict chat templates: system
+// messages are merged into one at the start, empty messages dropped,
+// consecutive user or assistant messages merged and a user turn added if
+// the conversation starts with the assistant. Tool messages stay right
+// after the assistant message with their calls.
+func normalizeMessages(messages []map[string]any) []map[string]any {
+	var system []string
+	rest := make([]map[string]any, 0, len(messages))
+	for _, m := range messages {
+		switch m["role"] {
+		case "system":
+			if s := contentText(m["content"]); strings.TrimSpace(s) != "" {
+				system = append(system, s)
+			}
+			continue
+		case "user":
+			if contentEmpty(m["content"]) {
+				continue
+			}
+		case "assistant":
+			calls, _ := m["tool_calls"].([]map[string]any)
+			if contentEmpty(m["content"]) {
+				if len(calls) == 0 {
+					continue
+				}
+				// Templates choke on "" next to tool calls
+				m = copyMessage(m)
+				delete(m, "content")
+			}
+		case "tool":
+			if contentEmpty(m["content"]) {
+				m = copyMessage(m)
+				m["content"] = "(no output)"
+			}
+		}
+		rest = append(rest, m)
+	}
+
+	out := make([]map[string]any, 0, len(rest)+2)
+	if len(system) > 0 {
+		out = append(out, map[string]any{"role": "system", "content": strings.Join(system, "\n\n")})
+	}
+	for _, m := range rest {
+		last := len(out) - 1
+		if last < 0 || out[last]["role"] == "system" {
+			if m["role"] != "user" {
+				out = append(out, map[string]any{"role": "user", "content": strictFillerText})
+				last++
+			}
+		}
+		prev := out[last]
+		switch {
+		case m["role"] == "user" && prev["role"] == "user":
+			out[last] = copyMessage(prev)
+			out[last]["content"] = mergeContent(prev["content"], m["content"])
+		case m["role"] == "assistant" && prev["role"] == "assistant" && prev["tool_calls"] == nil:
+			merged := copyMessage(m)
+			merged["content"] = mergeContent(prev["content"], m["content"])
+			if merged["content"] == nil {
+				delete(merged, "content")
+			}
+			out[last] = merged
+		default:
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// contentText returns the text of string or part content
+func contentText(c any) string {
+	switch v := c.(type) {
+	case string:
+		return v
+	case []OAContentPart:
+		var texts []string
+		for _, p := range v {
+			if p.Type == "text" {
+				texts = append(texts, p.Text)
+			}
+		}
+		return strings.Join(texts, "\n\n")
+	}
+	return ""
+}
+
+func contentEmpty(c any) bool {
+	switch v := c.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []OAContentPart:
+		for _, p := range v {
+			if p.Type != "text" || strings.TrimSpace(p.Text) != "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// mergeContent joins two message contents, as parts if either has any
+func mergeContent(a, b any) any {
+	if contentEmpty(a) {
+		return b
+	}
+	if contentEmpty(b) {
+		return a
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return as + "\n\n" + bs
+	}
+	return append(contentParts(a), contentParts(b)...)
+}
+
+func contentParts(c any) []OAContentPart {
+	switch v := c.(type) {
+	case string:
+		return []OAContentPart{{Type: "text", Text: v}}
+	case []OAContentPart:
+		return v
+	}
+	return nil
+}
+
+func copyMessage(m map[string]any) map[string]any {
+	c := make(map[string]any, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
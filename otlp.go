@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= OTLP Trace Export =================
+
+// OTLP protocols
+const (
+	otlpHTTPJSON     = "http/json"
+	otlpHTTPProtobuf = "http/protobuf"
+	otlpGRPC         = "grpc"
+)
+
+// TracingConfig configures OTLP trace export. An empty endpoint disables
+// tracing; incoming traceparent headers are still passed upstream.
+type TracingConfig struct {
+	Endpoint    string // Collector URL, e.g. http://localhost:4318
+	Protocol    string // http/json, http/protobuf or grpc
+	Headers     map[string]string
+	ServiceName string
+	SampleRatio float64 // Share of new traces recorded; incoming traces follow their sampled flag
+}
+
+// validateTracing checks the endpoint and fills in defaults
+func validateTracing(cfg *TracingConfig, protocolPath, endpointPath string, errs *ConfigErrors) {
+	if cfg.Protocol == "" {
+		cfg.Protocol = otlpHTTPJSON
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "ant2oa"
+	}
+	switch cfg.Protocol {
+	case otlpHTTPJSON, otlpHTTPProtobuf, otlpGRPC:
+	default:
+		errs.add(protocolPath, "must be http/json, http/protobuf or grpc, got %q", cfg.Protocol)
+	}
+	if cfg.Endpoint != "" && !strings.HasPrefix(cfg.Endpoint, "http://") && !strings.HasPrefix(cfg.Endpoint, "https://") {
+		errs.add(endpointPath, "must be an http(s) URL, got %q", cfg.Endpoint)
+	}
+}
+
+const (
+	spanQueueSize = 4096
+	spanBatchSize = 512
+	spanFlushTime = 5 * time.Second
+)
+
+// spanExporter batches finished spans and sends them to the collector
+type spanExporter struct {
+	cfg     TracingConfig
+	url     string
+	client  *http.Client
+	queue   chan *span
+	done    chan struct{} // Closed when the export loop has flushed and exited
+	stop    chan struct{}
+	dropped atomic.Int64
+}
+
+var tracer atomic.Pointer[spanExporter]
+
+// configureTracing starts, replaces or stops the exporter. An unchanged
+// config keeps the running exporter.
+func configureTracing(cfg TracingConfig) {
+	old := tracer.Load()
+	if old != nil && reflect.DeepEqual(old.cfg, cfg) {
+		return
+	}
+	var exp *spanExporter
+	if cfg.Endpoint != "" {
+		exp = newSpanExporter(cfg)
+		go exp.run()
+		tracingLogger.Info("tracing enabled", "endpoint", exp.url, "protocol", cfg.Protocol)
+	} else if old != nil {
+		tracingLogger.Info("tracing disabled")
+	}
+	tracer.Store(exp)
+	if old != nil {
+		close(old.stop)
+	}
+}
+
+// shutdownTracing flushes queued spans before the process exits
+func shutdownTracing(ctx context.Context) {
+	exp := tracer.Swap(nil)
+	if exp == nil {
+		return
+	}
+	close(exp.stop)
+	select {
+	case <-exp.done:
+	case <-ctx.Done():
+	}
+}
+
+func newSpanExporter(cfg TracingConfig) *spanExporter {
+	e := &spanExporter{
+		cfg:   cfg,
+		url:   strings.TrimSuffix(cfg.Endpoint, "/"),
+		queue: make(chan *span, spanQueueSize),
+		done:  make(chan struct{}),
+		stop:  make(chan struct{}),
+	}
+	transport := &http.Transport{IdleConnTimeout: 90 * time.Second}
+	if cfg.Protocol == otlpGRPC {
+		// gRPC needs HTTP/2, also over plain-text connections
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		e.url += "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+	} else if u, err := url.Parse(cfg.Endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+		e.url += "/v1/traces"
+	}
+	e.client = &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	return e
+}
+
+func (e *spanExporter) enqueue(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *spanExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(spanFlushTime)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, spanBatchSize)
+	flush := func() {
+		if n := e.dropped.Swap(0); n > 0 {
+			tracingLogger.Warn("dropped spans, export queue full", "spans", n)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			tracingLogger.Error("span export failed", "spans", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+					if len(batch) >= spanBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends one ExportTraceServiceRequest
+func (e *spanExporter) export(spans []*span) error {
+	var body []byte
+	var ctype string
+	switch e.cfg.Protocol {
+	case otlpGRPC:
+		msg := encodeTraceRequestProto(spans, e.cfg.ServiceName)
+		body = make([]byte, 5, 5+len(msg)) // Uncompressed gRPC message frame
+		binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+		body = append(body, msg...)
+		ctype = "application/grpc"
+	case otlpHTTPProtobuf:
+		body = encodeTraceRequestProto(spans, e.cfg.ServiceName)
+		ctype = "application/x-protobuf"
+	default:
+		var err error
+		if body, err = json.Marshal(encodeTraceRequestJSON(spans, e.cfg.ServiceName)); err != nil {
+			return err
+		}
+		ctype = "application/json"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ctype)
+	if e.cfg.Protocol == otlpGRPC {
+		req.Header.Set("TE", "trailers")
+	}
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	if e.cfg.Protocol == otlpGRPC {
+		// Trailers-only responses carry the status in the headers
+		status := resp.Trailer.Get("grpc-status")
+		if status == "" {
+			status = resp.Header.Get("grpc-status")
+		}
+		if status != "0" {
+			msg := resp.Trailer.Get("grpc-message")
+			if msg == "" {
+				msg = resp.Header.Get("grpc-message")
+			}
+			return fmt.Errorf("grpc-status %s: %s", status, msg)
+		}
+	}
+	return nil
+}
+
+// ================= OTLP JSON =================
+
+func encodeTraceRequestJSON(spans []*span, service string) map[string]any {
+	out := make([]map[string]any, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		js := map[string]any{
+			"traceId":           hex.EncodeToString(s.sc.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.sc.SpanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrsJSON(s.attrs),
+		}
+		if s.parent != (spanID{}) {
+			js["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.sc.TraceState != "" {
+			js["traceState"] = s.sc.TraceState
+		}
+		if len(s.events) > 0 {
+			events := make([]map[string]any, len(s.events))
+			for j, ev := range s.events {
+				events[j] = map[string]any{"timeUnixNano": strconv.FormatInt(ev.time.UnixNano(), 10), "name": ev.name}
+			}
+			js["events"] = events
+		}
+		if s.errMsg != "" {
+			js["status"] = map[string]any{"code": 2, "message": s.errMsg}
+		}
+		s.mu.Unlock()
+		out[i] = js
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": attrsJSON([]spanAttr{{"service.name", service}})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "ant2oa"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+func attrsJSON(attrs []spanAttr) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]any
+		switch x := a.value.(type) {
+		case string:
+			v = map[string]any{"stringValue": x}
+		case bool:
+			v = map[string]any{"boolValue": x}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": x}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, map[string]any{"key": a.key, "value": v})
+	}
+	return out
+}
+
+// ================= OTLP Protobuf =================
+
+// protoWriter appends protobuf wire format; field numbers follow
+// opentelemetry/proto/collector/trace/v1/trace_service.proto
+type protoWriter struct {
+	b []byte
+}
+
+func (p *protoWriter) tag(field, wire int) {
+	p.b = binary.AppendUvarint(p.b, uint64(field<<3|wire))
+}
+
+func (p *protoWriter) varint(field int, v uint64) {
+	p.tag(field, 0)
+	p.b = binary.AppendUvarint(p.b, v)
+}
+
+func (p *protoWriter) fixed64(field int, v uint64) {
+	p.tag(field, 1)
+	p.b = binary.LittleEndian.AppendUint64(p.b, v)
+}
+
+func (p *protoWriter) bytes(field int, b []byte) {
+	p.tag(field, 2)
+	p.b = binary.AppendUvarint(p.b, uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protoWriter) string(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+func (p *protoWriter) message(field int, fn func(m *protoWriter)) {
+	var m protoWriter
+	fn(&m)
+	p.bytes(field, m.b)
+}
+
+func encodeTraceRequestProto(spans []*span, service string) []byte {
+	var p protoWriter
+	p.message(1, func(rs *protoWriter) { // ResourceSpans
+		rs.message(1, func(res *protoWriter) { // Resource
+			protoAttrs(res, 1, []spanAttr{{"service.name", service}})
+		})
+		rs.message(2, func(ss *protoWriter) { // ScopeSpans
+			ss.message(1, func(scope *protoWriter) { scope.string(1, "ant2oa") })
+			for _, s := range spans {
+				ss.message(2, func(m *protoWriter) { protoSpan(m, s) })
+			}
+		})
+	})
+	return p.b
+}
+
+func protoSpan(m *protoWriter, s *span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.bytes(1, s.sc.TraceID[:])
+	m.bytes(2, s.sc.SpanID[:])
+	if s.sc.TraceState != "" {
+		m.string(3, s.sc.TraceState)
+	}
+	if s.parent != (spanID{}) {
+		m.bytes(4, s.parent[:])
+	}
+	m.string(5, s.name)
+	m.varint(6, uint64(s.kind))
+	m.fixed64(7, uint64(s.start.UnixNano()))
+	m.fixed64(8, uint64(s.end.UnixNano()))
+	protoAttrs(m, 9, s.attrs)
+	for _, ev := range s.events {
+		m.message(11, func(e *protoWriter) {
+			e.fixed64(1, uint64(ev.time.UnixNano()))
+			e.string(2, ev.name)
+		})
+	}
+	if s.errMsg != "" {
+		m.message(15, func(st *protoWriter) {
+			st.string(2, s.errMsg)
+			st.varint(3, 2) // STATUS_CODE_ERROR
+		})
+	}
+}
+
+func protoAttrs(p *protoWriter, field int, attrs []spanAttr) {
+	for _, a := range attrs {
+		p.message(field, func(kv *protoWriter) {
+			kv.string(1, a.key)
+			kv.message(2, func(v *protoWriter) { // AnyValue
+				switch x := a.value.(type) {
+				case string:
+					v.string(1, x)
+				case bool:
+					b := uint64(0)
+					if x {
+						b = 1
+					}
+					v.varint(2, b)
+				case int:
+					v.varint(3, uint64(x))
+				case int64:
+					v.varint(3, uint64(x))
+				case float64:
+					v.fixed64(4, math.Float64bits(x))
+				default:
+					v.string(1, fmt.Sprint(x))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,1030 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// ================= PDF Text Extraction =================
+
+// A minimal PDF reader for pulling the text out of documents sent to
+// upstreams that can't read PDFs. It scans for objects instead of trusting
+// the xref table, so damaged files still give what text they have.
+
+type (
+	pdfName    string
+	pdfString  []byte
+	pdfRef     struct{ num, gen int }
+	pdfDict    map[string]any
+	pdfKeyword string
+)
+
+type pdfObject struct {
+	val    any
+	stream []byte // Raw stream data, nil if the object has none
+
+	decoded   []byte // Filtered stream, once decode has run
+	decodeErr error
+	done      bool
+}
+
+type pdfFile struct {
+	objs  map[int]*pdfObject
+	fonts map[int]*pdfFont
+
+	// Left of the per-document limits, which keep decompression bombs and
+	// shared streams used over and over from running away
+	decodeLeft  int
+	contentLeft int
+	truncated   bool
+}
+
+// Limits per document. Content streams count on each use, as a stream
+// shared by every page is run for each of them.
+const (
+	pdfMaxPages        = 2000
+	pdfMaxDecodedBytes = 64 << 20
+	pdfMaxContentBytes = 256 << 20
+)
+
+var errPDFTooLarge = errors.New("decoded data over the limit")
+
+var pdfObjHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// extractPDFText returns the text of a PDF, pages separated by a marker
+func extractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\r\n "), []byte("%PDF")) {
+		return "", errors.New("not a PDF file")
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return "", errors.New("PDF is encrypted")
+	}
+	f := &pdfFile{
+		objs:        make(map[int]*pdfObject),
+		fonts:       make(map[int]*pdfFont),
+		decodeLeft:  pdfMaxDecodedBytes,
+		contentLeft: pdfMaxContentBytes,
+	}
+	f.scan(data)
+
+	pages := f.pages()
+	if len(pages) == 0 {
+		return "", errors.New("no pages found")
+	}
+	var sb strings.Builder
+	for i, page := range pages {
+		text := strings.TrimSpace(f.pageText(page))
+		if len(pages) > 1 {
+			fmt.Fprintf(&sb, "--- Page %d ---\n", i+1)
+		}
+		sb.WriteString(text)
+		sb.WriteString("\n\n")
+		if f.truncated {
+			sb.WriteString("(text extraction stopped here: the document is too large)")
+			break
+		}
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// scan reads every "N G obj" in the file, later definitions winning as
+// in incremental updates, then the objects packed in object streams
+func (f *pdfFile) scan(data []byte) {
+	for _, m := range pdfObjHeader.FindAllSubmatchIndex(data, -1) {
+		num, _ := strconv.Atoi(string(data[m[2]:m[3]]))
+		lx := &pdfLexer{b: data, pos: m[1]}
+		val, err := lx.value()
+		if err != nil {
+			continue
+		}
+		obj := &pdfObject{val: val}
+		lx.skipSpace()
+		if lx.pos <= len(data) && bytes.HasPrefix(data[lx.pos:], []byte("stream")) {
+			obj.stream = streamData(data, lx.pos+len("stream"), val)
+		}
+		f.objs[num] = obj
+	}
+
+	for _, obj := range f.objs {
+		d, ok := obj.val.(pdfDict)
+		if !ok || d["Type"] != pdfName("ObjStm") || obj.stream == nil {
+			continue
+		}
+		body, err := f.decode(obj)
+		if err != nil {
+			continue
+		}
+		n, first := f.int(d["N"]), f.int(d["First"])
+		lx := &pdfLexer{b: body}
+		for i := 0; i < n; i++ {
+			num, err1 := lx.value()
+			off, err2 := lx.value()
+			if err1 != nil || err2 != nil {
+				break
+			}
+			numF, _ := num.(float64)
+			offF, _ := off.(float64)
+			pos := first + int(offF)
+			if _, exists := f.objs[int(numF)]; exists || first < 0 || offF < 0 || pos < 0 || pos >= len(body) {
+				continue
+			}
+			vl := &pdfLexer{b: body, pos: pos}
+			if val, err := vl.value(); err == nil {
+				f.objs[int(numF)] = &pdfObject{val: val}
+			}
+		}
+	}
+}
+
+// streamData returns the bytes between "stream" and "endstream"
+func streamData(data []byte, start int, dict any) []byte {
+	if start < len(data) && data[start] == '\r' {
+		start++
+	}
+	if start < len(data) && data[start] == '\n' {
+		start++
+	}
+	if start > len(data) {
+		return nil
+	}
+	// Trust /Length if it is direct and lands on endstream
+	if d, ok := dict.(pdfDict); ok {
+		if n, ok := d["Length"].(float64); ok && n >= 0 && n <= float64(len(data)-start) {
+			end := start + int(n)
+			if bytes.HasPrefix(bytes.TrimLeft(data[end:], "\r\n\t "), []byte("endstream")) {
+				return data[start:end]
+			}
+		}
+	}
+	end := bytes.Index(data[start:], []byte("endstream"))
+	if end < 0 {
+		return data[start:]
+	}
+	return bytes.TrimRight(data[start:start+end], "\r\n")
+}
+
+// resolve follows references
+func (f *pdfFile) resolve(v any) any {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		obj := f.objs[ref.num]
+		if obj == nil {
+			return nil
+		}
+		v = obj.val
+	}
+	return nil
+}
+
+func (f *pdfFile) dict(v any) pdfDict {
+	d, _ := f.resolve(v).(pdfDict)
+	return d
+}
+
+func (f *pdfFile) int(v any) int {
+	n, _ := f.resolve(v).(float64)
+	return int(n)
+}
+
+// decode returns an object's stream data with its filters applied. Results
+// are kept, so streams shared between pages are decoded once.
+func (f *pdfFile) decode(obj *pdfObject) ([]byte, error) {
+	if !obj.done {
+		obj.decoded, obj.decodeErr = f.applyFilters(obj)
+		obj.done = true
+		if obj.decodeErr == errPDFTooLarge {
+			f.truncated = true
+		} else {
+			f.decodeLeft -= len(obj.decoded)
+		}
+	}
+	return obj.decoded, obj.decodeErr
+}
+
+func (f *pdfFile) applyFilters(obj *pdfObject) ([]byte, error) {
+	d, _ := obj.val.(pdfDict)
+	var filters []any
+	switch flt := f.resolve(d["Filter"]).(type) {
+	case pdfName:
+		filters = []any{flt}
+	case []any:
+		filters = flt
+	}
+	b := obj.stream
+	for _, flt := range filters {
+		var err error
+		switch f.resolve(flt) {
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			b, err = inflate(b, f.decodeLeft)
+		case pdfName("ASCIIHexDecode"), pdfName("AHx"):
+			b, err = asciiHexDecode(b)
+		case pdfName("ASCII85Decode"), pdfName("A85"):
+			b, err = ascii85Decode(b)
+		default:
+			err = fmt.Errorf("unsupported filter %v", flt)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(b) > f.decodeLeft {
+		return nil, errPDFTooLarge
+	}
+	return b, nil
+}
+
+// inflate decompresses up to limit bytes
+func inflate(b []byte, limit int) ([]byte, error) {
+	read := func(r io.Reader) ([]byte, error) {
+		out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+		if len(out) > limit {
+			return nil, errPDFTooLarge
+		}
+		return out, err
+	}
+	if r, err := zlib.NewReader(bytes.NewReader(b)); err == nil {
+		out, err := read(r)
+		// Truncated streams still give their start
+		if len(out) > 0 || err == nil {
+			return out, nil
+		}
+		if err == errPDFTooLarge {
+			return nil, err
+		}
+	}
+	out, err := read(flate.NewReader(bytes.NewReader(b)))
+	if len(out) > 0 {
+		return out, nil
+	}
+	return nil, err
+}
+
+func asciiHexDecode(b []byte) ([]byte, error) {
+	var clean []byte
+	for _, c := range b {
+		if c == '>' {
+			break
+		}
+		if isHexDigit(c) {
+			clean = append(clean, c)
+		}
+	}
+	if len(clean)%2 == 1 {
+		clean = append(clean, '0')
+	}
+	out := make([]byte, len(clean)/2)
+	_, err := hex.Decode(out, clean)
+	return out, err
+}
+
+func ascii85Decode(b []byte) ([]byte, error) {
+	var out []byte
+	var group [5]byte
+	n := 0
+	for _, c := range b {
+		switch {
+		case c == '~':
+			goto done
+		case c == 'z' && n == 0:
+			out = append(out, 0, 0, 0, 0)
+		case c >= '!' && c <= 'u':
+			group[n] = c - '!'
+			n++
+			if n == 5 {
+				v := uint32(0)
+				for _, g := range group {
+					v = v*85 + uint32(g)
+				}
+				out = append(out, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+				n = 0
+			}
+		}
+	}
+done:
+	if n > 1 {
+		for i := n; i < 5; i++ {
+			group[i] = 84
+		}
+		v := uint32(0)
+		for _, g := range group {
+			v = v*85 + uint32(g)
+		}
+		out = append(out, []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}[:n-1]...)
+	}
+	return out, nil
+}
+
+// pdfPage is a page with the resources it inherits
+type pdfPage struct {
+	dict      pdfDict
+	resources pdfDict
+}
+
+// pages walks the page tree from the catalog
+func (f *pdfFile) pages() []pdfPage {
+	var root pdfDict
+	for _, obj := range f.objs {
+		if d, ok := obj.val.(pdfDict); ok && d["Type"] == pdfName("Catalog") {
+			root = f.dict(d["Pages"])
+			break
+		}
+	}
+	var pages []pdfPage
+	seen := make(map[int]bool) // Page tree objects, in case of cycles
+	var walk func(node pdfDict, res pdfDict, depth int)
+	walk = func(node pdfDict, res pdfDict, depth int) {
+		if node == nil || depth > 64 || len(pages) >= pdfMaxPages {
+			return
+		}
+		if r := f.dict(node["Resources"]); r != nil {
+			res = r
+		}
+		kids, ok := f.resolve(node["Kids"]).([]any)
+		if !ok || node["Type"] == pdfName("Page") {
+			pages = append(pages, pdfPage{dict: node, resources: res})
+			return
+		}
+		for _, kid := range kids {
+			if ref, ok := kid.(pdfRef); ok {
+				if seen[ref.num] {
+					continue
+				}
+				seen[ref.num] = true
+			}
+			walk(f.dict(kid), res, depth+1)
+		}
+	}
+	walk(root, nil, 0)
+
+	// No usable catalog: take the page objects in number order
+	if len(pages) == 0 {
+		nums := make([]int, 0, len(f.objs))
+		for num, obj := range f.objs {
+			if d, ok := obj.val.(pdfDict); ok && d["Type"] == pdfName("Page") {
+				nums = append(nums, num)
+			}
+		}
+		sort.Ints(nums)
+		if len(nums) > pdfMaxPages {
+			nums = nums[:pdfMaxPages]
+		}
+		for _, num := range nums {
+			d := f.objs[num].val.(pdfDict)
+			pages = append(pages, pdfPage{dict: d, resources: f.dict(d["Resources"])})
+		}
+	}
+	return pages
+}
+
+func (f *pdfFile) pageText(p pdfPage) string {
+	var content []byte
+	switch c := p.dict["Contents"].(type) {
+	case []any:
+		for _, ref := range c {
+			content = append(content, f.streamOf(ref)...)
+			content = append(content, '\n')
+		}
+	default:
+		// A reference to a stream, or to an array of them
+		if arr, ok := f.resolve(c).([]any); ok {
+			for _, ref := range arr {
+				content = append(content, f.streamOf(ref)...)
+				content = append(content, '\n')
+			}
+		} else {
+			content = f.streamOf(c)
+		}
+	}
+	var sb strings.Builder
+	f.showText(&sb, content, p.resources, 0)
+	return cleanPDFText(sb.String())
+}
+
+// streamOf returns the decoded stream of a referenced object
+func (f *pdfFile) streamOf(v any) []byte {
+	ref, ok := v.(pdfRef)
+	if !ok {
+		return nil
+	}
+	obj := f.objs[ref.num]
+	if obj == nil || obj.stream == nil {
+		return nil
+	}
+	b, err := f.decode(obj)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// showText runs a content stream's text operators
+func (f *pdfFile) showText(sb *strings.Builder, content []byte, res pdfDict, depth int) {
+	if len(content) > f.contentLeft {
+		f.truncated = true
+		return
+	}
+	f.contentLeft -= len(content)
+	fonts := f.dict(res["Font"])
+	var font *pdfFont
+	var stack []any
+	lastY := math.NaN()
+
+	newline := func() {
+		if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+			sb.WriteByte('\n')
+		}
+	}
+	space := func() {
+		if s := sb.String(); len(s) > 0 && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\n") {
+			sb.WriteByte(' ')
+		}
+	}
+	show := func(v any) {
+		if s, ok := v.(pdfString); ok {
+			sb.WriteString(font.decode(s))
+		}
+	}
+	num := func(i int) float64 {
+		if i < 0 || i >= len(stack) {
+			return 0
+		}
+		n, _ := stack[i].(float64)
+		return n
+	}
+
+	lx := &pdfLexer{b: content}
+	for {
+		tok, err := lx.value()
+		if err != nil {
+			break
+		}
+		op, ok := tok.(pdfKeyword)
+		if !ok {
+			stack = append(stack, tok)
+			continue
+		}
+		switch op {
+		case "BT":
+			lastY = math.NaN()
+		case "ET":
+			space()
+		case "Tf":
+			if len(stack) >= 2 {
+				if name, ok := stack[len(stack)-2].(pdfName); ok {
+					font = f.font(fonts[string(name)])
+				}
+			}
+		case "Td", "TD":
+			if len(stack) >= 2 {
+				if ty := num(len(stack) - 1); ty != 0 {
+					newline()
+				} else if num(len(stack)-2) > 0 {
+					space()
+				}
+			}
+		case "Tm":
+			if len(stack) >= 6 {
+				y := num(len(stack) - 1)
+				if !math.IsNaN(lastY) && math.Abs(y-lastY) > 1 {
+					newline()
+				} else {
+					space()
+				}
+				lastY = y
+			}
+		case "T*":
+			newline()
+		case "Tj":
+			if len(stack) > 0 {
+				show(stack[len(stack)-1])
+			}
+		case "'", "\"":
+			newline()
+			if len(stack) > 0 {
+				show(stack[len(stack)-1])
+			}
+		case "TJ":
+			if len(stack) > 0 {
+				if arr, ok := stack[len(stack)-1].([]any); ok {
+					for _, e := range arr {
+						if n, ok := e.(float64); ok {
+							if n < -200 {
+								space()
+							}
+						} else {
+							show(e)
+						}
+					}
+				}
+			}
+		case "Do":
+			// Text in form XObjects
+			if len(stack) > 0 && depth < 8 {
+				if name, ok := stack[len(stack)-1].(pdfName); ok {
+					ref := f.dict(res["XObject"])[string(name)]
+					if r, ok := ref.(pdfRef); ok {
+						if obj := f.objs[r.num]; obj != nil {
+							if d, ok := obj.val.(pdfDict); ok && d["Subtype"] == pdfName("Form") {
+								formRes := f.dict(d["Resources"])
+								if formRes == nil {
+									formRes = res
+								}
+								f.showText(sb, f.streamOf(r), formRes, depth+1)
+							}
+						}
+					}
+				}
+			}
+		case "BI":
+			lx.skipInlineImage()
+		}
+		stack = stack[:0]
+	}
+}
+
+// cleanPDFText trims lines and collapses runs of blank lines
+func cleanPDFText(s string) string {
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	blank := 0
+	for _, l := range lines {
+		l = strings.Join(strings.Fields(l), " ")
+		if l == "" {
+			if blank++; blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		out = append(out, l)
+	}
+	return strings.Join(out, "\n")
+}
+
+// ================= PDF Fonts =================
+
+// pdfFont maps character codes in shown strings to text
+type pdfFont struct {
+	codeLen int               // Bytes per code
+	cmap    map[uint32]string // From ToUnicode
+	simple  map[byte]rune     // From /Differences, for simple fonts
+}
+
+func (f *pdfFile) font(ref any) *pdfFont {
+	r, isRef := ref.(pdfRef)
+	if ft, ok := f.fonts[r.num]; isRef && ok {
+		return ft
+	}
+	d := f.dict(ref)
+	ft := &pdfFont{codeLen: 1}
+	if d["Subtype"] == pdfName("Type0") {
+		ft.codeLen = 2
+	}
+	if r, ok := d["ToUnicode"].(pdfRef); ok {
+		if b := f.streamOf(r); b != nil {
+			ft.parseCMap(b)
+		}
+	}
+	if enc := f.dict(d["Encoding"]); enc != nil {
+		if diffs, ok := f.resolve(enc["Differences"]).([]any); ok {
+			ft.simple = make(map[byte]rune)
+			code := 0
+			for _, e := range diffs {
+				switch v := e.(type) {
+				case float64:
+					code = int(v)
+				case pdfName:
+					if r, ok := glyphRune(string(v)); ok && code < 256 {
+						ft.simple[byte(code)] = r
+					}
+					code++
+				}
+			}
+		}
+	}
+	if isRef {
+		f.fonts[r.num] = ft
+	}
+	return ft
+}
+
+// parseCMap reads the bfchar and bfrange mappings of a ToUnicode CMap
+func (ft *pdfFont) parseCMap(b []byte) {
+	ft.cmap = make(map[uint32]string)
+	lx := &pdfLexer{b: b}
+	var stack []any
+	mode := ""
+	for {
+		tok, err := lx.value()
+		if err != nil {
+			return
+		}
+		kw, ok := tok.(pdfKeyword)
+		if !ok {
+			if mode != "" {
+				stack = append(stack, tok)
+			}
+			continue
+		}
+		switch kw {
+		case "begincodespacerange", "beginbfchar", "beginbfrange":
+			mode, stack = string(kw), nil
+		case "endcodespacerange":
+			if len(stack) > 0 {
+				if s, ok := stack[0].(pdfString); ok && len(s) > 0 {
+					ft.codeLen = len(s)
+				}
+			}
+			mode = ""
+		case "endbfchar":
+			for i := 0; i+1 < len(stack); i += 2 {
+				src, _ := stack[i].(pdfString)
+				dst, _ := stack[i+1].(pdfString)
+				ft.cmap[codeOf(src)] = utf16BE(dst)
+			}
+			mode = ""
+		case "endbfrange":
+			for i := 0; i+2 < len(stack); i += 3 {
+				lo, _ := stack[i].(pdfString)
+				hi, _ := stack[i+1].(pdfString)
+				start, end := codeOf(lo), codeOf(hi)
+				if end < start || end-start > 65535 {
+					continue
+				}
+				switch dst := stack[i+2].(type) {
+				case pdfString:
+					// Consecutive codes map to consecutive characters
+					base := []rune(utf16BE(dst))
+					if len(base) == 0 {
+						continue
+					}
+					for c := start; c <= end; c++ {
+						r := append([]rune{}, base...)
+						r[len(r)-1] += rune(c - start)
+						ft.cmap[c] = string(r)
+					}
+				case []any:
+					for j, d := range dst {
+						if s, ok := d.(pdfString); ok && start+uint32(j) <= end {
+							ft.cmap[start+uint32(j)] = utf16BE(s)
+						}
+					}
+				}
+			}
+			mode = ""
+		}
+	}
+}
+
+func (ft *pdfFont) decode(s pdfString) string {
+	if ft == nil {
+		ft = &pdfFont{codeLen: 1}
+	}
+	var sb strings.Builder
+	n := ft.codeLen
+	if n < 1 || n > 4 {
+		n = 1
+	}
+	for i := 0; i+n <= len(s); i += n {
+		code := codeOf(s[i : i+n])
+		if t, ok := ft.cmap[code]; ok {
+			sb.WriteString(t)
+			continue
+		}
+		if n > 1 {
+			continue // CID without a mapping: no way to know the character
+		}
+		if r, ok := ft.simple[byte(code)]; ok {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune(winAnsiRune(byte(code)))
+		}
+	}
+	return sb.String()
+}
+
+func codeOf(b []byte) uint32 {
+	var c uint32
+	for _, x := range b {
+		c = c<<8 | uint32(x)
+	}
+	return c
+}
+
+func utf16BE(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(u))
+}
+
+// WinAnsi differs from Latin-1 in 0x80-0x9F
+var winAnsiHigh = map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡', 0x88: 'ˆ',
+	0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž', 0x91: '‘', 0x92: '’', 0x93: '“',
+	0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—', 0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›',
+	0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+}
+
+func winAnsiRune(c byte) rune {
+	if r, ok := winAnsiHigh[c]; ok {
+		return r
+	}
+	if c < 0x20 && c != '\t' {
+		return ' '
+	}
+	return rune(c)
+}
+
+var glyphNames = map[string]rune{
+	"space": ' ', "exclam": '!', "quotedbl": '"', "numbersign": '#', "dollar": '$', "percent": '%',
+	"ampersand": '&', "quotesingle": '\'', "parenleft": '(', "parenright": ')', "asterisk": '*',
+	"plus": '+', "comma": ',', "hyphen": '-', "period": '.', "slash": '/', "colon": ':',
+	"semicolon": ';', "less": '<', "equal": '=', "greater": '>', "question": '?', "at": '@',
+	"bracketleft": '[', "backslash": '\\', "bracketright": ']', "underscore": '_', "braceleft": '{',
+	"bar": '|', "braceright": '}', "quoteleft": '‘', "quoteright": '’', "quotedblleft": '“',
+	"quotedblright": '”', "endash": '–', "emdash": '—', "bullet": '•', "ellipsis": '…',
+	"zero": '0', "one": '1', "two": '2', "three": '3', "four": '4', "five": '5', "six": '6',
+	"seven": '7', "eight": '8', "nine": '9', "fi": 'ﬁ', "fl": 'ﬂ',
+}
+
+// glyphRune maps a glyph name from an encoding's /Differences
+func glyphRune(name string) (rune, bool) {
+	if len(name) == 1 {
+		return rune(name[0]), true
+	}
+	if r, ok := glyphNames[name]; ok {
+		return r, true
+	}
+	if strings.HasPrefix(name, "uni") && len(name) == 7 {
+		if v, err := strconv.ParseUint(name[3:], 16, 32); err == nil {
+			return rune(v), true
+		}
+	}
+	return 0, false
+}
+
+// ================= PDF Lexer =================
+
+type pdfLexer struct {
+	b   []byte
+	pos int
+}
+
+var errPDFEnd = errors.New("end of data")
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelim(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func (lx *pdfLexer) skipSpace() {
+	for lx.pos < len(lx.b) {
+		c := lx.b[lx.pos]
+		if isPDFSpace(c) {
+			lx.pos++
+		} else if c == '%' {
+			for lx.pos < len(lx.b) && lx.b[lx.pos] != '\n' && lx.b[lx.pos] != '\r' {
+				lx.pos++
+			}
+		} else {
+			return
+		}
+	}
+}
+
+// value reads one object; a number followed by "G R" is a reference
+func (lx *pdfLexer) value() (any, error) {
+	return lx.valueAt(0)
+}
+
+func (lx *pdfLexer) token(depth int) (any, error) {
+	if depth > 100 {
+		return nil, errors.New("nesting too deep")
+	}
+	lx.skipSpace()
+	if lx.pos >= len(lx.b) {
+		return nil, errPDFEnd
+	}
+	c := lx.b[lx.pos]
+	switch {
+	case c == '/':
+		lx.pos++
+		start := lx.pos
+		for lx.pos < len(lx.b) && !isPDFSpace(lx.b[lx.pos]) && !isPDFDelim(lx.b[lx.pos]) {
+			lx.pos++
+		}
+		return pdfName(unescapeName(lx.b[start:lx.pos])), nil
+	case c == '(':
+		return lx.literalString(), nil
+	case c == '<' && lx.pos+1 < len(lx.b) && lx.b[lx.pos+1] == '<':
+		lx.pos += 2
+		d := pdfDict{}
+		for {
+			lx.skipSpace()
+			if lx.pos+1 < len(lx.b) && lx.b[lx.pos] == '>' && lx.b[lx.pos+1] == '>' {
+				lx.pos += 2
+				return d, nil
+			}
+			k, err := lx.token(depth + 1)
+			if err != nil {
+				return d, err
+			}
+			name, ok := k.(pdfName)
+			if !ok {
+				continue
+			}
+			v, err := lx.valueAt(depth + 1)
+			if err != nil {
+				return d, err
+			}
+			d[string(name)] = v
+		}
+	case c == '<':
+		lx.pos++
+		start := lx.pos
+		for lx.pos < len(lx.b) && lx.b[lx.pos] != '>' {
+			lx.pos++
+		}
+		s, _ := asciiHexDecode(lx.b[start:lx.pos])
+		if lx.pos < len(lx.b) {
+			lx.pos++ // >
+		}
+		return pdfString(s), nil
+	case c == '[':
+		lx.pos++
+		var arr []any
+		for {
+			lx.skipSpace()
+			if lx.pos < len(lx.b) && lx.b[lx.pos] == ']' {
+				lx.pos++
+				if arr == nil {
+					arr = []any{}
+				}
+				return arr, nil
+			}
+			v, err := lx.valueAt(depth + 1)
+			if err != nil {
+				return arr, err
+			}
+			arr = append(arr, v)
+		}
+	case c == ']' || c == '>' || c == ')' || c == '{' || c == '}':
+		lx.pos++
+		return pdfKeyword(string(c)), nil
+	}
+
+	start := lx.pos
+	for lx.pos < len(lx.b) && !isPDFSpace(lx.b[lx.pos]) && !isPDFDelim(lx.b[lx.pos]) {
+		lx.pos++
+	}
+	word := string(lx.b[start:lx.pos])
+	if n, err := strconv.ParseFloat(word, 64); err == nil {
+		return n, nil
+	}
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	return pdfKeyword(word), nil
+}
+
+// valueAt reads an object nested depth levels deep
+func (lx *pdfLexer) valueAt(depth int) (any, error) {
+	v, err := lx.token(depth)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := v.(float64); ok && n == math.Trunc(n) && n >= 0 {
+		save := lx.pos
+		if g, err := lx.token(depth); err == nil {
+			if gn, ok := g.(float64); ok && gn == math.Trunc(gn) {
+				if r, err := lx.token(depth); err == nil && r == pdfKeyword("R") {
+					return pdfRef{int(n), int(gn)}, nil
+				}
+			}
+		}
+		lx.pos = save
+	}
+	return v, nil
+}
+
+func (lx *pdfLexer) literalString() pdfString {
+	lx.pos++ // (
+	var out []byte
+	depth := 1
+	for lx.pos < len(lx.b) {
+		c := lx.b[lx.pos]
+		lx.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return out
+			}
+		case '\\':
+			if lx.pos >= len(lx.b) {
+				return out
+			}
+			e := lx.b[lx.pos]
+			lx.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				// Line continuation
+				if e == '\r' && lx.pos < len(lx.b) && lx.b[lx.pos] == '\n' {
+					lx.pos++
+				}
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && lx.pos < len(lx.b) && lx.b[lx.pos] >= '0' && lx.b[lx.pos] <= '7'; i++ {
+						v = v*8 + int(lx.b[lx.pos]-'0')
+						lx.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func unescapeName(b []byte) string {
+	if bytes.IndexByte(b, '#') < 0 {
+		return string(b)
+	}
+	var out []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] == '#' && i+2 < len(b) && isHexDigit(b[i+1]) && isHexDigit(b[i+2]) {
+			v, _ := strconv.ParseUint(string(b[i+1:i+3]), 16, 8)
+			out = append(out, byte(v))
+			i += 2
+			continue
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
+
+// skipInlineImage moves past an inline image's "ID <data> EI"
+func (lx *pdfLexer) skipInlineImage() {
+	id := bytes.Index(lx.b[lx.pos:], []byte("ID"))
+	if id < 0 {
+		lx.pos = len(lx.b)
+		return
+	}
+	lx.pos = min(lx.pos+id+3, len(lx.b))
+	for lx.pos+2 <= len(lx.b) {
+		i := bytes.Index(lx.b[lx.pos:], []byte("EI"))
+		if i < 0 {
+			lx.pos = len(lx.b)
+			return
+		}
+		lx.pos += i + 2
+		before := lx.b[lx.pos-3]
+		if isPDFSpace(before) && (lx.pos >= len(lx.b) || isPDFSpace(lx.b[lx.pos])) {
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPDF = "%PDF-1.4\n" +
+	"1 0 obj <</Type/Catalog/Pages 2 0 R>> endobj\n" +
+	"2 0 obj <</Type/Pages/Kids[3 0 R]/Count 1>> endobj\n" +
+	"3 0 obj <</Type/Page/Parent 2 0 R/Contents 4 0 R>> endobj\n" +
+	"4 0 obj <</Length 32>> stream\nBT /F1 12 Tf (Hello, PDF) Tj ET\nendstream endobj\n" +
+	"%%EOF\n"
+
+func TestExtractPDFText(t *testing.T) {
+	text, err := extractPDFText([]byte(testPDF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "Hello, PDF") {
+		t.Fatalf("text = %q, want it to contain %q", text, "Hello, PDF")
+	}
+}
+
+// FuzzExtractPDFText checks the parser never panics on client documents
+func FuzzExtractPDFText(f *testing.F) {
+	f.Add([]byte(testPDF))
+	f.Add([]byte("%PDF-1.5\n5 0 obj <</Type/ObjStm/N 2/First -50>> stream\n1 0 2 5 (x) (y)\nendstream endobj"))
+	f.Add([]byte("%PDF0 0 obj<"))
+	f.Add([]byte("%PDF-1.4\n1 0 obj <</Length -31>> stream\nBT (x) Tj ET\nendstream endobj"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		extractPDFText(data)
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import "strings"
+
+// ================= Assistant Prefill =================
+
+// Route prefill strategies, for requests that end with a partial assistant
+// turn the model should continue. Without one the turn is sent as it is.
+const (
+	prefillPrefix   = "prefix"   // "prefix": true on the message (DeepSeek, Mistral)
+	prefillContinue = "continue" // continue_final_message (vLLM)
+	prefillEmulate  = "emulate"  // Ask for a reply starting with the text
+)
+
+func validPrefill(s string) bool {
+	return s == "" || s == prefillPrefix || s == prefillContinue || s == prefillEmulate
+}
+
+// trailingPrefill returns the final message if it is an assistant turn
+// without tool calls, which the client wants continued
+func trailingPrefill(messages []map[string]any) map[string]any {
+	if len(messages) == 0 {
+		return nil
+	}
+	last := messages[len(messages)-1]
+	if last["role"] != "assistant" || last["tool_calls"] != nil || contentEmpty(last["content"]) {
+		return nil
+	}
+	return last
+}
+
+// applyPrefill hands a trailing assistant turn to the route's continuation
+// mechanism. It returns the messages to send and, unless the upstream is
+// known to return only the continuation, the prefill text to cut from the
+// start of the response.
+func applyPrefill(oaReqMap map[string]any, messages []map[string]any, route *RouteConfig) ([]map[string]any, string) {
+	last := trailingPrefill(messages)
+	if last == nil {
+		return messages, ""
+	}
+	strategy := ""
+	if route != nil {
+		strategy = route.Prefill
+	}
+	text := contentText(last["content"])
+	switch strategy {
+	case prefillPrefix:
+		last["prefix"] = true
+		return messages, ""
+	case prefillContinue:
+		oaReqMap["continue_final_message"] = true
+		oaReqMap["add_generation_prompt"] = false
+		return messages, ""
+	case prefillEmulate:
+		instruction := "Your reply must start with exactly the text between the <prefill> tags, continuing from there:\n<prefill>" + text + "</prefill>"
+		return appendUserText(messages[:len(messages)-1], instruction), text
+	}
+	return messages, text
+}
+
+// prefillStitcher cuts a repeated prefill from the start of streamed text,
+// so the client only gets the continuation, as from Anthropic. Text is held
+// back only while it could still be the prefill. A nil stitcher passes
+// everything through.
+type prefillStitcher struct {
+	prefill string
+	buf     string
+	done    bool
+}
+
+func newPrefillStitcher(prefill string) *prefillStitcher {
+	if strings.TrimSpace(prefill) == "" {
+		return nil
+	}
+	return &prefillStitcher{prefill: strings.TrimSpace(prefill)}
+}
+
+// feed returns the text that can be sent on
+func (s *prefillStitcher) feed(text string) string {
+	if s == nil || s.done {
+		return text
+	}
+	s.buf += text
+	body := strings.TrimLeft(s.buf, " \t\r\n")
+	switch {
+	case strings.HasPrefix(body, s.prefill):
+		s.done = true
+		return body[len(s.prefill):]
+	case strings.HasPrefix(s.prefill, body):
+		return "" // Can't tell yet
+	}
+	s.done = true
+	return s.buf
+}
+
+// flush returns held back text at the end of the text
+func (s *prefillStitcher) flush() string {
+	if s == nil || s.done {
+		return ""
+	}
+	s.done = true
+	return s.buf
+}
+
+// cutPrefillEcho is the stitcher for a complete text
+func cutPrefillEcho(text, prefill string) string {
+	s := newPrefillStitcher(prefill)
+	out := s.feed(text)
+	return out + s.flush()
+}
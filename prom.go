@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ================= Prometheus Exposition =================
+
+// expositionWriter writes the Prometheus text format (version 0.0.4)
+type expositionWriter struct {
+	w *bufio.Writer
+}
+
+func newExpositionWriter(w io.Writer) *expositionWriter {
+	return &expositionWriter{w: bufio.NewWriter(w)}
+}
+
+// header starts a metric family
+func (e *expositionWriter) header(name, typ, help string) {
+	e.w.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	e.w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes one sample line; names and values are paired by index
+func (e *expositionWriter) sample(name string, labelNames, labelValues []string, value float64) {
+	e.w.WriteString(name)
+	if len(labelNames) > 0 {
+		e.w.WriteByte('{')
+		for i, l := range labelNames {
+			if i > 0 {
+				e.w.WriteByte(',')
+			}
+			e.w.WriteString(l + `="` + escapeLabelValue(labelValues[i]) + `"`)
+		}
+		e.w.WriteByte('}')
+	}
+	e.w.WriteByte(' ')
+	e.w.WriteString(formatValue(value))
+	e.w.WriteByte('\n')
+}
+
+// single writes a family with one unlabeled sample
+func (e *expositionWriter) single(name, typ, help string, value float64) {
+	e.header(name, typ, help)
+	e.sample(name, nil, nil, value)
+}
+
+func (e *expositionWriter) flush() error {
+	return e.w.Flush()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+func escapeLabelValue(s string) string { return labelEscaper.Replace(s) }
+
+// ================= Label Cardinality =================
+
+// overflowLabel replaces label values beyond the per-label limit
+const overflowLabel = "other"
+
+// labelLimiter caps the number of distinct values seen per label name.
+// Values past the limit are reported as "other", so clients sending random
+// model names or paths can't grow the metrics without bound.
+type labelLimiter struct {
+	max      atomic.Int64
+	mu       sync.Mutex
+	values   map[string]map[string]struct{}
+	dropped  map[string]map[string]struct{} // Values already counted as overflow
+	overflow sync.Map                       // label name -> *atomic.Uint64
+}
+
+// maxDroppedValues bounds how many overflowed values are remembered per
+// label; past it every use of a new value counts again
+const maxDroppedValues = 10000
+
+var labelLimits = newLabelLimiter(100)
+
+func newLabelLimiter(max int) *labelLimiter {
+	l := &labelLimiter{values: make(map[string]map[string]struct{}), dropped: make(map[string]map[string]struct{})}
+	l.max.Store(int64(max))
+	return l
+}
+
+func (l *labelLimiter) setMax(max int) {
+	l.max.Store(int64(max))
+}
+
+// limit returns value, or "other" if the label already has too many values.
+// The empty value is always allowed.
+func (l *labelLimiter) limit(name, value string) string {
+	if value == "" {
+		return value
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen, ok := l.values[name]
+	if !ok {
+		seen = make(map[string]struct{})
+		l.values[name] = seen
+	}
+	if _, ok := seen[value]; ok {
+		return value
+	}
+	if int64(len(seen)) >= l.max.Load() {
+		l.drop(name, value)
+		return overflowLabel
+	}
+	seen[value] = struct{}{}
+	return value
+}
+
+// drop counts value as overflowed, once per distinct value. Callers hold mu.
+func (l *labelLimiter) drop(name, value string) {
+	dropped, ok := l.dropped[name]
+	if !ok {
+		dropped = make(map[string]struct{})
+		l.dropped[name] = dropped
+	}
+	if _, ok := dropped[value]; ok {
+		return
+	}
+	if len(dropped) < maxDroppedValues {
+		dropped[value] = struct{}{}
+	}
+	c, _ := l.overflow.LoadOrStore(name, new(atomic.Uint64))
+	c.(*atomic.Uint64).Add(1)
+}
+
+func (l *labelLimiter) write(e *expositionWriter) {
+	const name = "ant2oa_metrics_label_overflow_total"
+	e.header(name, "counter", "Distinct label values replaced by \"other\" because of the cardinality limit")
+	var names []string
+	l.overflow.Range(func(k, _ any) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	sort.Strings(names)
+	for _, n := range names {
+		c, _ := l.overflow.Load(n)
+		e.sample(name, []string{"label"}, []string{n}, float64(c.(*atomic.Uint64).Load()))
+	}
+}
+
+// ================= Labeled Vectors =================
+
+// metricVec maps label values to a series of type T
+type metricVec[T any] struct {
+	name   string
+	help   string
+	labels []string
+	newT   func() *T
+	series sync.Map // label values joined by "\xff" -> *seriesEntry[T]
+}
+
+type seriesEntry[T any] struct {
+	values []string
+	m      *T
+}
+
+// with returns the series for the given label values, applying the
+// cardinality limit to each value
+func (v *metricVec[T]) with(values []string) *T {
+	key := strings.Join(values, "\xff")
+	if e, ok := v.series.Load(key); ok {
+		return e.(*seriesEntry[T]).m
+	}
+
+	limited := make([]string, len(values))
+	for i, val := range values {
+		limited[i] = labelLimits.limit(v.labels[i], val)
+	}
+	e, _ := v.series.LoadOrStore(strings.Join(limited, "\xff"), &seriesEntry[T]{values: limited, m: v.newT()})
+	return e.(*seriesEntry[T]).m
+}
+
+// each visits all series in a stable order
+func (v *metricVec[T]) each(fn func(values []string, m *T)) {
+	var keys []string
+	v.series.Range(func(k, _ any) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, k := range keys {
+		e, _ := v.series.Load(k)
+		se := e.(*seriesEntry[T])
+		fn(se.values, se.m)
+	}
+}
+
+// counterVec is a labeled Prometheus counter
+type counterVec struct {
+	metricVec[floatCounter]
+}
+
+// floatCounter is a float64 that is updated atomically
+type floatCounter struct {
+	bits atomic.Uint64
+}
+
+func (c *floatCounter) add(v float64) {
+	for {
+		old := c.bits.Load()
+		if c.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (c *floatCounter) load() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+func newCounterVec(name, help string, labels []string) *counterVec {
+	return &counterVec{metricVec[floatCounter]{name: name, help: help, labels: labels, newT: func() *floatCounter { return new(floatCounter) }}}
+}
+
+func (v *counterVec) add(values []string, n float64) {
+	if n > 0 {
+		v.with(values).add(n)
+	}
+}
+
+func (v *counterVec) write(e *expositionWriter) {
+	e.header(v.name, "counter", v.help)
+	v.each(func(values []string, c *floatCounter) {
+		e.sample(v.name, v.labels, values, c.load())
+	})
+}
+
+// sumBy totals the counter grouped by one label
+func (v *counterVec) sumBy(label string) map[string]float64 {
+	idx := indexOf(v.labels, label)
+	out := make(map[string]float64)
+	v.each(func(values []string, c *floatCounter) {
+		out[values[idx]] += c.load()
+	})
+	return out
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// histogramVec is a labeled Prometheus histogram
+type histogramVec struct {
+	metricVec[histogram]
+	buckets []float64 // Upper bounds, ascending; +Inf is implicit
+}
+
+type histogram struct {
+	counts []atomic.Uint64 // One per bucket plus +Inf, not cumulative
+	count  atomic.Uint64
+	sum    floatCounter
+}
+
+func newHistogramVec(name, help string, labels []string, buckets []float64) *histogramVec {
+	v := &histogramVec{buckets: buckets}
+	v.metricVec = metricVec[histogram]{name: name, help: help, labels: labels, newT: func() *histogram {
+		return &histogram{counts: make([]atomic.Uint64, len(buckets)+1)}
+	}}
+	return v
+}
+
+func (v *histogramVec) observe(values []string, value float64) {
+	h := v.with(values)
+	h.counts[sort.SearchFloat64s(v.buckets, value)].Add(1)
+	h.count.Add(1)
+	h.sum.add(value)
+}
+
+func (v *histogramVec) write(e *expositionWriter) {
+	e.header(v.name, "histogram", v.help)
+	bucketLabels := append(append([]string(nil), v.labels...), "le")
+	v.each(func(values []string, h *histogram) {
+		bucketValues := append(append([]string(nil), values...), "")
+		var cum uint64
+		for i := range h.counts {
+			cum += h.counts[i].Load()
+			bucketValues[len(values)] = "+Inf"
+			if i < len(v.buckets) {
+				bucketValues[len(values)] = formatValue(v.buckets[i])
+			}
+			e.sample(v.name+"_bucket", bucketLabels, bucketValues, float64(cum))
+		}
+		e.sample(v.name+"_sum", v.labels, values, h.sum.load())
+		e.sample(v.name+"_count", v.labels, values, float64(h.count.Load()))
+	})
+}
+
+// quantile estimates the q-quantile over all series by linear
+// interpolation within buckets, like PromQL's histogram_quantile
+func (v *histogramVec) quantile(q float64) float64 {
+	counts := make([]uint64, len(v.buckets)+1)
+	var total uint64
+	v.each(func(_ []string, h *histogram) {
+		for i := range h.counts {
+			n := h.counts[i].Load()
+			counts[i] += n
+			total += n
+		}
+	})
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var cum uint64
+	for i, n := range counts {
+		if float64(cum+n) < rank || n == 0 {
+			cum += n
+			continue
+		}
+		if i == len(v.buckets) {
+			return v.buckets[len(v.buckets)-1] // Can't interpolate into +Inf
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = v.buckets[i-1]
+		}
+		return lower + (v.buckets[i]-lower)*(rank-float64(cum))/float64(n)
+	}
+	return v.buckets[len(v.buckets)-1]
+}
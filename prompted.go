@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Prompted Tools =================
+
+// Route tool modes. Prompted routes describe tools in the system prompt for
+// models without native function calling and parse calls out of the text.
+const (
+	toolsNative   = "native"
+	toolsPrompted = "prompted"
+)
+
+const (
+	toolCallOpen  = "<tool_call>"
+	toolCallClose = "</tool_call>"
+)
+
+// promptedToolsPrompt describes the tools and the calling convention. It
+// is empty if there are no tools or tool_choice is "none".
+func promptedToolsPrompt(tools []AnthropicTool, toolChoice any) string {
+	if len(tools) == 0 {
+		return ""
+	}
+	must := ""
+	switch tc := toolChoice.(type) {
+	case string:
+		if tc == "none" {
+			return ""
+		}
+		if tc == "any" {
+			must = "You must call at least one tool.\n"
+		}
+	case map[string]any:
+		switch tc["type"] {
+		case "none":
+			return ""
+		case "any":
+			must = "You must call at least one tool.\n"
+		case "tool":
+			must = fmt.Sprintf("You must call the %v tool.\n", tc["name"])
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("You can call the tools listed below. To call a tool, reply with a block like this:\n\n")
+	sb.WriteString(toolCallOpen + "\n{\"name\": \"tool_name\", \"arguments\": {\"param\": \"value\"}}\n" + toolCallClose + "\n\n")
+	sb.WriteString("Use one block per call; several blocks may follow each other. The arguments must be a JSON object matching the tool's parameters. ")
+	sb.WriteString("After your tool calls, stop and wait: the results come back in <tool_result> blocks.\n")
+	sb.WriteString(must)
+	sb.WriteString("\n<tools>\n")
+	for _, t := range tools {
+		b, _ := json.Marshal(struct {
+			Name        string          `json:"name"`
+			Description string          `json:"description,omitempty"`
+			Parameters  json.RawMessage `json:"parameters,omitempty"`
+		}{t.Name, t.Description, t.InputSchema})
+		sb.Write(b)
+		sb.WriteByte('\n')
+	}
+	sb.WriteString("</tools>")
+	return sb.String()
+}
+
+// promptedMessages rewrites OpenAI messages for a model without function
+// calling: the tool prompt joins the system message, assistant tool_calls
+// become <tool_call> blocks and tool messages <tool_result> user text.
+func promptedMessages(messages []map[string]any, toolPrompt string) []map[string]any {
+	out := make([]map[string]any, 0, len(messages)+1)
+	if toolPrompt != "" {
+		if len(messages) > 0 && messages[0]["role"] == "system" {
+			sys := contentText(messages[0]["content"])
+			messages = messages[1:]
+			toolPrompt = sys + "\n\n" + toolPrompt
+		}
+		out = append(out, map[string]any{"role": "system", "content": toolPrompt})
+	}
+
+	names := make(map[string]string) // Tool call ID -> name
+	for _, m := range messages {
+		switch m["role"] {
+		case "assistant":
+			calls, _ := m["tool_calls"].([]map[string]any)
+			if len(calls) == 0 {
+				out = append(out, m)
+				continue
+			}
+			var sb strings.Builder
+			if txt := contentText(m["content"]); txt != "" {
+				sb.WriteString(txt + "\n\n")
+			}
+			for _, c := range calls {
+				fn, _ := c["function"].(map[string]string)
+				id, _ := c["id"].(string)
+				names[id] = fn["name"]
+				args := fn["arguments"]
+				if args == "" {
+					args = "{}"
+				}
+				sb.WriteString(toolCallOpen + "\n{\"name\": ")
+				name, _ := json.Marshal(fn["name"])
+				sb.Write(name)
+				sb.WriteString(", \"arguments\": " + args + "}\n" + toolCallClose + "\n")
+			}
+			out = append(out, map[string]any{"role": "assistant", "content": strings.TrimSpace(sb.String())})
+		case "tool":
+			id, _ := m["tool_call_id"].(string)
+			content := contentText(m["content"])
+			text := fmt.Sprintf("<tool_result name=%q tool_call_id=%q>\n%s\n</tool_result>", names[id], id, content)
+			out = appendUserText(out, text)
+		case "user":
+			// Text after tool results joins their turn
+			if text, ok := m["content"].(string); ok {
+				out = appendUserText(out, text)
+			} else {
+				out = append(out, m)
+			}
+		default:
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// appendUserText adds text to the last message if it's from the user, so
+// tool results and what follows them make one turn
+func appendUserText(messages []map[string]any, text string) []map[string]any {
+	if n := len(messages); n > 0 && messages[n-1]["role"] == "user" {
+		last := messages[n-1]
+		switch c := last["content"].(type) {
+		case string:
+			last["content"] = c + "\n\n" + text
+			return messages
+		case []OAContentPart:
+			last["content"] = append(c, OAContentPart{Type: "text", Text: text})
+			return messages
+		}
+	}
+	return append(messages, map[string]any{"role": "user", "content": text})
+}
+
+// parsePromptedToolCall reads the JSON between <tool_call> tags
+func parsePromptedToolCall(s string) (name, args string, ok bool) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "```json")
+	s = strings.TrimPrefix(s, "```")
+	s = strings.TrimSpace(strings.TrimSuffix(s, "```"))
+	fixed, _ := repairJSON(s)
+
+	var call struct {
+		Name       string          `json:"name"`
+		Arguments  json.RawMessage `json:"arguments"`
+		Input      json.RawMessage `json:"input"`
+		Parameters json.RawMessage `json:"parameters"`
+	}
+	if json.Unmarshal([]byte(fixed), &call) != nil || call.Name == "" {
+		return "", "", false
+	}
+	raw := call.Arguments
+	if len(raw) == 0 {
+		raw = call.Input
+	}
+	if len(raw) == 0 {
+		raw = call.Parameters
+	}
+	// Some models send the arguments JSON-encoded as a string
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		raw = json.RawMessage(str)
+	}
+	args, _ = repairJSON(string(raw))
+	return call.Name, args, true
+}
+
+// splitPromptedToolCalls separates the <tool_call> blocks of a complete
+// response from its text. Blocks that don't parse are kept as text.
+func splitPromptedToolCalls(text string) (rest string, calls []OAToolCall) {
+	var sb strings.Builder
+	for {
+		start := strings.Index(text, toolCallOpen)
+		if start < 0 {
+			sb.WriteString(text)
+			break
+		}
+		body := text[start+len(toolCallOpen):]
+		end := strings.Index(body, toolCallClose)
+		after := ""
+		if end >= 0 {
+			body, after = body[:end], body[end+len(toolCallClose):]
+		}
+		if name, args, ok := parsePromptedToolCall(body); ok {
+			sb.WriteString(text[:start])
+			calls = append(calls, OAToolCall{ID: newToolUseID(), Type: "function", Function: OAFunction{Name: name, Arguments: args}})
+		} else {
+			sb.WriteString(text[:start+len(toolCallOpen)] + body)
+			if end >= 0 {
+				sb.WriteString(toolCallClose)
+			}
+		}
+		if end < 0 {
+			break
+		}
+		text = after
+	}
+	rest = sb.String()
+	if len(calls) > 0 {
+		rest = strings.TrimSpace(rest)
+	}
+	return rest, calls
+}
@@ -3,12 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/goccy/go-json"
@@ -20,16 +20,15 @@ var (
 	// Connection Pooling & Timeout
 	HttpClient = &http.Client{
 		Timeout: 10 * time.Minute,
-		Transport: &http.Transport{
+		Transport: &cassetteTransport{base: &http.Transport{
 			MaxIdleConns:        100,
 			MaxIdleConnsPerHost: 100,
 			IdleConnTimeout:     90 * time.Second,
-		},
+		}},
 	}
 
-	// Rate Limiting
-	limiter          chan struct{}
-	rateLimitEnabled bool
+	// Rate Limiting (swapped atomically on config reload)
+	globalLimiter atomic.Pointer[tokenBucket]
 
 	// Buffer Pool
 	bufferPool = sync.Pool{
@@ -39,13 +38,85 @@ var (
 	}
 )
 
+// tokenBucket is the global RPM limiter. Tokens are refilled by a goroutine
+// that exits when the bucket is replaced.
+type tokenBucket struct {
+	rpm    int
+	tokens chan struct{}
+	stop   chan struct{}
+}
+
+func newTokenBucket(rpm int) *tokenBucket {
+	burst := 5 // Default burst
+	if rpm < 5 {
+		burst = rpm
+	}
+	tb := &tokenBucket{
+		rpm:    rpm,
+		tokens: make(chan struct{}, burst),
+		stop:   make(chan struct{}),
+	}
+
+	// Initial fill
+	for i := 0; i < burst; i++ {
+		tb.tokens <- struct{}{}
+	}
+
+	interval := time.Minute / time.Duration(rpm)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case tb.tokens <- struct{}{}:
+				default:
+				}
+			case <-tb.stop:
+				return
+			}
+		}
+	}()
+	return tb
+}
+
+// setGlobalRateLimit replaces the global limiter. rpm <= 0 disables it.
+// An unchanged limit keeps the existing bucket and its tokens.
+func setGlobalRateLimit(rpm int) {
+	old := globalLimiter.Load()
+	if old != nil && old.rpm == rpm {
+		return
+	}
+	var tb *tokenBucket
+	if rpm > 0 {
+		tb = newTokenBucket(rpm)
+	}
+	globalLimiter.Store(tb)
+	if old != nil {
+		close(old.stop)
+	}
+	if rpm > 0 {
+		configLogger.Info("rate limit enabled", "rpm", rpm)
+	} else if old != nil {
+		configLogger.Info("rate limit disabled")
+	}
+}
+
+func rateLimitEnabled() bool {
+	return globalLimiter.Load() != nil
+}
+
 func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaReqMap map[string]any, stream bool) {
 	// Rate Limit Check
-	if rateLimitEnabled && limiter != nil {
+	if tb := globalLimiter.Load(); tb != nil {
+		_, span := startSpan(r.Context(), "rate_limit.wait", spanKindInternal)
 		select {
-		case <-limiter:
-			// Go ahead
+		case <-tb.tokens:
+			span.finish()
 		case <-r.Context().Done():
+			span.setError("client disconnected")
+			span.finish()
 			http.Error(w, "client disconnected waiting for rate limit", 499)
 			return
 		}
@@ -64,40 +135,75 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 	}
 	apiURL += "/chat/completions"
 
+	// Ask for a final usage chunk so streamed token counts are known
+	if stream {
+		oaReqMap["stream_options"] = map[string]any{"include_usage": true}
+	}
+
 	// Use buffer pool for JSON marshaling
 	byteBuf := bufferPool.Get().(*bytes.Buffer)
 	byteBuf.Reset()
 	defer bufferPool.Put(byteBuf)
 
+	logger := requestLogger(r.Context(), proxyLogger)
 	if err := json.NewEncoder(byteBuf).Encode(oaReqMap); err != nil {
-		log.Printf("Request Marshal Error: %v", err)
+		logger.Error("request marshal failed", "error", err)
 		http.Error(w, "error processing request", 500)
 		return
 	}
 
 	var resp *http.Response
 	maxRetries := 3
+	st := statsFrom(r.Context())
+	st.Capture.openAIRequest(byteBuf.Bytes())
 
 	for i := 0; i <= maxRetries; i++ {
-		or, err := http.NewRequestWithContext(r.Context(), "POST", apiURL, bytes.NewReader(byteBuf.Bytes()))
+		var connStart time.Time
+		trace := &httptrace.ClientTrace{
+			GetConn: func(string) { connStart = time.Now() },
+			GotConn: func(httptrace.GotConnInfo) { st.UpstreamConnect = time.Since(connStart) },
+		}
+		ctx, span := startSpan(r.Context(), "upstream.attempt", spanKindClient)
+		span.setAttr("http.request.method", "POST")
+		span.setAttr("url.full", apiURL)
+		span.setAttr("server.address", st.Upstream)
+		span.setAttr("http.request.resend_count", i)
+		ctx = httptrace.WithClientTrace(ctx, trace)
+		or, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(byteBuf.Bytes()))
 		if err != nil {
+			span.finish()
 			http.Error(w, err.Error(), 500)
 			return
 		}
 		or.Header.Set("Authorization", auth)
 		or.Header.Set("Content-Type", "application/json")
+		injectTraceparent(ctx, or.Header)
+
+		or.Header.Set("X-Request-Id", st.RequestID)
 
+		logger.Debug("upstream request", "url", apiURL, "model", st.Model, "stream", stream, "attempt", i+1, "bytes", byteBuf.Len())
+		st.UpstreamStart = time.Now()
 		resp, err = HttpClient.Do(or)
 		if err != nil {
-			log.Printf("Upstream Request Error (Auth: %s): %v", MaskKey(auth), err)
+			span.setError(err.Error())
+		} else {
+			span.setAttr("http.response.status_code", resp.StatusCode)
+			if resp.StatusCode >= 400 {
+				span.setError(resp.Status)
+			}
+		}
+		span.finish()
+		if err != nil {
+			logger.Warn("upstream request failed", "url", apiURL, "attempt", i+1, "auth", MaskKey(auth), "error", err)
 			metrics.UpstreamErrors.Add(1)
 			if i >= maxRetries {
 				http.Error(w, err.Error(), 502)
 				return
 			}
 			waitTime := time.Duration(1<<i) * time.Second
-			log.Printf("Upstream error. Retrying in %v...", waitTime)
+			logger.Info("retrying upstream request", "wait", waitTime.String())
 			metrics.UpstreamRetries.Add(1)
+			st.Retries++
 			select {
 			case <-time.After(waitTime):
 				continue
@@ -107,6 +213,7 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 			}
 		}
 
+		logger.Debug("upstream response", "status", resp.StatusCode, "attempt", i+1, "duration_ms", time.Since(st.UpstreamStart).Milliseconds())
 		if resp.StatusCode != 429 && resp.StatusCode < 500 {
 			break
 		}
@@ -116,8 +223,9 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 
 		if i < maxRetries {
 			waitTime := time.Duration(1<<i) * time.Second
-			log.Printf("Upstream %d. Retrying in %v...", resp.StatusCode, waitTime)
+			logger.Warn("retrying upstream request", "status", resp.StatusCode, "wait", waitTime.String())
 			metrics.UpstreamRetries.Add(1)
+			st.Retries++
 			select {
 			case <-time.After(waitTime):
 				continue
@@ -128,14 +236,16 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 		}
 	}
 	defer resp.Body.Close()
+	st.Capture.upstreamResponse(resp, stream)
 
 	if resp.StatusCode != 200 {
 		if resp.StatusCode >= 500 {
 			metrics.UpstreamErrors.Add(1)
 		}
+		logger.Warn("upstream returned error", "status", resp.StatusCode, "retries", st.Retries)
 		rb, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("Error reading error response body: %v", err)
+			logger.Error("reading upstream error body failed", "error", err)
 		}
 		if ctype := resp.Header.Get("Content-Type"); ctype != "" {
 			w.Header().Set("Content-Type", ctype)
@@ -144,7 +254,7 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 		}
 		w.WriteHeader(resp.StatusCode)
 		if _, err := w.Write(rb); err != nil {
-			log.Printf("Error writing error response: %v", err)
+			logger.Warn("writing error response failed", "error", err)
 		}
 		return
 	}
@@ -153,10 +263,12 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 		w.Header().Set("Content-Type", "application/json")
 		var oaResp OAChatResp
 		if err := json.NewDecoder(resp.Body).Decode(&oaResp); err != nil {
+			logger.Error("upstream response decode failed", "error", err)
 			http.Error(w, "upstream decode error", 502)
 			return
 		}
 		if len(oaResp.Choices) == 0 {
+			logger.Warn("upstream response has no choices")
 			http.Error(w, "empty choices", 502)
 			return
 		}
@@ -174,19 +286,33 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 
 		// 2. Text Content (Parse <think>)
 		rawContent := choice.Message.Content
+		toolCalls := choice.Message.ToolCalls
+		if st.PromptedTools {
+			var calls []OAToolCall
+			rawContent, calls = splitPromptedToolCalls(rawContent)
+			toolCalls = append(toolCalls, calls...)
+		}
 		parsedBlocks := parseContentWithThinkTags(rawContent) // Helper below
+		for _, b := range parsedBlocks {
+			// Only the first text continues the prefill
+			if b["type"] == "text" && st.Prefill != "" {
+				b["text"] = cutPrefillEcho(b["text"].(string), st.Prefill)
+				break
+			}
+		}
 		blocks = append(blocks, parsedBlocks...)
 
 		// 3. Tool Calls
-		for _, tc := range choice.Message.ToolCalls {
-			args := "{}"
-			if tc.Function.Arguments != "" {
-				args = tc.Function.Arguments
+		for _, tc := range toolCalls {
+			args, ok := repairJSON(tc.Function.Arguments)
+			if !ok {
+				logger.Warn("tool call arguments are not valid JSON", "name", tc.Function.Name, "arguments", args)
+				args = "{}"
 			}
 			blocks = append(blocks, map[string]any{
 				"type":  "tool_use",
-				"id":    tc.ID,
-				"name":  tc.Function.Name,
+				"id":    st.ToolNames.clientID(tc.ID),
+				"name":  st.ToolNames.clientName(tc.Function.Name),
 				"input": json.RawMessage(args),
 			})
 		}
@@ -195,10 +321,7 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 			blocks = append(blocks, map[string]any{"type": "text", "text": ""})
 		}
 
-		stopReason := "end_turn"
-		if choice.FinishReason == "tool_calls" {
-			stopReason = "tool_use"
-		}
+		st.setUsage(&oaResp.Usage)
 
 		anthResp := map[string]any{
 			"id":            "msg_" + oaResp.ID,
@@ -206,12 +329,9 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 			"role":          "assistant",
 			"model":         oaResp.Model,
 			"content":       blocks,
-			"stop_reason":   stopReason,
+			"stop_reason":   anthropicStopReason(choice.FinishReason, len(toolCalls) > 0),
 			"stop_sequence": nil,
-			"usage": map[string]any{
-				"input_tokens":  oaResp.Usage.PromptTokens,
-				"output_tokens": oaResp.Usage.CompletionTokens,
-			},
+			"usage":         st.anthropicUsage(),
 		}
 		json.NewEncoder(w).Encode(anthResp)
 		return
@@ -227,84 +347,120 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 		return
 	}
 	reader := bufio.NewReader(resp.Body)
-
-	startedMessage := false
+	_, streamSpan := startSpan(r.Context(), "stream", spanKindInternal)
+	defer func() {
+		streamSpan.setAttr("gen_ai.usage.output_tokens", st.OutputTokens)
+		streamSpan.finish()
+		logger.Debug("stream finished", "output_tokens", st.OutputTokens)
+	}()
+
+	enc := newSSEEncoder(w, flusher, st, logger)
 	lastUsage := map[string]int{"input": 0, "output": 0}
 
 	// FSM State
-	currentBlockType := "" // "thinking", "text", "tool_use"
+	currentBlockType := "" // "thinking" or "text"; tool_use blocks belong to tools
 	currentBlockIdx := -1
+	inThinkTag := false // Thinking block opened by a <think> tag in the content
 	hasToolUse := false // 跟踪是否有tool_use
+	finishReason := ""
 
 	// Buffers
 	contentBuffer := "" // for text <think> parsing
 
-	// Tool State
-	currentToolIndex := -1
+	tools := newToolCallStream(enc, st.ToolNames)
+	stitch := newPrefillStitcher(st.Prefill)
+
+	// Tool calls end when another block starts
+	openBlock := func(block contentBlock) {
+		tools.flush()
+		currentBlockIdx = enc.blockStart(block)
+		currentBlockType = block.Type
+	}
 
 	emitDelta := func(text string) {
+		if currentBlockType != "thinking" {
+			text = stitch.feed(text)
+		}
 		if text == "" {
 			return
 		}
 		if currentBlockType == "" {
-			currentBlockIdx++
-			currentBlockType = "text"
-			w.Write([]byte(fmt.Sprintf("event: content_block_start\ndata: {\"type\": \"content_block_start\", \"index\": %d, \"content_block\": {\"type\": \"text\", \"text\": \"\"}}\n\n", currentBlockIdx)))
+			// Whitespace between tool calls isn't worth a text block
+			if hasToolUse && strings.TrimSpace(text) == "" {
+				return
+			}
+			openBlock(textBlock())
 		}
 
 		switch currentBlockType {
 		case "thinking":
-			evt, _ := json.Marshal(map[string]any{
-				"type":  "content_block_delta",
-				"index": currentBlockIdx,
-				"delta": map[string]string{"type": "thinking_delta", "thinking": text},
-			})
-			w.Write([]byte("event: content_block_delta\ndata: " + string(evt) + "\n\n"))
+			enc.blockDelta(currentBlockIdx, thinkingDelta(text))
 		case "text":
-			evt, _ := json.Marshal(map[string]any{
-				"type":  "content_block_delta",
-				"index": currentBlockIdx,
-				"delta": map[string]string{"type": "text_delta", "text": text},
-			})
-			w.Write([]byte("event: content_block_delta\ndata: " + string(evt) + "\n\n"))
+			enc.blockDelta(currentBlockIdx, textDelta(text))
 		}
 	}
 
 	closeBlock := func() {
-		if currentBlockIdx >= 0 {
-			w.Write([]byte(fmt.Sprintf("event: content_block_stop\ndata: {\"type\": \"content_block_stop\", \"index\": %d}\n\n", currentBlockIdx)))
+		if currentBlockType != "" {
+			enc.blockStop(currentBlockIdx)
 		}
 		currentBlockType = ""
+		inThinkTag = false
+	}
+
+	// A complete <tool_call> block from a prompted tools route
+	promptedCalls := 0
+	emitPromptedCall := func(body string) {
+		name, args, ok := parsePromptedToolCall(body)
+		if !ok {
+			logger.Debug("unparsable prompted tool call kept as text", "body", body)
+			emitDelta(toolCallOpen + body + toolCallClose)
+			return
+		}
+		closeBlock()
+		hasToolUse = true
+		tools.add(OAToolCall{Index: promptedCalls, Function: OAFunction{Name: name, Arguments: args}})
+		tools.flush()
+		promptedCalls++
 	}
 
+	// flushContent emits what's left of the content buffer
+	flushContent := func() {
+		if held := stitch.flush(); held != "" {
+			emitDelta(held)
+		}
+		if st.PromptedTools && strings.HasPrefix(contentBuffer, toolCallOpen) {
+			// Cut off before </tool_call>
+			emitPromptedCall(strings.TrimPrefix(contentBuffer, toolCallOpen))
+		} else if contentBuffer != "" {
+			emitDelta(contentBuffer)
+		}
+		contentBuffer = ""
+	}
+
+	stopReason := func() string {
+		return anthropicStopReason(finishReason, hasToolUse)
+	}
+
+	var readErr error
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
+			readErr = err
 			break
 		}
 		line = strings.TrimSpace(line)
-		if !strings.HasPrefix(line, "data: ") {
+		if !strings.HasPrefix(line, "data:") {
 			continue
 		}
-		data := strings.TrimPrefix(line, "data: ")
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
 		if data == "[DONE]" {
 			// 处理contentBuffer中的残留数据
-			if contentBuffer != "" {
-				emitDelta(contentBuffer)
-				contentBuffer = ""
-			}
+			flushContent()
 			closeBlock()
-			// 根据是否有tool_use来决定stop_reason
-			stopReason := "end_turn"
-			if hasToolUse {
-				stopReason = "tool_use"
-			}
-			usageJson, _ := json.Marshal(map[string]any{
-				"output_tokens": lastUsage["output"],
-			})
-			w.Write([]byte(fmt.Sprintf("event: message_delta\ndata: {\"type\": \"message_delta\", \"delta\": {\"stop_reason\": \"%s\", \"stop_sequence\": null}, \"usage\": %s}\n\n", stopReason, string(usageJson))))
-			w.Write([]byte("event: message_stop\ndata: {\"type\": \"message_stop\"}\n\n"))
-			flusher.Flush()
+			tools.flush()
+			enc.messageDelta(stopReason(), lastUsage["output"])
+			enc.messageStop()
 			return
 		}
 
@@ -313,25 +469,33 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 			continue
 		}
 
+		if chunk.Error != nil {
+			logger.Warn("upstream error in stream", "type", chunk.Error.Type, "message", chunk.Error.Message)
+			metrics.UpstreamErrors.Add(1)
+			enc.error(anthropicErrorType(chunk.Error.Type, chunk.Error.Message), chunk.Error.Message)
+			return
+		}
+
 		if chunk.Usage != nil {
-			lastUsage["input"] = chunk.Usage.PromptTokens
+			st.setUsage(chunk.Usage)
+			lastUsage["input"] = st.anthropicUsage().InputTokens
 			lastUsage["output"] = chunk.Usage.CompletionTokens
 		}
 
 		if len(chunk.Choices) == 0 {
 			continue
 		}
-
-		if !startedMessage {
-			usageJson, _ := json.Marshal(map[string]any{
-				"input_tokens":  lastUsage["input"],
-				"output_tokens": lastUsage["output"],
-			})
-			w.Write([]byte("event: message_start\ndata: {\"type\": \"message_start\", \"message\": {\"id\": \"msg_proxy\", \"type\": \"message\", \"role\": \"assistant\", \"content\": [], \"model\": \"proxy\", \"stop_reason\": null, \"stop_sequence\": null, \"usage\": " + string(usageJson) + "}}\n\n"))
-			startedMessage = true
+		if fr := chunk.Choices[0].FinishReason; fr != "" {
+			finishReason = fr
 		}
 
+		enc.messageStart(lastUsage["input"], lastUsage["output"])
+
 		delta := chunk.Choices[0].Delta
+		if st.FirstToken.IsZero() && (delta.Content != "" || delta.ReasoningContent != "" || delta.Reasoning != "" || len(delta.ToolCalls) > 0) {
+			st.FirstToken = time.Now()
+			streamSpan.addEvent("first_token")
+		}
 
 		// 1. Handle Reasoning (deepseek style or reasoning_content)
 		rContent := delta.ReasoningContent
@@ -341,17 +505,16 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 		if rContent != "" {
 			if currentBlockType != "thinking" {
 				closeBlock()
-				currentBlockIdx++
-				currentBlockType = "thinking"
-				w.Write([]byte(fmt.Sprintf("event: content_block_start\ndata: {\"type\": \"content_block_start\", \"index\": %d, \"content_block\": {\"type\": \"thinking\", \"thinking\": \"\"}}\n\n", currentBlockIdx)))
+				openBlock(thinkingBlock())
 			}
 			emitDelta(rContent)
 		}
 
 		// 2. Handle Text (parsed for <think>)
 		if delta.Content != "" {
-			// If we were in tool mode, close it
-			if currentBlockType == "tool_use" {
+			// Content ends a tool call, and reasoning_content thinking; only a
+			// <think> tag keeps content in a thinking block
+			if currentBlockType == "thinking" && !inThinkTag {
 				closeBlock()
 			}
 
@@ -361,6 +524,27 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 				startTag := strings.Index(contentBuffer, "<think>")
 				endTag := strings.Index(contentBuffer, "</think>")
 
+				// Prompted tool calls, outside thinking
+				callTag := -1
+				if st.PromptedTools && currentBlockType != "thinking" {
+					callTag = strings.Index(contentBuffer, toolCallOpen)
+				}
+				if callTag != -1 && (startTag == -1 || callTag < startTag) && (endTag == -1 || callTag < endTag) {
+					if pre := contentBuffer[:callTag]; pre != "" {
+						emitDelta(pre)
+					}
+					body := contentBuffer[callTag+len(toolCallOpen):]
+					end := strings.Index(body, toolCallClose)
+					if end == -1 {
+						// Wait for the rest of the call
+						contentBuffer = contentBuffer[callTag:]
+						break
+					}
+					emitPromptedCall(body[:end])
+					contentBuffer = body[end+len(toolCallClose):]
+					continue
+				}
+
 				if startTag == -1 && endTag == -1 {
 					// Safe partial check
 					cutoff := len(contentBuffer)
@@ -410,20 +594,16 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 						closeBlock()
 					}
 					if currentBlockType != "thinking" {
-						currentBlockIdx++
-						currentBlockType = "thinking"
-						w.Write([]byte(fmt.Sprintf("event: content_block_start\ndata: {\"type\": \"content_block_start\", \"index\": %d, \"content_block\": {\"type\": \"thinking\", \"thinking\": \"\"}}\n\n", currentBlockIdx)))
+						openBlock(thinkingBlock())
 					}
+					inThinkTag = true
 					contentBuffer = contentBuffer[tagIdx+7:]
 				} else {
 					// </think>
 					if currentBlockType == "thinking" {
 						closeBlock()
 					}
-					if currentBlockType != "text" {
-						// Don't auto open text unless content follows?
-						// Actually emitDelta will open text if needed.
-					}
+					// emitDelta opens a text block once content follows
 					contentBuffer = contentBuffer[tagIdx+8:]
 				}
 			}
@@ -431,57 +611,57 @@ func forwardOAMap(w http.ResponseWriter, r *http.Request, base, auth string, oaR
 
 		// 3. Handle Tool Calls
 		if len(delta.ToolCalls) > 0 {
-			if currentBlockType == "text" || currentBlockType == "thinking" {
-				closeBlock()
-			}
+			// Text held back for tag parsing came before the calls
+			flushContent()
+			closeBlock()
 
+			hasToolUse = true // 标记有tool_use
 			for _, tc := range delta.ToolCalls {
-				// Check if new tool call started (index changed or ID present)
-				if tc.Index != currentToolIndex || tc.ID != "" {
-					if currentBlockType == "tool_use" && tc.Index != currentToolIndex {
-						closeBlock()
-					}
-
-					if tc.ID != "" {
-						currentToolIndex = tc.Index
-						hasToolUse = true // 标记有tool_use
-						// Start new tool_use block
-						currentBlockIdx++
-						currentBlockType = "tool_use"
-
-						startJson, _ := json.Marshal(map[string]any{
-							"type":  "content_block_start",
-							"index": currentBlockIdx,
-							"content_block": map[string]string{
-								"type": "tool_use",
-								"id":   tc.ID,
-								"name": tc.Function.Name,
-							},
-						})
-						w.Write([]byte("event: content_block_start\ndata: " + string(startJson) + "\n\n"))
-					}
-				}
-
-				// Streaming arguments
-				if tc.Function.Arguments != "" {
-					// Ensure we are in tool_use block (sometimes ID comes first, args later)
-					if currentBlockType != "tool_use" {
-						// If it happens (packet split weirdly), we rely on previous state.
-					}
-
-					deltaJson, _ := json.Marshal(map[string]any{
-						"type":  "content_block_delta",
-						"index": currentBlockIdx,
-						"delta": map[string]string{
-							"type":         "input_json_delta",
-							"partial_json": tc.Function.Arguments,
-						},
-					})
-					w.Write([]byte("event: content_block_delta\ndata: " + string(deltaJson) + "\n\n"))
-				}
+				tools.add(tc)
 			}
 		}
 
 		flusher.Flush()
 	}
+
+	// The upstream stopped without [DONE]
+	if r.Context().Err() != nil {
+		return
+	}
+	if readErr == io.EOF {
+		flushContent()
+		closeBlock()
+		tools.flush()
+		logger.Warn("upstream stream ended without [DONE]")
+	} else {
+		logger.Warn("upstream stream failed", "error", readErr)
+		metrics.UpstreamErrors.Add(1)
+	}
+	enc.finish(readErr, stopReason(), lastUsage["output"])
+}
+
+// anthropicStopReason maps an OpenAI finish_reason to Anthropic's
+// stop_reason. Tool calls win whatever the reason says.
+func anthropicStopReason(finishReason string, toolUse bool) string {
+	switch {
+	case toolUse || finishReason == "tool_calls":
+		return "tool_use"
+	case finishReason == "length":
+		return "max_tokens"
+	}
+	return "end_turn"
+}
+
+// anthropicErrorType maps an upstream error to an Anthropic error type
+func anthropicErrorType(upstreamType, msg string) string {
+	s := strings.ToLower(upstreamType + " " + msg)
+	switch {
+	case strings.Contains(s, "overload"):
+		return "overloaded_error"
+	case strings.Contains(s, "rate_limit") || strings.Contains(s, "rate limit"):
+		return "rate_limit_error"
+	case strings.Contains(s, "invalid_request"):
+		return "invalid_request_error"
+	}
+	return "api_error"
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// ================= Runtime Settings & Hot Reload =================
+
+// Settings holds the values that can change while the server is running.
+// A new Settings is built on every reload and swapped in atomically, so
+// handlers always see a consistent snapshot.
+type Settings struct {
+	Listeners      []ListenerConfig
+	BaseURL        string
+	Model          string
+	AuthKey        string // Upstream key; empty = forward the client's key
+	RateLimit      int    // Global RPM, 0 = unlimited
+	MaxRequestSize int64
+	AdminPassword  string
+	MetricsEnabled bool
+	MaxLabelValues int // Cardinality limit per metric label
+	Log            LogConfig
+	UsageLog       UsageLogConfig
+	Prices         map[string]Price // Upstream model -> price
+	Tracing        TracingConfig
+	Capture        CaptureConfig
+	Cassette       CassetteConfig
+}
+
+// ReloadStatus describes the outcome of the most recent reload attempt
+type ReloadStatus struct {
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"` // "startup", "sighup", "watch", "api"
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var (
+	settings   atomic.Pointer[Settings]
+	lastReload atomic.Pointer[ReloadStatus]
+	reloadMu   sync.Mutex
+	activeEnv  atomic.Pointer[envFile] // Env file of the running config
+)
+
+// currentSettings returns the active settings snapshot
+func currentSettings() *Settings {
+	if s := settings.Load(); s != nil {
+		return s
+	}
+	return &Settings{}
+}
+
+// envFile holds the variables of the env file. They are not put in the
+// process environment, so a reload that fails leaves nothing behind.
+type envFile map[string]string
+
+// readEnvFile parses the env file; a missing file is empty
+func readEnvFile() (envFile, error) {
+	path := configEnvPath()
+	values, err := godotenv.Read(path)
+	if os.IsNotExist(err) {
+		return envFile{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// lookup finds a variable, the real process environment winning over the file
+func (e envFile) lookup(key string) (string, bool) {
+	if v, ok := os.LookupEnv(key); ok {
+		return v, true
+	}
+	v, ok := e[key]
+	return v, ok
+}
+
+func (e envFile) get(key string) string {
+	v, _ := e.lookup(key)
+	return v
+}
+
+// currentEnv returns the env file of the running configuration
+func currentEnv() envFile {
+	if e := activeEnv.Load(); e != nil {
+		return *e
+	}
+	return nil
+}
+
+// reloadConfig re-reads ant2oa.yaml, the env file, keys.json and routes.json. Everything is
+// parsed and validated, and certificates and the log file are opened,
+// before anything is applied. On error the running configuration is left
+// untouched.
+func reloadConfig(trigger string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	err := func() error {
+		env, err := readEnvFile()
+		if err != nil {
+			return err
+		}
+		cfg, err := loadConfig(env)
+		if err != nil {
+			return err
+		}
+		useTLS, err := loadTLS()
+		if err != nil {
+			return err
+		}
+		logs, err := newLogging(cfg.Settings.Log)
+		if err != nil {
+			return fmt.Errorf("logging.file: %w", err)
+		}
+
+		// All of it is good: switch over
+		activeEnv.Store(&env)
+		useTLS()
+		useLogging(logs)
+		setAPIKeys(cfg.Keys)
+		setModelRoutes(cfg.Routes)
+		setGlobalRateLimit(cfg.Settings.RateLimit)
+		labelLimits.setMax(cfg.Settings.MaxLabelValues)
+		configureTracing(cfg.Settings.Tracing)
+		usage.configure(cfg.Settings.UsageLog)
+		settings.Store(cfg.Settings)
+		return nil
+	}()
+
+	status := &ReloadStatus{Time: time.Now(), Trigger: trigger, OK: err == nil}
+	if err != nil {
+		status.Error = err.Error()
+		configLogger.Error("config reload failed, keeping previous config", "trigger", trigger, "error", err)
+	} else {
+		s := currentSettings()
+		configLogger.Info("config reloaded", "trigger", trigger, "upstream", s.BaseURL, "model", s.Model, "rate_limit", s.RateLimit)
+	}
+	lastReload.Store(status)
+	return err
+}
+
+// watchConfig reloads on SIGHUP and whenever one of the config files changes.
+// Changes are detected by polling modification time and size.
+func watchConfig(interval time.Duration, done <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var ticker <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		ticker = t.C
+	}
+
+	last := configFingerprint()
+	for {
+		select {
+		case <-hup:
+			reloadConfig("sighup")
+			last = configFingerprint()
+		case <-ticker:
+			if fp := configFingerprint(); fp != last {
+				last = fp
+				reloadConfig("watch")
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// configFingerprint summarizes the state of all watched files
+func configFingerprint() string {
+	var sb strings.Builder
+	for _, path := range []string{configFilePath(), configEnvPath(), "keys.json", "routes.json"} {
+		if fi, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&sb, "%s:%d:%d;", path, fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			fmt.Fprintf(&sb, "%s:-;", path)
+		}
+	}
+	return sb.String()
+}
+
+// reloadInterval returns the polling interval from CONFIG_WATCH_INTERVAL (default 5s, 0 disables)
+func reloadInterval() time.Duration {
+	v := currentEnv().get("CONFIG_WATCH_INTERVAL")
+	if v == "" {
+		return 5 * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		configLogger.Warn("invalid CONFIG_WATCH_INTERVAL, using 5s", "value", v)
+		return 5 * time.Second
+	}
+	return d
+}
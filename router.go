@@ -9,9 +9,28 @@ import (
 )
 
 type RouteConfig struct {
-	Pattern  string `json:"pattern"`            // Regex pattern for model name
-	Upstream string `json:"upstream"`           // Base URL
-	AuthKey  string `json:"auth_key,omitempty"` // Optional override auth key for this upstream
+	Pattern         string  `json:"pattern" yaml:"pattern"`                               // Regex pattern for model name
+	Provider        string  `json:"provider,omitempty" yaml:"provider"`                   // Named provider from ant2oa.yaml
+	Upstream        string  `json:"upstream" yaml:"upstream"`                             // Base URL
+	AuthKey         string  `json:"auth_key,omitempty" yaml:"auth_key"`                   // Optional override auth key for this upstream
+	Model           string  `json:"model,omitempty" yaml:"model"`                         // Upstream model name; may reference pattern groups ($1)
+	AuthKeyFile     string  `json:"auth_key_file,omitempty" yaml:"auth_key_file"`         // Read AuthKey from this file
+	Price           *Price  `json:"price,omitempty" yaml:"price"`                         // Overrides the model price table
+	Capture         bool    `json:"capture,omitempty" yaml:"capture"`                     // Record every request for debugging
+	Tools           string  `json:"tools,omitempty" yaml:"tools"`                         // "native" (default) or "prompted" for models without function calling
+	Schema          string  `json:"schema,omitempty" yaml:"schema"`                       // Tool schema profile: "raw" (default), "strict" or "gemini"
+	ToolIDs         string  `json:"tool_ids,omitempty" yaml:"tool_ids"`                   // "mistral" rewrites tool call IDs to 9 alphanumeric characters
+	Documents       string  `json:"documents,omitempty" yaml:"documents"`                 // "text" (default) extracts PDF text, "file" sends PDFs as file parts
+	Images          string  `json:"images,omitempty" yaml:"images"`                       // "url" (default) passes image URLs on, "fetch" inlines them, "none" drops images
+	ImageMaxSide    int     `json:"image_max_side,omitempty" yaml:"image_max_side"`       // Downscale images whose longest side is larger
+	ImageMaxBytes   int     `json:"image_max_bytes,omitempty" yaml:"image_max_bytes"`     // Re-encode images larger than this
+	ToolErrorPrefix *string `json:"tool_error_prefix,omitempty" yaml:"tool_error_prefix"` // Prepended to failed tool results, "Error: " if unset
+	ToolErrorField  string  `json:"tool_error_field,omitempty" yaml:"tool_error_field"`   // Also set this field to true on their tool messages
+	Messages        string  `json:"messages,omitempty" yaml:"messages"`                   // "strict" merges and orders messages for strict chat templates
+	Prefill         string  `json:"prefill,omitempty" yaml:"prefill"`                     // How a trailing assistant turn is continued: "prefix", "continue" or "emulate"
+	PromptCache     string  `json:"prompt_cache,omitempty" yaml:"prompt_cache"`           // cache_control breakpoints: dropped (default), "cache_control" or "key"
+
+	re *regexp.Regexp
 }
 
 var (
@@ -19,34 +38,58 @@ var (
 	routesMutex sync.RWMutex
 )
 
-func loadModelRoutes() error {
+// readModelRoutes parses routes.json without validating or applying it
+func readModelRoutes() ([]RouteConfig, error) {
 	data, err := os.ReadFile("routes.json")
 	if os.IsNotExist(err) {
-		return nil
+		return nil, nil
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var routes []RouteConfig
 	if err := json.Unmarshal(data, &routes); err != nil {
-		return err
+		return nil, err
 	}
+	return routes, nil
+}
 
+func setModelRoutes(routes []RouteConfig) {
 	routesMutex.Lock()
 	modelRoutes = routes
 	routesMutex.Unlock()
-	return nil
 }
 
-func getUpstreamForModel(model string, defaultBase string) (string, string) {
+// ResolvedRoute is the result of routing a requested model name
+type ResolvedRoute struct {
+	Index    int          // Index in the route list, -1 for the default upstream
+	Route    *RouteConfig // nil for the default upstream
+	Upstream string
+	AuthKey  string
+	Model    string // Model name sent upstream
+}
+
+// resolveRoute finds the first route matching model, falling back to the
+// default upstream in s.
+func resolveRoute(model string, s *Settings) ResolvedRoute {
 	routesMutex.RLock()
 	defer routesMutex.RUnlock()
 
-	for _, route := range modelRoutes {
-		if matched, _ := regexp.MatchString(route.Pattern, model); matched {
-			return route.Upstream, route.AuthKey
+	for i := range modelRoutes {
+		route := &modelRoutes[i]
+		m := route.re.FindStringSubmatchIndex(model)
+		if m == nil {
+			continue
+		}
+		res := ResolvedRoute{Index: i, Route: route, Upstream: route.Upstream, AuthKey: route.AuthKey, Model: model}
+		if res.AuthKey == "" && route.Upstream == s.BaseURL {
+			res.AuthKey = s.AuthKey
+		}
+		if route.Model != "" {
+			res.Model = string(route.re.ExpandString(nil, route.Model, model, m))
 		}
+		return res
 	}
-	return defaultBase, ""
+	return ResolvedRoute{Index: -1, Upstream: s.BaseURL, AuthKey: s.AuthKey, Model: model}
 }
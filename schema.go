@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Tool Schema Sanitization =================
+
+// schemaProfile is the JSON Schema subset a kind of upstream accepts for
+// tool parameters, set per route with "schema"
+type schemaProfile struct {
+	keywords map[string]bool // Kept; others are dropped
+	formats  map[string]bool // String formats kept
+	// Gemini: unions and type arrays become one schema with "nullable",
+	// const becomes enum, additionalProperties goes
+	flatten  bool
+	nameRule *regexp.Regexp
+}
+
+var schemaProfiles = map[string]*schemaProfile{
+	// vLLM guided decoding, Mistral and other strict validators
+	"strict": {
+		keywords: setOf("type", "description", "title", "properties", "required", "items", "enum", "const",
+			"anyOf", "default", "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf",
+			"minLength", "maxLength", "pattern", "format", "minItems", "maxItems", "uniqueItems",
+			"additionalProperties", "minProperties", "maxProperties", "nullable"),
+		formats:  setOf("date-time", "date", "time", "duration", "email", "hostname", "ipv4", "ipv6", "uuid"),
+		nameRule: regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`),
+	},
+	// Gemini's OpenAPI 3.0 subset
+	"gemini": {
+		keywords: setOf("type", "format", "description", "nullable", "enum", "items", "properties", "required",
+			"minItems", "maxItems", "minimum", "maximum", "minLength", "maxLength"),
+		formats:  setOf("enum", "date-time"),
+		flatten:  true,
+		nameRule: regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.:-]{0,63}$`),
+	},
+}
+
+// Metadata keywords dropped without counting as a loss
+var schemaMetadata = setOf("$schema", "$id", "$comment", "$defs", "definitions", "$anchor", "examples")
+
+func setOf(keys ...string) map[string]bool {
+	m := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		m[k] = true
+	}
+	return m
+}
+
+func validSchemaProfile(name string) bool {
+	_, ok := schemaProfiles[name]
+	return name == "" || name == "raw" || ok
+}
+
+// sanitizeTools rewrites the tools' parameter schemas to the named
+// profile. Names are made to fit its rule by toolMapper.
+func sanitizeTools(tools []OATool, profile string, logger *slog.Logger) {
+	p := schemaProfiles[profile]
+	if p == nil {
+		return
+	}
+	for i := range tools {
+		fn := &tools[i].Function
+		var lossy []string
+		fn.Parameters, lossy = sanitizeSchema(fn.Parameters, p)
+		if len(lossy) > 0 {
+			logger.Info("tool schema changed lossily", "tool", fn.Name, "profile", profile, "changes", lossy)
+		}
+	}
+}
+
+// Schema nodes sanitized per tool. Shared $refs are expanded at every use,
+// which could otherwise grow a schema exponentially.
+const schemaMaxNodes = 5000
+
+// schemaSanitizer rewrites one tool's parameter schema to a profile
+type schemaSanitizer struct {
+	p     *schemaProfile
+	root  map[string]any
+	lossy []string // Transformations that changed what the schema accepts
+	nodes int
+}
+
+// sanitizeSchema returns the schema rewritten to profile p, and the lossy
+// transformations made, each as "<path>: <what>"
+func sanitizeSchema(raw json.RawMessage, p *schemaProfile) (json.RawMessage, []string) {
+	var root map[string]any
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &root); err != nil {
+			return json.RawMessage(`{"type":"object"}`), []string{"#: not a JSON object, replaced with an empty object schema"}
+		}
+	}
+	if root == nil {
+		root = map[string]any{}
+	}
+	s := &schemaSanitizer{p: p, root: root}
+	out, _ := s.walk(root, "#", nil).(map[string]any)
+	if out == nil {
+		out = map[string]any{}
+	}
+	if _, ok := out["type"]; !ok {
+		out["type"] = "object"
+	}
+	b, _ := json.Marshal(out)
+	return b, s.lossy
+}
+
+func (s *schemaSanitizer) loss(path, format string, args ...any) {
+	s.lossy = append(s.lossy, path+": "+fmt.Sprintf(format, args...))
+}
+
+// walk sanitizes the schema at path. refs are the $refs being expanded,
+// to catch recursion.
+func (s *schemaSanitizer) walk(node any, path string, refs []string) any {
+	orig, ok := node.(map[string]any)
+	if !ok {
+		return node
+	}
+	if s.nodes++; s.nodes > schemaMaxNodes {
+		if s.nodes == schemaMaxNodes+1 {
+			s.loss(path, "schema over %d nodes, this and later parts replaced with objects", schemaMaxNodes)
+		}
+		return map[string]any{"type": "object"}
+	}
+	// Copied, as $ref targets are shared
+	m := make(map[string]any, len(orig))
+	for k, v := range orig {
+		m[k] = v
+	}
+
+	if ref, ok := m["$ref"].(string); ok {
+		for _, r := range refs {
+			if r == ref {
+				s.loss(path, "recursive $ref %s replaced with an object", ref)
+				return map[string]any{"type": "object"}
+			}
+		}
+		target, ok := s.resolve(ref)
+		if !ok {
+			s.loss(path, "unresolvable $ref %s dropped", ref)
+			target = map[string]any{}
+		}
+		merged := make(map[string]any, len(target)+len(m))
+		for k, v := range target {
+			merged[k] = v
+		}
+		for k, v := range m {
+			if k != "$ref" {
+				merged[k] = v
+			}
+		}
+		return s.walk(merged, path, append(refs[:len(refs):len(refs)], ref))
+	}
+
+	m = s.mergeAllOf(m, path)
+	if s.p.flatten {
+		if s.flattenUnion(m, path) {
+			// The chosen variant may be a $ref or union itself
+			return s.walk(m, path, refs)
+		}
+	} else if one, ok := m["oneOf"]; ok {
+		delete(m, "oneOf")
+		m["anyOf"] = one
+		s.loss(path, "oneOf treated as anyOf")
+	}
+
+	out := make(map[string]any, len(m))
+	for _, k := range schemaKeys(m) {
+		v := m[k]
+		if !s.p.keywords[k] {
+			if k == "additionalProperties" && v == true {
+				continue // The default
+			}
+			if !schemaMetadata[k] {
+				s.loss(path, "%s dropped", k)
+			}
+			continue
+		}
+		switch k {
+		case "properties":
+			props, _ := v.(map[string]any)
+			if len(props) == 0 {
+				continue // Some upstreams reject empty properties
+			}
+			np := make(map[string]any, len(props))
+			for _, name := range schemaKeys(props) {
+				np[name] = s.walk(props[name], path+"/properties/"+name, refs)
+			}
+			out[k] = np
+		case "items":
+			if tuple, ok := v.([]any); ok {
+				if len(tuple) == 0 {
+					continue
+				}
+				s.loss(path, "tuple items reduced to the first item schema")
+				v = tuple[0]
+			}
+			out[k] = s.walk(v, path+"/items", refs)
+		case "additionalProperties":
+			if sub, ok := v.(map[string]any); ok {
+				out[k] = s.walk(sub, path+"/additionalProperties", refs)
+			} else {
+				out[k] = v
+			}
+		case "anyOf":
+			list, _ := v.([]any)
+			nl := make([]any, len(list))
+			for i, sub := range list {
+				nl[i] = s.walk(sub, fmt.Sprintf("%s/anyOf/%d", path, i), refs)
+			}
+			out[k] = nl
+		case "format":
+			if f, ok := v.(string); ok && !s.p.formats[f] {
+				s.loss(path, "format %q dropped", f)
+				continue
+			}
+			out[k] = v
+		case "enum":
+			if s.p.flatten && !allStrings(v) {
+				s.loss(path, "non-string enum dropped")
+				continue
+			}
+			out[k] = v
+		default:
+			out[k] = v
+		}
+	}
+
+	// Required names must exist once properties are known
+	if req, ok := out["required"].([]any); ok {
+		props, _ := out["properties"].(map[string]any)
+		kept := make([]any, 0, len(req))
+		for _, name := range req {
+			if n, ok := name.(string); ok && props != nil && props[n] != nil {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) > 0 {
+			out["required"] = kept
+		} else {
+			delete(out, "required")
+		}
+	}
+	return out
+}
+
+// resolve looks up a local JSON pointer ref like "#/$defs/Item"
+func (s *schemaSanitizer) resolve(ref string) (map[string]any, bool) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+	var cur any = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	m, ok := cur.(map[string]any)
+	return m, ok
+}
+
+// mergeAllOf folds allOf subschemas into m, unioning properties and required
+func (s *schemaSanitizer) mergeAllOf(m map[string]any, path string) map[string]any {
+	all, ok := m["allOf"].([]any)
+	if !ok {
+		return m
+	}
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		if k != "allOf" {
+			out[k] = v
+		}
+	}
+	for _, sub := range all {
+		sm, ok := sub.(map[string]any)
+		if !ok {
+			continue
+		}
+		if ref, ok := sm["$ref"].(string); ok {
+			if sm, ok = s.resolve(ref); !ok {
+				s.loss(path, "unresolvable $ref %s in allOf dropped", ref)
+				continue
+			}
+		}
+		for k, v := range sm {
+			switch k {
+			case "allOf":
+				s.loss(path, "nested allOf dropped")
+			case "properties":
+				props, _ := out[k].(map[string]any)
+				merged := make(map[string]any, len(props))
+				for n, p := range props {
+					merged[n] = p
+				}
+				if sp, ok := v.(map[string]any); ok {
+					for n, p := range sp {
+						merged[n] = p
+					}
+				}
+				out[k] = merged
+			case "required":
+				req, _ := out[k].([]any)
+				if sr, ok := v.([]any); ok {
+					req = append(req, sr...)
+				}
+				out[k] = req
+			default:
+				if _, ok := out[k]; !ok {
+					out[k] = v
+				}
+			}
+		}
+	}
+	return out
+}
+
+// flattenUnion turns anyOf/oneOf and type arrays in m into a single schema
+// for upstreams without unions. A null variant becomes "nullable"; of
+// several other variants only the first is kept. It reports whether a
+// variant was merged into m.
+func (s *schemaSanitizer) flattenUnion(m map[string]any, path string) (merged bool) {
+	if c, ok := m["const"]; ok {
+		delete(m, "const")
+		m["enum"] = []any{c}
+	}
+	if types, ok := m["type"].([]any); ok {
+		var kept []any
+		for _, t := range types {
+			if t == "null" {
+				m["nullable"] = true
+			} else {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) > 1 {
+			s.loss(path, "type %v reduced to %v", types, kept[0])
+		}
+		if len(kept) > 0 {
+			m["type"] = kept[0]
+		} else {
+			delete(m, "type")
+		}
+	}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		list, ok := m[key].([]any)
+		if !ok {
+			continue
+		}
+		delete(m, key)
+		var variants []map[string]any
+		for _, v := range list {
+			vm, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			if vm["type"] == "null" {
+				m["nullable"] = true
+				continue
+			}
+			variants = append(variants, vm)
+		}
+		if len(variants) == 0 {
+			continue
+		}
+		// A union of constants is an enum
+		if values, ok := unionValues(variants); ok {
+			m["enum"] = values
+			if t, ok := variants[0]["type"]; ok {
+				m["type"] = t
+			} else if allStrings(values) {
+				m["type"] = "string"
+			}
+			return false
+		}
+		if len(variants) > 1 {
+			s.loss(path, "%s of %d schemas reduced to the first", key, len(variants))
+		}
+		for k, v := range variants[0] {
+			if _, ok := m[k]; !ok {
+				m[k] = v
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// unionValues returns the values of variants that are all const or enum
+func unionValues(variants []map[string]any) ([]any, bool) {
+	var values []any
+	for _, v := range variants {
+		for k := range v {
+			if k != "const" && k != "enum" && k != "type" && k != "description" && k != "title" {
+				return nil, false
+			}
+		}
+		switch {
+		case v["const"] != nil:
+			values = append(values, v["const"])
+		case v["enum"] != nil:
+			list, ok := v["enum"].([]any)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, list...)
+		default:
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func allStrings(v any) bool {
+	list, ok := v.([]any)
+	if !ok {
+		return false
+	}
+	for _, e := range list {
+		if _, ok := e.(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// schemaKeys returns m's keys sorted, so losses are logged in a stable order
+// and the node cap cuts off the same properties every time
+func schemaKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
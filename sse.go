@@ -0,0 +1,349 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Anthropic SSE Encoder =================
+
+// Anthropic streaming events. Each is encoded as "event: <type>" followed
+// by its JSON as data.
+type (
+	messageStartEvent struct {
+		Type    string           `json:"type"`
+		Message anthropicMessage `json:"message"`
+	}
+	anthropicMessage struct {
+		ID           string         `json:"id"`
+		Type         string         `json:"type"`
+		Role         string         `json:"role"`
+		Content      []any          `json:"content"`
+		Model        string         `json:"model"`
+		StopReason   *string        `json:"stop_reason"`
+		StopSequence *string        `json:"stop_sequence"`
+		Usage        anthropicUsage `json:"usage"`
+	}
+	anthropicUsage struct {
+		InputTokens              int `json:"input_tokens"`
+		OutputTokens             int `json:"output_tokens"`
+		CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+		CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	}
+	contentBlockStartEvent struct {
+		Type         string       `json:"type"`
+		Index        int          `json:"index"`
+		ContentBlock contentBlock `json:"content_block"`
+	}
+	contentBlock struct {
+		Type     string          `json:"type"`
+		Text     *string         `json:"text,omitempty"`
+		Thinking *string         `json:"thinking,omitempty"`
+		ID       string          `json:"id,omitempty"`
+		Name     string          `json:"name,omitempty"`
+		Input    json.RawMessage `json:"input,omitempty"`
+	}
+	contentBlockDeltaEvent struct {
+		Type  string     `json:"type"`
+		Index int        `json:"index"`
+		Delta blockDelta `json:"delta"`
+	}
+	blockDelta struct {
+		Type        string  `json:"type"`
+		Text        *string `json:"text,omitempty"`
+		Thinking    *string `json:"thinking,omitempty"`
+		PartialJSON *string `json:"partial_json,omitempty"`
+	}
+	contentBlockStopEvent struct {
+		Type  string `json:"type"`
+		Index int    `json:"index"`
+	}
+	messageDeltaEvent struct {
+		Type  string `json:"type"`
+		Delta struct {
+			StopReason   string  `json:"stop_reason"`
+			StopSequence *string `json:"stop_sequence"`
+		} `json:"delta"`
+		Usage struct {
+			// Input counts are only sent once the upstream reported them
+			InputTokens              int `json:"input_tokens,omitempty"`
+			OutputTokens             int `json:"output_tokens"`
+			CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+			CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+		} `json:"usage"`
+	}
+	messageStopEvent struct {
+		Type string `json:"type"`
+	}
+	errorEvent struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+)
+
+func textBlock() contentBlock     { return contentBlock{Type: "text", Text: new(string)} }
+func thinkingBlock() contentBlock { return contentBlock{Type: "thinking", Thinking: new(string)} }
+func toolUseBlock(id, name string) contentBlock {
+	return contentBlock{Type: "tool_use", ID: id, Name: name, Input: json.RawMessage("{}")}
+}
+
+func textDelta(s string) blockDelta     { return blockDelta{Type: "text_delta", Text: &s} }
+func thinkingDelta(s string) blockDelta { return blockDelta{Type: "thinking_delta", Thinking: &s} }
+func inputJSONDelta(s string) blockDelta {
+	return blockDelta{Type: "input_json_delta", PartialJSON: &s}
+}
+
+// blockFor returns the block type a delta belongs in
+func (d blockDelta) blockFor() string {
+	switch d.Type {
+	case "text_delta":
+		return "text"
+	case "thinking_delta":
+		return "thinking"
+	}
+	return "tool_use"
+}
+
+// Stream repair kinds, the "kind" label of ant2oa_stream_repairs_total
+const (
+	repairMissingStart   = "missing_message_start"
+	repairUnclosedBlock  = "unclosed_block"
+	repairBlockIndex     = "block_index"
+	repairOrphanDelta    = "orphan_delta"
+	repairDroppedDelta   = "dropped_delta"
+	repairDuplicateStop  = "duplicate_block_stop"
+	repairMissingDelta   = "missing_message_delta"
+	repairDuplicateDelta = "duplicate_message_delta"
+	repairAfterEnd       = "event_after_end"
+	repairUnterminated   = "unterminated_stream"
+	repairBlockAfterDone = "block_after_message_delta"
+)
+
+// sseEncoder writes Anthropic streaming events and keeps them in grammar:
+//
+//	message_start (content_block_start content_block_delta* content_block_stop)* message_delta message_stop
+//
+// or an error event at any point. Events that would break it are repaired
+// (missing events are inserted, misplaced ones rewritten or dropped) and
+// every repair is counted in ant2oa_stream_repairs_total.
+type sseEncoder struct {
+	w       io.Writer
+	flusher http.Flusher
+	st      *requestStats
+	logger  *slog.Logger
+
+	started   bool
+	delta     bool // message_delta sent
+	ended     bool // message_stop or error sent
+	next      int  // Index of the next content block
+	open      int  // Index of the open block, -1 if none
+	openType  string
+	model     string
+	inputToks int
+}
+
+func newSSEEncoder(w io.Writer, flusher http.Flusher, st *requestStats, logger *slog.Logger) *sseEncoder {
+	return &sseEncoder{w: w, flusher: flusher, st: st, logger: logger, open: -1, model: "proxy"}
+}
+
+func (e *sseEncoder) repair(kind string) {
+	streamRepairs.add([]string{kind, e.st.Model}, 1)
+	e.logger.Debug("stream repaired", "kind", kind)
+}
+
+func (e *sseEncoder) write(name string, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		e.logger.Error("encoding stream event failed", "event", name, "error", err)
+		return
+	}
+	io.WriteString(e.w, "event: "+name+"\ndata: ")
+	e.w.Write(b)
+	io.WriteString(e.w, "\n\n")
+}
+
+func (e *sseEncoder) flush() {
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+}
+
+// usable reports whether another event may be sent, counting a repair if not
+func (e *sseEncoder) usable() bool {
+	if e.ended {
+		e.repair(repairAfterEnd)
+		return false
+	}
+	return true
+}
+
+func (e *sseEncoder) messageStart(inputTokens, outputTokens int) {
+	if !e.usable() || e.started {
+		return
+	}
+	e.started = true
+	e.inputToks = inputTokens
+	e.write("message_start", messageStartEvent{Type: "message_start", Message: anthropicMessage{
+		ID:      "msg_proxy",
+		Type:    "message",
+		Role:    "assistant",
+		Content: []any{},
+		Model:   e.model,
+		Usage: anthropicUsage{
+			InputTokens:              inputTokens,
+			OutputTokens:             outputTokens,
+			CacheCreationInputTokens: e.st.CacheWriteTokens,
+			CacheReadInputTokens:     e.st.CachedTokens,
+		},
+	}})
+}
+
+func (e *sseEncoder) ensureStarted() {
+	if !e.started {
+		e.repair(repairMissingStart)
+		e.messageStart(e.inputToks, 0)
+	}
+}
+
+// blockStart opens a content block and returns its index
+func (e *sseEncoder) blockStart(block contentBlock) int {
+	if !e.usable() {
+		return -1
+	}
+	e.ensureStarted()
+	if e.delta {
+		e.repair(repairBlockAfterDone)
+		return -1
+	}
+	if e.open >= 0 {
+		e.repair(repairUnclosedBlock)
+		e.blockStop(e.open)
+	}
+	e.open, e.openType = e.next, block.Type
+	e.next++
+	e.write("content_block_start", contentBlockStartEvent{Type: "content_block_start", Index: e.open, ContentBlock: block})
+	return e.open
+}
+
+// blockDelta sends a delta for the block at index. A delta for a closed or
+// unknown block goes to the open block if it fits there; text and thinking
+// get a new block otherwise, tool input can't and is dropped.
+func (e *sseEncoder) blockDelta(index int, d blockDelta) {
+	if !e.usable() {
+		return
+	}
+	if index != e.open || d.blockFor() != e.openType {
+		switch {
+		case e.open >= 0 && d.blockFor() == e.openType:
+			e.repair(repairBlockIndex)
+		case d.Type == "input_json_delta" || e.delta:
+			e.repair(repairDroppedDelta)
+			return
+		default:
+			e.repair(repairOrphanDelta)
+			if e.open >= 0 {
+				e.blockStop(e.open)
+			}
+			if d.Type == "text_delta" {
+				e.blockStart(textBlock())
+			} else {
+				e.blockStart(thinkingBlock())
+			}
+		}
+		index = e.open
+	}
+	e.write("content_block_delta", contentBlockDeltaEvent{Type: "content_block_delta", Index: index, Delta: d})
+}
+
+func (e *sseEncoder) blockStop(index int) {
+	if !e.usable() {
+		return
+	}
+	if e.open < 0 || index != e.open {
+		e.repair(repairDuplicateStop)
+		return
+	}
+	e.write("content_block_stop", contentBlockStopEvent{Type: "content_block_stop", Index: index})
+	e.open, e.openType = -1, ""
+}
+
+// closeOpenBlock ends the open block, if any. It isn't a repair.
+func (e *sseEncoder) closeOpenBlock() {
+	if e.open >= 0 {
+		e.blockStop(e.open)
+	}
+}
+
+func (e *sseEncoder) messageDelta(stopReason string, outputTokens int) {
+	if !e.usable() {
+		return
+	}
+	if e.delta {
+		e.repair(repairDuplicateDelta)
+		return
+	}
+	e.ensureStarted()
+	if e.open >= 0 {
+		e.repair(repairUnclosedBlock)
+		e.blockStop(e.open)
+	}
+	e.delta = true
+	ev := messageDeltaEvent{Type: "message_delta"}
+	ev.Delta.StopReason = stopReason
+	ev.Usage.OutputTokens = outputTokens
+	if e.st.InputTokens > 0 {
+		u := e.st.anthropicUsage()
+		ev.Usage.InputTokens = u.InputTokens
+		ev.Usage.CacheCreationInputTokens = u.CacheCreationInputTokens
+		ev.Usage.CacheReadInputTokens = u.CacheReadInputTokens
+	}
+	e.write("message_delta", ev)
+}
+
+func (e *sseEncoder) messageStop() {
+	if !e.usable() {
+		return
+	}
+	if !e.delta {
+		e.repair(repairMissingDelta)
+		e.messageDelta("end_turn", 0)
+	}
+	e.ended = true
+	e.write("message_stop", messageStopEvent{Type: "message_stop"})
+	e.flush()
+}
+
+// error ends the stream with an error event
+func (e *sseEncoder) error(errType, msg string) {
+	if !e.usable() {
+		return
+	}
+	e.ended = true
+	ev := errorEvent{Type: "error"}
+	ev.Error.Type = errType
+	ev.Error.Message = msg
+	e.write("error", ev)
+	e.flush()
+}
+
+// finish ends a stream the upstream stopped without [DONE]: normally after
+// a clean EOF, with an error event after a read error
+func (e *sseEncoder) finish(readErr error, stopReason string, outputTokens int) {
+	if e.ended {
+		return
+	}
+	e.repair(repairUnterminated)
+	if readErr != nil && readErr != io.EOF {
+		e.error("api_error", "upstream stream interrupted: "+readErr.Error())
+		return
+	}
+	e.closeOpenBlock()
+	e.messageDelta(stopReason, outputTokens)
+	e.messageStop()
+}
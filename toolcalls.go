@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Streaming Tool Calls =================
+
+// toolCallState is one upstream tool call and its Anthropic block
+type toolCallState struct {
+	index  int // Upstream index
+	id     string
+	name   string
+	args   strings.Builder // All fragments so far
+	sent   int             // Bytes of args already sent as input_json_delta
+	block  int             // Anthropic block index, -1 until started
+	closed bool
+}
+
+// toolCallStream turns OpenAI tool call deltas into Anthropic tool_use
+// blocks, one per upstream index. Blocks can't interleave, so the first
+// call streams live and fragments of later calls are buffered until tool
+// calls end (see flush).
+type toolCallStream struct {
+	enc     *sseEncoder
+	names   *toolMapper            // Restores renamed tool names and IDs
+	byIndex map[int]*toolCallState // Latest call for each upstream index
+	calls   []*toolCallState       // In order of appearance
+	active  *toolCallState         // Call whose block is open
+}
+
+func newToolCallStream(enc *sseEncoder, names *toolMapper) *toolCallStream {
+	return &toolCallStream{enc: enc, names: names, byIndex: make(map[int]*toolCallState)}
+}
+
+// add handles one tool call fragment
+func (t *toolCallStream) add(tc OAToolCall) {
+	call := t.byIndex[tc.Index]
+	// A new ID at a known index is a new call; some upstreams send every
+	// call with index 0
+	if call == nil || (tc.ID != "" && call.id != "" && tc.ID != call.id) {
+		call = &toolCallState{index: tc.Index, block: -1}
+		t.byIndex[tc.Index] = call
+		t.calls = append(t.calls, call)
+	}
+	if call.closed {
+		t.enc.repair("late_tool_fragment")
+		return
+	}
+	if tc.ID != "" {
+		call.id = tc.ID
+	}
+	if tc.Function.Name != "" && call.block < 0 {
+		call.name += tc.Function.Name
+	}
+	call.args.WriteString(tc.Function.Arguments)
+
+	if t.active == nil && call.name != "" {
+		t.start(call)
+	}
+	if t.active == call {
+		t.send(call)
+	}
+}
+
+// pending reports whether there are tool calls that flush would emit
+func (t *toolCallStream) pending() bool {
+	for _, call := range t.calls {
+		if !call.closed {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *toolCallStream) start(call *toolCallState) {
+	if call.id == "" {
+		call.id = newToolUseID()
+	}
+	call.block = t.enc.blockStart(toolUseBlock(t.names.clientID(call.id), t.names.clientName(call.name)))
+	t.active = call
+}
+
+// send streams the arguments received since the last send
+func (t *toolCallStream) send(call *toolCallState) {
+	args := call.args.String()
+	if call.sent < len(args) {
+		t.enc.blockDelta(call.block, inputJSONDelta(args[call.sent:]))
+		call.sent = len(args)
+	}
+}
+
+// flush ends tool calls: the open block is completed and closed, then each
+// buffered call is sent as a block of its own with repaired arguments
+func (t *toolCallStream) flush() {
+	for _, call := range t.calls {
+		if call.closed {
+			continue
+		}
+		if call.name == "" {
+			t.enc.repair("dropped_tool_call")
+			t.enc.logger.Warn("dropping tool call without a name", "index", call.index, "id", call.id)
+			call.closed = true
+			continue
+		}
+		if t.active != call {
+			t.start(call)
+		}
+		args := call.args.String()
+		fixed, ok := repairJSON(args)
+		switch {
+		case ok && fixed == args:
+		case ok && strings.HasPrefix(fixed, args[:call.sent]):
+			// Only the unsent part can still change
+			t.enc.repair("tool_args_repaired")
+			call.args.Reset()
+			call.args.WriteString(fixed)
+		default:
+			// Send "{}" as the non-streaming path does; arguments already
+			// streamed live can't be taken back, so those are completed
+			t.enc.repair("tool_args_invalid")
+			t.enc.logger.Warn("tool call arguments are not valid JSON", "name", call.name, "arguments", args)
+			sent := args[:call.sent]
+			call.args.Reset()
+			if sent == "" {
+				call.args.WriteString("{}")
+			} else if fixed, ok := repairJSON(sent); ok && strings.HasPrefix(fixed, sent) {
+				call.args.WriteString(fixed)
+			} else {
+				call.args.WriteString(sent)
+			}
+		}
+		t.send(call)
+		t.enc.blockStop(call.block)
+		call.closed = true
+		t.active = nil
+	}
+}
+
+func newToolUseID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "toolu_" + hex.EncodeToString(b)
+}
+
+// repairJSON returns s if it is valid JSON, or s completed by closing open
+// strings, arrays and objects, as upstreams cut off by max_tokens leave
+// them. ok is false if that doesn't make it valid. Empty input is "{}".
+func repairJSON(s string) (fixed string, ok bool) {
+	if strings.TrimSpace(s) == "" {
+		return "{}", true
+	}
+	if json.Valid([]byte(s)) {
+		return s, true
+	}
+
+	var stack []byte
+	inString, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inString && escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case inString && c == '"':
+			inString = false
+		case inString:
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			stack = append(stack, c)
+		case c == '}' || c == ']':
+			if len(stack) == 0 {
+				return s, false
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	base := s
+	if escaped {
+		base += `\`
+	}
+	if inString {
+		base += `"`
+	}
+	base = strings.TrimRight(base, " \t\r\n")
+	var closers strings.Builder
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i] == '{' {
+			closers.WriteByte('}')
+		} else {
+			closers.WriteByte(']')
+		}
+	}
+	// Try as is, then with a dangling key or colon given a null value
+	for _, mid := range []string{"", "null", ":null"} {
+		if fixed := base + mid + closers.String(); json.Valid([]byte(fixed)) {
+			return fixed, true
+		}
+	}
+	// A trailing comma can't be completed without dropping it
+	if trimmed := strings.TrimSuffix(base, ","); trimmed != base {
+		if fixed := trimmed + closers.String(); json.Valid([]byte(fixed)) {
+			return fixed, true
+		}
+	}
+	return s, false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// ================= Tool Name & ID Mapping =================
+
+// Tool call ID styles, set per route with "tool_ids"
+const (
+	toolIDsKeep    = ""
+	toolIDsMistral = "mistral" // 9 alphanumeric characters
+)
+
+func validToolIDStyle(s string) bool {
+	return s == toolIDsKeep || s == toolIDsMistral
+}
+
+// OpenAI's rule, which most upstreams share
+var defaultToolNameRule = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// toolMapper renames tool names and tool call IDs the upstream would reject
+// for one request, and maps them back in the response so clients only see
+// their own. A nil mapper changes nothing.
+type toolMapper struct {
+	nameRule *regexp.Regexp
+	idStyle  string
+	names    map[string]string // Client -> upstream
+	rnames   map[string]string // Upstream -> client
+	ids      map[string]string
+	rids     map[string]string
+}
+
+// newToolMapper returns the mapper for a route and the request's tools, or
+// nil for prompted tools, whose names never reach the upstream's validator
+func newToolMapper(route *RouteConfig, tools []AnthropicTool) *toolMapper {
+	m := &toolMapper{
+		nameRule: defaultToolNameRule,
+		names:    make(map[string]string),
+		rnames:   make(map[string]string),
+		ids:      make(map[string]string),
+		rids:     make(map[string]string),
+	}
+	if route != nil {
+		if route.Tools == toolsPrompted {
+			return nil
+		}
+		if p := schemaProfiles[route.Schema]; p != nil {
+			m.nameRule = p.nameRule
+		}
+		m.idStyle = route.ToolIDs
+	}
+	// Valid names stay as they are, so renamed ones must not take them
+	for _, t := range tools {
+		if m.nameRule.MatchString(t.Name) {
+			m.rnames[t.Name] = t.Name
+		}
+	}
+	return m
+}
+
+// upstreamName returns the name sent upstream for a client tool name
+func (m *toolMapper) upstreamName(name string) string {
+	if m == nil || name == "" || m.nameRule.MatchString(name) {
+		return name
+	}
+	if n, ok := m.names[name]; ok {
+		return n
+	}
+	n := safeToolName(name)
+	if !m.nameRule.MatchString(n) || m.rnames[n] != "" {
+		// Still invalid, or taken by another tool
+		n = "tool_" + shortHash(name, 16)
+	}
+	m.names[name], m.rnames[n] = n, name
+	return n
+}
+
+// clientName maps an upstream tool name back
+func (m *toolMapper) clientName(name string) string {
+	if m == nil {
+		return name
+	}
+	if n, ok := m.rnames[name]; ok {
+		return n
+	}
+	return name
+}
+
+// upstreamID returns the tool call ID sent upstream for a client ID
+func (m *toolMapper) upstreamID(id string) string {
+	if m == nil || id == "" || m.idStyle != toolIDsMistral {
+		return id
+	}
+	if v, ok := m.ids[id]; ok {
+		return v
+	}
+	v := alnumHash(id, 9)
+	for n := 0; m.rids[v] != ""; n++ {
+		v = alnumHash(id+strings.Repeat("#", n+1), 9)
+	}
+	m.ids[id], m.rids[v] = v, id
+	return v
+}
+
+// clientID maps an upstream tool call ID back
+func (m *toolMapper) clientID(id string) string {
+	if m == nil {
+		return id
+	}
+	if v, ok := m.rids[id]; ok {
+		return v
+	}
+	return id
+}
+
+// toolChoice renames the function of a normalized tool_choice
+func (m *toolMapper) toolChoice(tc any) any {
+	if c, ok := tc.(map[string]any); ok {
+		if fn, ok := c["function"].(map[string]any); ok {
+			if name, ok := fn["name"].(string); ok {
+				fn["name"] = m.upstreamName(name)
+			}
+		}
+	}
+	return tc
+}
+
+// safeToolName replaces characters outside [a-zA-Z0-9_-] and shortens long
+// names, keeping a hash of the original so names stay distinct
+func safeToolName(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	n := sb.String()
+	if c := n[0]; !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_') {
+		n = "t_" + n
+	}
+	if len(n) > 64 {
+		n = n[:55] + "_" + shortHash(name, 8)
+	}
+	return n
+}
+
+func shortHash(s string, n int) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])[:n]
+}
+
+// alnumHash derives an n character [a-zA-Z0-9] string from s
+func alnumHash(s string, n int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	h := sha256.Sum256([]byte(s))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[int(h[i])%len(alphabet)]
+	}
+	return string(b)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Tool Results =================
+
+// Marks failed tool results in the tool message when the route sets no
+// tool_error_prefix
+const defaultToolErrorPrefix = "Error: "
+
+// toolResultMessage builds the tool message for a tool_result block. Its
+// text parts are joined into the content; images and documents the tool
+// message can't hold are returned to go in the user message after it.
+func toolResultMessage(p AnthropicContent, id string, route *RouteConfig, media func(AnthropicContent) []OAContentPart) (map[string]any, []OAContentPart) {
+	text, attached := flattenToolResult(p.Content, media)
+
+	var lifted []OAContentPart
+	if len(attached) > 0 {
+		text = strings.TrimSpace(text + "\n[attachments in the next message]")
+		lifted = append([]OAContentPart{{Type: "text", Text: "Attachments from tool result " + id + ":"}}, attached...)
+	}
+
+	msg := map[string]any{"role": "tool", "tool_call_id": id}
+	if p.IsError {
+		prefix := defaultToolErrorPrefix
+		if route != nil && route.ToolErrorPrefix != nil {
+			prefix = *route.ToolErrorPrefix
+		}
+		text = prefix + text
+		if route != nil && route.ToolErrorField != "" {
+			msg[route.ToolErrorField] = true
+		}
+	}
+	msg["content"] = text
+	if keepCacheControl(route) && p.CacheControl != nil {
+		msg["content"] = []OAContentPart{{Type: "text", Text: text, CacheControl: p.CacheControl}}
+	}
+	return msg, lifted
+}
+
+// flattenToolResult turns tool_result content, a string or a list of
+// blocks, into plain text. Media blocks are converted by media; any text
+// that gives (notes for dropped images, extracted documents) stays in the
+// text and the rest is returned.
+func flattenToolResult(raw json.RawMessage, media func(AnthropicContent) []OAContentPart) (string, []OAContentPart) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, nil
+	}
+	var blocks []json.RawMessage
+	if json.Unmarshal(raw, &blocks) != nil {
+		return string(raw), nil
+	}
+
+	var texts []string
+	var attached []OAContentPart
+	for _, b := range blocks {
+		var head struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(b, &head)
+		var c AnthropicContent
+		if head.Type == "text" || head.Type == "image" || head.Type == "document" {
+			if json.Unmarshal(b, &c) != nil {
+				head.Type = ""
+			}
+		}
+		switch head.Type {
+		case "text":
+			if c.Text != "" {
+				texts = append(texts, c.Text)
+			}
+		case "image", "document":
+			for _, part := range media(c) {
+				if part.Type == "text" {
+					texts = append(texts, part.Text)
+				} else {
+					attached = append(attached, part)
+				}
+			}
+		case "search_result":
+			texts = append(texts, searchResultText(b))
+		default:
+			texts = append(texts, string(b))
+		}
+	}
+	return strings.Join(texts, "\n\n"), attached
+}
+
+// searchResultText renders a search_result block like a document
+func searchResultText(raw json.RawMessage) string {
+	var r struct {
+		Title   string          `json:"title"`
+		Source  string          `json:"source"`
+		Content json.RawMessage `json:"content"`
+	}
+	if json.Unmarshal(raw, &r) != nil {
+		return string(raw)
+	}
+	return fmt.Sprintf("<search_result title=%q source=%q>\n%s\n</search_result>", r.Title, r.Source, parseComplexContent(r.Content))
+}
+
+// fixToolAdjacency enforces OpenAI's rule that an assistant message with
+// tool_calls is followed directly by one tool message per call. Missing
+// results get a placeholder, and tool messages with no matching call are
+// turned into user text.
+func fixToolAdjacency(messages []map[string]any) []map[string]any {
+	orphan := func(t map[string]any) map[string]any {
+		id, _ := t["tool_call_id"].(string)
+		return map[string]any{"role": "user", "content": fmt.Sprintf("[Result of tool call %s]\n%s", id, contentText(t["content"]))}
+	}
+	out := make([]map[string]any, 0, len(messages))
+	for i := 0; i < len(messages); i++ {
+		m := messages[i]
+		if m["role"] == "tool" {
+			out = append(out, orphan(m))
+			continue
+		}
+		out = append(out, m)
+		calls, _ := m["tool_calls"].([]map[string]any)
+		if m["role"] != "assistant" || len(calls) == 0 {
+			continue
+		}
+
+		pending := make(map[string]bool, len(calls))
+		for _, c := range calls {
+			id, _ := c["id"].(string)
+			pending[id] = true
+		}
+		var orphans []map[string]any
+		for i+1 < len(messages) && messages[i+1]["role"] == "tool" {
+			i++
+			t := messages[i]
+			if id, _ := t["tool_call_id"].(string); pending[id] {
+				delete(pending, id)
+				out = append(out, t)
+			} else {
+				orphans = append(orphans, orphan(t))
+			}
+		}
+		for _, c := range calls {
+			if id, _ := c["id"].(string); pending[id] {
+				out = append(out, map[string]any{"role": "tool", "tool_call_id": id, "content": "[no result was provided for this call]"})
+			}
+		}
+		out = append(out, orphans...)
+	}
+	return out
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ================= Tracing =================
+
+// Span kinds, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+// spanContext identifies a span across process boundaries (W3C Trace Context)
+type spanContext struct {
+	TraceID    traceID
+	SpanID     spanID
+	Sampled    bool
+	TraceState string
+}
+
+// parseTraceparent parses a "traceparent" header like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(h, state string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || sc.TraceID == (traceID{}) {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || sc.SpanID == (spanID{}) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	sc.TraceState = state
+	return sc, true
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// span is one timed operation. All methods are safe on a nil span, which is
+// what startSpan returns when the request isn't traced.
+type span struct {
+	sc     spanContext
+	parent spanID
+	name   string
+	kind   int
+	start  time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []spanAttr
+	events []spanEvent
+	errMsg string // Non-empty marks the span as failed
+}
+
+type spanAttr struct {
+	key   string
+	value any // string, bool, int, int64 or float64
+}
+
+type spanEvent struct {
+	time time.Time
+	name string
+}
+
+type spanKey struct{}
+type remoteSpanKey struct{}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child of the span in ctx. Without a parent it starts a
+// new trace, continuing an incoming traceparent if there is one.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	exp := tracer.Load()
+	if exp == nil {
+		return ctx, nil
+	}
+
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent := spanFrom(ctx); parent != nil {
+		s.sc.TraceID = parent.sc.TraceID
+		s.sc.TraceState = parent.sc.TraceState
+		s.parent = parent.sc.SpanID
+	} else if remote, ok := ctx.Value(remoteSpanKey{}).(spanContext); ok {
+		if !remote.Sampled {
+			return ctx, nil
+		}
+		s.sc.TraceID = remote.TraceID
+		s.sc.TraceState = remote.TraceState
+		s.parent = remote.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		if !exp.sample(s.sc.TraceID) {
+			return ctx, nil
+		}
+	}
+	rand.Read(s.sc.SpanID[:])
+	s.sc.Sampled = true
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startServerSpan starts the root span of an incoming request, honoring its
+// traceparent. The remote context is kept so it is passed on upstream even
+// when tracing is off.
+func startServerSpan(r *http.Request) (context.Context, *span) {
+	ctx := r.Context()
+	if sc, ok := parseTraceparent(r.Header.Get("traceparent"), r.Header.Get("tracestate")); ok {
+		ctx = context.WithValue(ctx, remoteSpanKey{}, sc)
+	}
+	ctx, s := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+	s.setAttr("http.request.method", r.Method)
+	s.setAttr("url.path", r.URL.Path)
+	s.setAttr("user_agent.original", r.UserAgent())
+	return ctx, s
+}
+
+// finishServerSpan records the outcome of a request on its root span
+func finishServerSpan(s *span, st *requestStats, status int) {
+	s.setAttr("http.response.status_code", status)
+	s.setAttr("ant2oa.key", st.Key)
+	s.setAttr("gen_ai.request.model", st.RequestedModel)
+	if st.Model != "" {
+		s.setAttr("gen_ai.usage.input_tokens", st.InputTokens)
+		s.setAttr("gen_ai.usage.output_tokens", st.OutputTokens)
+	}
+	if status >= http.StatusInternalServerError {
+		s.setError(http.StatusText(status))
+	}
+	s.finish()
+}
+
+// injectTraceparent adds the trace context of ctx to outgoing headers
+func injectTraceparent(ctx context.Context, h http.Header) {
+	var sc spanContext
+	if s := spanFrom(ctx); s != nil {
+		sc = s.sc
+	} else if remote, ok := ctx.Value(remoteSpanKey{}).(spanContext); ok {
+		sc = remote
+	} else {
+		return
+	}
+	h.Set("traceparent", sc.traceparent())
+	if sc.TraceState != "" {
+		h.Set("tracestate", sc.TraceState)
+	}
+}
+
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	if v, ok := value.(string); ok && v == "" {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, spanAttr{key, value})
+	s.mu.Unlock()
+}
+
+func (s *span) addEvent(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, spanEvent{time.Now(), name})
+	s.mu.Unlock()
+}
+
+func (s *span) setError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = msg
+	s.mu.Unlock()
+}
+
+// finish ends the span and queues it for export
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if exp := tracer.Load(); exp != nil {
+		exp.enqueue(s)
+	}
+}
+
+// sample decides whether a new trace is recorded, based on its trace ID so
+// the decision is consistent for every span of the trace
+func (e *spanExporter) sample(id traceID) bool {
+	ratio := e.cfg.SampleRatio
+	if ratio >= 1 {
+		return true
+	}
+	var x uint64
+	for _, b := range id[8:] {
+		x = x<<8 | uint64(b)
+	}
+	return float64(x>>11)/float64(1<<53) < math.Max(ratio, 0)
+}
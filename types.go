@@ -5,7 +5,7 @@ import "github.com/goccy/go-json"
 // ================= Common =================
 
 type AnthropicContent struct {
-	Type string `json:"type"` // "text", "tool_use", "tool_result"
+	Type string `json:"type"` // "text", "image", "document", "tool_use", "tool_result"
 
 	// Type: text
 	Text string `json:"text,omitempty"`
@@ -15,25 +15,36 @@ type AnthropicContent struct {
 	Name  string          `json:"name,omitempty"`
 	Input json.RawMessage `json:"input,omitempty"`
 
-	// Type: image
-	Source *AnthropicImageSource `json:"source,omitempty"`
+	// Type: image, document
+	Source *AnthropicSource `json:"source,omitempty"`
+
+	// Type: document
+	Title     string          `json:"title,omitempty"`
+	Context   string          `json:"context,omitempty"`
+	Citations json.RawMessage `json:"citations,omitempty"` // {"enabled": true}
 
 	// Type: tool_result
 	ToolUseID string          `json:"tool_use_id,omitempty"`
 	Content   json.RawMessage `json:"content,omitempty"` // string or []Content
 	IsError   bool            `json:"is_error,omitempty"`
+
+	CacheControl json.RawMessage `json:"cache_control,omitempty"` // {"type": "ephemeral"}
 }
 
-type AnthropicImageSource struct {
-	Type      string `json:"type"`       // "base64"
-	MediaType string `json:"media_type"` // "image/jpeg", "image/png", etc.
-	Data      string `json:"data"`       // base64
+type AnthropicSource struct {
+	Type      string          `json:"type"`                 // "base64", "text", "content", "url", "file"
+	MediaType string          `json:"media_type,omitempty"` // "image/jpeg", "application/pdf", "text/plain", etc.
+	Data      string          `json:"data,omitempty"`       // base64, or the text of a text source
+	URL       string          `json:"url,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"` // string or []Content, for content sources
+	FileID    string          `json:"file_id,omitempty"`
 }
 
 type AnthropicTool struct {
-	Name        string          `json:"name"`
-	Description string          `json:"description,omitempty"`
-	InputSchema json.RawMessage `json:"input_schema"` // JSON Schema
+	Name         string          `json:"name"`
+	Description  string          `json:"description,omitempty"`
+	InputSchema  json.RawMessage `json:"input_schema"` // JSON Schema
+	CacheControl json.RawMessage `json:"cache_control,omitempty"`
 }
 
 // ================= Anthropic New (/v1/messages) =================
@@ -86,18 +97,27 @@ type OAMessage struct {
 }
 
 type OAContentPart struct {
-	Type     string      `json:"type"` // "text", "image_url"
+	Type     string      `json:"type"` // "text", "image_url", "file"
 	Text     string      `json:"text,omitempty"`
 	ImageURL *OAImageURL `json:"image_url,omitempty"`
+	File     *OAFile     `json:"file,omitempty"`
+
+	CacheControl json.RawMessage `json:"cache_control,omitempty"` // Only for prompt_cache: cache_control routes
 }
 
 type OAImageURL struct {
 	URL string `json:"url"` // data:image/jpeg;base64,...
 }
 
+type OAFile struct {
+	Filename string `json:"filename,omitempty"`
+	FileData string `json:"file_data"` // data:application/pdf;base64,...
+}
+
 type OATool struct {
-	Type     string     `json:"type"` // "function"
-	Function OAFunction `json:"function"`
+	Type         string          `json:"type"` // "function"
+	Function     OAFunction      `json:"function"`
+	CacheControl json.RawMessage `json:"cache_control,omitempty"`
 }
 
 type OAFunction struct {
@@ -123,11 +143,14 @@ type OAStreamChunk struct {
 			Reasoning        string       `json:"reasoning,omitempty"` // 兼容某些厂商
 			ToolCalls        []OAToolCall `json:"tool_calls,omitempty"`
 		} `json:"delta"`
+		FinishReason string `json:"finish_reason,omitempty"`
 	} `json:"choices"`
-	Usage *struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-	} `json:"usage,omitempty"`
+	Usage *OAUsage `json:"usage,omitempty"`
+	// Some upstreams report failures mid-stream as an error chunk
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error,omitempty"`
 }
 
 // Anthropic Models API
@@ -165,8 +188,34 @@ type OAChatResp struct {
 		} `json:"message"`
 		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-	} `json:"usage"`
+	Usage OAUsage `json:"usage"`
+}
+
+// OAUsage is the token usage reported by the upstream
+type OAUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens     int `json:"cached_tokens"`
+		CacheWriteTokens int `json:"cache_write_tokens,omitempty"` // OpenRouter
+	} `json:"prompt_tokens_details,omitempty"`
+	PromptCacheHitTokens     int `json:"prompt_cache_hit_tokens,omitempty"`     // DeepSeek
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"` // LiteLLM, passed on from Anthropic
+}
+
+// cachedTokens returns how many prompt tokens were served from the cache
+func (u *OAUsage) cachedTokens() int {
+	if u.PromptTokensDetails != nil && u.PromptTokensDetails.CachedTokens > 0 {
+		return u.PromptTokensDetails.CachedTokens
+	}
+	return u.PromptCacheHitTokens
+}
+
+// cacheCreationTokens returns how many prompt tokens were written to the
+// cache, for upstreams that report it
+func (u *OAUsage) cacheCreationTokens() int {
+	if u.PromptTokensDetails != nil && u.PromptTokensDetails.CacheWriteTokens > 0 {
+		return u.PromptTokensDetails.CacheWriteTokens
+	}
+	return u.CacheCreationInputTokens
 }
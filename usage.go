@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ================= Usage Log =================
+
+// UsageRecord is one finished request in the usage log
+type UsageRecord struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Key            string    `json:"key,omitempty"`    // Key label, never the raw key
+	KeyID          string    `json:"key_id,omitempty"` // Full key hash, for budgets
+	Endpoint       string    `json:"endpoint"`
+	RequestedModel string    `json:"requested_model,omitempty"`
+	Model          string    `json:"model"` // Model sent upstream
+	Route          string    `json:"route,omitempty"`
+	Upstream       string    `json:"upstream"`
+	Stream         bool      `json:"stream"`
+	Status         int       `json:"status"`
+	LatencyMs      int64     `json:"latency_ms"`
+	TTFTMs         int64     `json:"ttft_ms,omitempty"`
+	InputTokens    int       `json:"input_tokens"`
+	OutputTokens   int       `json:"output_tokens"`
+	CachedTokens   int       `json:"cached_tokens,omitempty"`
+	CostUSD        float64   `json:"cost_usd,omitempty"`
+	Retries        int       `json:"retries,omitempty"`
+}
+
+// UsageLogConfig controls where usage records go. Files are rotated by
+// size: usage.jsonl.1 is the most recent rotated file.
+type UsageLogConfig struct {
+	Path     string // Empty disables the usage log
+	MaxSize  int64  // Bytes before rotation
+	MaxFiles int    // Rotated files to keep
+}
+
+type usageLog struct {
+	mu   sync.Mutex
+	cfg  UsageLogConfig
+	f    *os.File
+	size int64
+}
+
+var usage = &usageLog{}
+
+func newUsageRecord(endpoint string, st *requestStats, status int, end time.Time) *UsageRecord {
+	rec := &UsageRecord{
+		Time:           st.Start.UTC(),
+		RequestID:      st.RequestID,
+		Key:            st.Key,
+		KeyID:          st.KeyID,
+		Endpoint:       endpoint,
+		RequestedModel: st.RequestedModel,
+		Model:          st.Model,
+		Route:          st.Route,
+		Upstream:       st.Upstream,
+		Stream:         st.Stream,
+		Status:         status,
+		LatencyMs:      end.Sub(st.Start).Milliseconds(),
+		InputTokens:    st.InputTokens,
+		OutputTokens:   st.OutputTokens,
+		CachedTokens:   st.CachedTokens,
+		CostUSD:        st.CostUSD,
+		Retries:        st.Retries,
+	}
+	if !st.FirstToken.IsZero() {
+		rec.TTFTMs = st.FirstToken.Sub(st.Start).Milliseconds()
+	}
+	return rec
+}
+
+// configure applies a new config, reopening the file if the path changed.
+// A file that can't be opened is logged and the usage log turned off, as
+// it is not worth refusing to serve over; the next reload tries again.
+func (u *usageLog) configure(cfg UsageLogConfig) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if cfg.Path == u.cfg.Path {
+		u.cfg = cfg
+		return
+	}
+	var f *os.File
+	var size int64
+	if cfg.Path != "" {
+		var err error
+		if f, err = os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			usageLogger.Error("cannot open usage log, running without it", "path", cfg.Path, "error", err)
+			cfg.Path = ""
+		} else if fi, err := f.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+	if u.f != nil {
+		u.f.Close()
+	}
+	u.cfg, u.f, u.size = cfg, f, size
+}
+
+// record appends rec, rotating first if the file would grow too large
+func (u *usageLog) record(rec *UsageRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.f == nil {
+		return
+	}
+	if u.cfg.MaxSize > 0 && u.size > 0 && u.size+int64(len(b)) > u.cfg.MaxSize {
+		if err := u.rotate(); err != nil {
+			usageLogger.Error("usage log rotation failed", "error", err)
+		}
+	}
+	n, err := u.f.Write(b)
+	u.size += int64(n)
+	if err != nil {
+		usageLogger.Error("usage log write failed", "error", err)
+	}
+}
+
+// rotate shifts usage.jsonl -> .1 -> .2 ... and drops the oldest file.
+// Must be called with u.mu held.
+func (u *usageLog) rotate() error {
+	path := u.cfg.Path
+	u.f.Close()
+	dropped := fmt.Sprintf("%s.%d", path, u.cfg.MaxFiles)
+	if u.cfg.MaxFiles == 0 {
+		dropped = path
+	}
+	if err := archiveSpend(path, dropped); err != nil {
+		usageLogger.Error("failed to archive spend of rotated usage log", "file", dropped, "error", err)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", path, u.cfg.MaxFiles))
+	for i := u.cfg.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if u.cfg.MaxFiles > 0 {
+		os.Rename(path, path+".1")
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		u.f = nil
+		return err
+	}
+	u.f, u.size = f, 0
+	return nil
+}
+
+// files lists the log files from oldest to newest
+func (u *usageLog) files() []string {
+	u.mu.Lock()
+	cfg := u.cfg
+	u.mu.Unlock()
+	if cfg.Path == "" {
+		return nil
+	}
+
+	var out []string
+	for i := cfg.MaxFiles; i >= 1; i-- {
+		p := fmt.Sprintf("%s.%d", cfg.Path, i)
+		if _, err := os.Stat(p); err == nil {
+			out = append(out, p)
+		}
+	}
+	return append(out, cfg.Path)
+}
+
+// scan calls fn for every record in time order. Partially written or
+// corrupt lines are skipped.
+func (u *usageLog) scan(fn func(*UsageRecord)) error {
+	for _, path := range u.files() {
+		err := scanUsageFile(path, fn)
+		if os.IsNotExist(err) {
+			continue // Rotated away while we were reading
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanUsageFile(path string, fn func(*UsageRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var rec UsageRecord
+		if json.Unmarshal(sc.Bytes(), &rec) == nil {
+			fn(&rec)
+		}
+	}
+	return sc.Err()
+}
+
+// ================= Usage Query =================
+
+// usageQuery filters usage records
+type usageQuery struct {
+	From, To time.Time // To is exclusive; zero means unbounded
+	Key      string
+	Model    string // Matches the requested or the upstream model
+	Upstream string
+}
+
+func (q *usageQuery) match(rec *UsageRecord) bool {
+	if !q.From.IsZero() && rec.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !rec.Time.Before(q.To) {
+		return false
+	}
+	if q.Key != "" && rec.Key != q.Key {
+		return false
+	}
+	if q.Model != "" && rec.Model != q.Model && rec.RequestedModel != q.Model {
+		return false
+	}
+	if q.Upstream != "" && rec.Upstream != q.Upstream {
+		return false
+	}
+	return true
+}
+
+// parseUsageTime accepts a date (2006-01-02) or an RFC 3339 timestamp.
+// For the upper bound a date includes the whole day.
+func parseUsageTime(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// usageRow is one aggregated group
+type usageRow struct {
+	Key          string  `json:"key,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	Upstream     string  `json:"upstream,omitempty"`
+	Day          string  `json:"day,omitempty"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	CachedTokens int64   `json:"cached_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+
+	latencyMs int64
+}
+
+var usageGroups = []string{"key", "model", "upstream", "day"}
+
+// usageAggregator groups records by the given dimensions while scanning,
+// so large logs don't have to be held in memory
+type usageAggregator struct {
+	groupBy []string
+	rows    map[string]*usageRow
+}
+
+func newUsageAggregator(groupBy []string) *usageAggregator {
+	return &usageAggregator{groupBy: groupBy, rows: make(map[string]*usageRow)}
+}
+
+func (a *usageAggregator) add(rec *UsageRecord) {
+	var row usageRow
+	for _, g := range a.groupBy {
+		switch g {
+		case "key":
+			row.Key = rec.Key
+		case "model":
+			row.Model = rec.Model
+		case "upstream":
+			row.Upstream = rec.Upstream
+		case "day":
+			row.Day = rec.Time.Format(time.DateOnly)
+		}
+	}
+	id := row.Day + "\xff" + row.Key + "\xff" + row.Model + "\xff" + row.Upstream
+	r, ok := a.rows[id]
+	if !ok {
+		r = &row
+		a.rows[id] = r
+	}
+	r.Requests++
+	if rec.Status >= http.StatusBadRequest {
+		r.Errors++
+	}
+	r.InputTokens += int64(rec.InputTokens)
+	r.OutputTokens += int64(rec.OutputTokens)
+	r.CachedTokens += int64(rec.CachedTokens)
+	r.CostUSD += rec.CostUSD
+	r.latencyMs += rec.LatencyMs
+}
+
+// result returns the groups sorted by day, key, model and upstream
+func (a *usageAggregator) result() []*usageRow {
+	rows := a.rows
+	out := make([]*usageRow, 0, len(rows))
+	for _, r := range rows {
+		r.AvgLatencyMs = float64(r.latencyMs) / float64(r.Requests)
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Upstream < b.Upstream
+	})
+	return out
+}
+
+// usageHandler serves the usage log (admin auth):
+//
+//	GET /api/usage?from=2026-01-01&to=2026-01-07&key=alice&model=gpt-4o
+//	    &group_by=key,model,day&format=csv&limit=1000
+//
+// Without group_by the most recent matching records are returned.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ant2oa"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	var q usageQuery
+	var err error
+	if q.From, err = parseUsageTime(params.Get("from"), false); err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseUsageTime(params.Get("to"), true); err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Key, q.Model, q.Upstream = params.Get("key"), params.Get("model"), params.Get("upstream")
+
+	var groupBy []string
+	if v := params.Get("group_by"); v != "" {
+		for _, g := range strings.Split(v, ",") {
+			if g = strings.TrimSpace(g); indexOf(usageGroups, g) < 0 {
+				http.Error(w, fmt.Sprintf("invalid group_by %q (use %s)", g, strings.Join(usageGroups, ", ")), http.StatusBadRequest)
+				return
+			}
+			groupBy = append(groupBy, g)
+		}
+	}
+	limit := 1000
+	if v := params.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	format := params.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "invalid format (use json or csv)", http.StatusBadRequest)
+		return
+	}
+
+	var agg *usageAggregator
+	if len(groupBy) > 0 {
+		agg = newUsageAggregator(groupBy)
+	}
+	var records []*UsageRecord
+	err = usage.scan(func(rec *UsageRecord) {
+		if !q.match(rec) {
+			return
+		}
+		if agg != nil {
+			agg.add(rec)
+			return
+		}
+		records = append(records, rec)
+		if len(records) > 2*limit {
+			// Only the most recent records are returned
+			records = append(records[:0], records[len(records)-limit:]...)
+		}
+	})
+	if err != nil {
+		usageLogger.Error("usage log read failed", "error", err)
+		http.Error(w, "failed to read usage log", http.StatusInternalServerError)
+		return
+	}
+
+	if agg != nil {
+		rows := agg.result()
+		if format == "csv" {
+			writeUsageCSV(w, usageRowsCSV(rows, groupBy))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"group_by": groupBy, "rows": rows})
+		return
+	}
+
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	if format == "csv" {
+		writeUsageCSV(w, usageRecordsCSV(records))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"records": records})
+}
+
+func usageRecordsCSV(records []*UsageRecord) [][]string {
+	out := [][]string{{"time", "key", "endpoint", "requested_model", "model", "route", "upstream",
+		"stream", "status", "latency_ms", "ttft_ms", "input_tokens", "output_tokens", "cached_tokens", "cost_usd", "retries"}}
+	for _, r := range records {
+		out = append(out, []string{
+			r.Time.Format(time.RFC3339Nano), r.Key, r.Endpoint, r.RequestedModel, r.Model, r.Route, r.Upstream,
+			strconv.FormatBool(r.Stream), strconv.Itoa(r.Status), strconv.FormatInt(r.LatencyMs, 10),
+			strconv.FormatInt(r.TTFTMs, 10), strconv.Itoa(r.InputTokens), strconv.Itoa(r.OutputTokens),
+			strconv.Itoa(r.CachedTokens), strconv.FormatFloat(r.CostUSD, 'f', 6, 64), strconv.Itoa(r.Retries),
+		})
+	}
+	return out
+}
+
+func usageRowsCSV(rows []*usageRow, groupBy []string) [][]string {
+	header := append(append([]string(nil), groupBy...), "requests", "errors", "input_tokens", "output_tokens", "cached_tokens", "cost_usd", "avg_latency_ms")
+	out := [][]string{header}
+	for _, r := range rows {
+		var line []string
+		for _, g := range groupBy {
+			switch g {
+			case "key":
+				line = append(line, r.Key)
+			case "model":
+				line = append(line, r.Model)
+			case "upstream":
+				line = append(line, r.Upstream)
+			case "day":
+				line = append(line, r.Day)
+			}
+		}
+		line = append(line, strconv.FormatInt(r.Requests, 10), strconv.FormatInt(r.Errors, 10),
+			strconv.FormatInt(r.InputTokens, 10), strconv.FormatInt(r.OutputTokens, 10),
+			strconv.FormatInt(r.CachedTokens, 10), strconv.FormatFloat(r.CostUSD, 'f', 6, 64),
+			strconv.FormatFloat(r.AvgLatencyMs, 'f', 1, 64))
+		out = append(out, line)
+	}
+	return out
+}
+
+func writeUsageCSV(w http.ResponseWriter, rows [][]string) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.WriteAll(rows)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	w.Write(buf.Bytes())
+}